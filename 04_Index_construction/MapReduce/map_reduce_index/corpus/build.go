@@ -12,9 +12,11 @@ func (corpus *Corpus) BuildIndexFromSlice(data []string) {
 
 	corpus.wg.Add(len(data) * 4)
 
-	for i, s := range data {
+	for _, s := range data {
 		words := splitRaw(s)
-		go corpus.createIndex(words, i)
+		// IDs are given in the order of the slice, before the goroutines race
+		id := corpus.Registry.Register(DocumentInfo{Title: Title([]byte(s)), Length: len(words)})
+		go corpus.createIndex(words, id)
 		go corpus.buildKGrammIndexFromTerms(words)
 		go corpus.buildSoundexIndexFromTerms(words)
 		go corpus.buildAutomatonIndexFromTerms(words)
@@ -74,7 +76,6 @@ func (corpus *Corpus) BuildIndexFromSerializedTokens(tokens []SerializedToken) {
 // Create or update index for terms
 func (corpus *Corpus) createIndex(words []string, id int) {
 
-	id++
 	file := fmt.Sprintf("Doc%d", id)
 
 	for position, w := range words {
@@ -12,6 +12,7 @@ type Corpus struct {
 	kGramm  *KGrammIndex
 	soundex *SoundexIndex
 	automaton *Automaton
+	Registry  *Registry
 	mutex   *sync.Mutex
 	wg      *sync.WaitGroup
 }
@@ -37,6 +38,7 @@ func NewCorpus(kgrammSize int) *Corpus{
 			&sync.Mutex{},
 			&sync.WaitGroup{},
 		},
+		NewRegistry(),
 		&sync.Mutex{},
 		&sync.WaitGroup{},
 	}
@@ -0,0 +1,136 @@
+package corpus
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DocumentInfo is what the index knows about a document besides its terms
+type DocumentInfo struct {
+	ID    int
+	Path  string
+	Title string
+	// Document of the file, a file of many documents gives one to each of them
+	Part int
+	// Tokens in the document
+	Length int
+	// When the document was registered and when its file was last changed
+	Added    time.Time
+	Modified time.Time
+}
+
+// Registry gives every document a global ID. IDs grow monotonically and are never
+// given twice, so documents of different files, builders and segments do not collide.
+type Registry struct {
+	documents map[int]DocumentInfo
+	next      int
+	mutex     *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{make(map[int]DocumentInfo), 0, &sync.Mutex{}}
+}
+
+// Give the document the next ID, it is registered now unless Added is set
+func (r *Registry) Register(info DocumentInfo) int {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	info.ID = r.next
+	if info.Added.IsZero() {
+		info.Added = time.Now()
+	}
+	r.documents[info.ID] = info
+	r.next++
+
+	return info.ID
+
+}
+
+// Put the document under its own ID, the ID and those below it are never given again.
+// Added time of the registered document is kept unless it is set.
+func (r *Registry) Put(info DocumentInfo) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if old, ok := r.documents[info.ID]; ok && info.Added.IsZero() {
+		info.Added = old.Added
+	}
+	r.documents[info.ID] = info
+	if info.ID >= r.next {
+		r.next = info.ID + 1
+	}
+
+}
+
+// Forget the document, its ID is not given again
+func (r *Registry) Remove(id int) {
+
+	r.mutex.Lock()
+	delete(r.documents, id)
+	r.mutex.Unlock()
+
+}
+
+func (r *Registry) Get(id int) (DocumentInfo, bool) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	info, ok := r.documents[id]
+
+	return info, ok
+
+}
+
+// ID the next registered document gets
+func (r *Registry) NextID() int {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.next
+
+}
+
+func (r *Registry) Size() int {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.documents)
+
+}
+
+// Registered documents sorted by ID
+func (r *Registry) Documents() []DocumentInfo {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	docs := make([]DocumentInfo, 0, len(r.documents))
+	for _, info := range r.documents {
+		docs = append(docs, info)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+
+	return docs
+
+}
+
+// Title of a plain text document is its first non-empty line
+func Title(content []byte) string {
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+
+	return ""
+
+}
@@ -0,0 +1,150 @@
+package corpus
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+var ErrDocumentNotStored = errors.New("corpus: document is not stored")
+
+// StoredDocument is what the index gives back for a doc ID: the original text,
+// the path and fields that parsers keep but do not index
+type StoredDocument struct {
+	ID     int
+	Path   string
+	Text   string
+	Fields map[string]string
+}
+
+// DocumentStore keeps every document compressed on its own, so one document
+// is read without decompressing the others
+type DocumentStore struct {
+	documents map[int][]byte
+	mutex     *sync.Mutex
+}
+
+type serializedStore struct {
+	IDs       []int
+	Documents [][]byte
+}
+
+func NewDocumentStore() *DocumentStore {
+	return &DocumentStore{make(map[int][]byte), &sync.Mutex{}}
+}
+
+// Compress and add the document, a document of the same ID is replaced
+func (s *DocumentStore) Put(doc StoredDocument) error {
+
+	data := bytes.Buffer{}
+	if err := gob.NewEncoder(&data).Encode(doc); err != nil {
+		return err
+	}
+
+	b := bytes.Buffer{}
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.documents[doc.ID] = b.Bytes()
+	s.mutex.Unlock()
+
+	return nil
+
+}
+
+func (s *DocumentStore) Get(id int) (StoredDocument, error) {
+
+	s.mutex.Lock()
+	compressed, ok := s.documents[id]
+	s.mutex.Unlock()
+
+	if !ok {
+		return StoredDocument{}, ErrDocumentNotStored
+	}
+
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return StoredDocument{}, err
+	}
+
+	doc := StoredDocument{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&doc)
+
+	return doc, err
+
+}
+
+// Forget the document, nothing happens when it is not stored
+func (s *DocumentStore) Remove(id int) {
+
+	s.mutex.Lock()
+	delete(s.documents, id)
+	s.mutex.Unlock()
+
+}
+
+func (s *DocumentStore) Size() int {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.documents)
+
+}
+
+// Compressed documents sorted by ID
+func (s *DocumentStore) MarshalBinary() ([]byte, error) {
+
+	s.mutex.Lock()
+	ss := serializedStore{}
+	for id := range s.documents {
+		ss.IDs = append(ss.IDs, id)
+	}
+	sort.Ints(ss.IDs)
+	for _, id := range ss.IDs {
+		ss.Documents = append(ss.Documents, s.documents[id])
+	}
+	s.mutex.Unlock()
+
+	b := bytes.Buffer{}
+	err := gob.NewEncoder(&b).Encode(ss)
+
+	return b.Bytes(), err
+
+}
+
+// Add documents of the data to the store, documents of the same IDs are replaced
+func (s *DocumentStore) UnmarshalBinary(data []byte) error {
+
+	ss := serializedStore{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&ss); err != nil {
+		return err
+	}
+	if len(ss.IDs) != len(ss.Documents) {
+		return errors.New("corpus: corrupt document store")
+	}
+
+	s.mutex.Lock()
+	for i, id := range ss.IDs {
+		s.documents[id] = ss.Documents[i]
+	}
+	s.mutex.Unlock()
+
+	return nil
+
+}
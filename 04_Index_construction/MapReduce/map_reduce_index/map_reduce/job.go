@@ -0,0 +1,215 @@
+package map_reduce
+
+import (
+	"../corpus"
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// KeyValue is a pair a mapper emits or a reducer gives back
+type KeyValue[K cmp.Ordered, V any] struct {
+	Key   K
+	Value V
+}
+
+// Mapper emits pairs of one document, a document that fails is left out of the job
+type Mapper[K cmp.Ordered, V any] func(document corpus.DocumentInfo, emit func(K, V)) error
+
+// MapReduce is a batch job over documents of a collection: inversion, term statistics,
+// link extraction and the like. Pairs of every mapper are combined and partitioned,
+// the shuffle sorts every partition by key and one reducer per partition folds the values of each key.
+type MapReduce[K cmp.Ordered, V, R any] struct {
+	Map Mapper[K, V]
+	// Merges values of a key in the output of one mapper before the shuffle, may be nil
+	Combine func(key K, values []V) V
+	// Partition of the key, keys are hashed when it is nil
+	Partition func(key K, partitions int) int
+	// Reducers of the job, one when it is 0
+	Partitions int
+	// Values of the key come in the order of their documents and of their emission
+	Reduce func(key K, values []V) R
+	// Mappers that run at once, MaxWorkers when it is 0
+	Workers int
+}
+
+// Output of one document, split by partition
+type mapOutput[K cmp.Ordered, V any] struct {
+	seq   int
+	parts [][]KeyValue[K, V]
+	err   error
+}
+
+func (job *MapReduce[K, V, R]) partitions() int {
+
+	if job.Partitions < 1 {
+		return 1
+	}
+
+	return job.Partitions
+
+}
+
+func (job *MapReduce[K, V, R]) workers() int {
+
+	if job.Workers < 1 {
+		return MaxWorkers
+	}
+
+	return job.Workers
+
+}
+
+func (job *MapReduce[K, V, R]) partitionOf(key K) int {
+
+	n := job.partitions()
+	if job.Partition != nil {
+		return job.Partition(key, n)
+	}
+
+	h := fnv.New32a()
+	fmt.Fprint(h, key)
+
+	return int(h.Sum32() % uint32(n))
+
+}
+
+// Run the job until documents are over, the result holds a slice per partition sorted by key.
+// Documents that failed are reported along with the result of the rest.
+func (job *MapReduce[K, V, R]) Run(documents <-chan corpus.DocumentInfo) ([][]KeyValue[K, R], error) {
+
+	outputs := make(chan mapOutput[K, V], job.workers())
+
+	go func() {
+		wg := &sync.WaitGroup{}
+		workers := make(chan struct{}, job.workers())
+		seq := 0
+		for document := range documents {
+			workers <- struct{}{}
+			wg.Add(1)
+			go func(seq int, document corpus.DocumentInfo) {
+				defer wg.Done()
+				outputs <- job.mapDocument(seq, document)
+				<-workers
+			}(seq, document)
+			seq++
+		}
+		wg.Wait()
+		close(outputs)
+	}()
+
+	// outputs are put back in the order of their documents, so the shuffle is stable
+	mapped := make([][][]KeyValue[K, V], 0)
+	failed := make([]error, 0)
+	for output := range outputs {
+		for len(mapped) <= output.seq {
+			mapped = append(mapped, nil)
+		}
+		if output.err != nil {
+			failed = append(failed, output.err)
+			continue
+		}
+		mapped[output.seq] = output.parts
+	}
+
+	result := make([][]KeyValue[K, R], job.partitions())
+	wg := &sync.WaitGroup{}
+	wg.Add(len(result))
+
+	for p := range result {
+		go func(p int) {
+			defer wg.Done()
+			result[p] = group(shuffle(mapped, p), func(key K, values []V) KeyValue[K, R] {
+				return KeyValue[K, R]{key, job.Reduce(key, values)}
+			})
+		}(p)
+	}
+	wg.Wait()
+
+	var err error
+	if len(failed) > 0 {
+		err = fmt.Errorf("map_reduce: %d documents failed, first: %v", len(failed), failed[0])
+	}
+
+	return result, err
+
+}
+
+// Map and combine one document, a panic of the mapper fails the document only
+func (job *MapReduce[K, V, R]) mapDocument(seq int, document corpus.DocumentInfo) (output mapOutput[K, V]) {
+
+	output.seq = seq
+	defer func() {
+		if r := recover(); r != nil {
+			output.parts = nil
+			output.err = fmt.Errorf("%s: %v", document.Path, r)
+		}
+	}()
+
+	pairs := make([]KeyValue[K, V], 0)
+	if output.err = job.Map(document, func(key K, value V) {
+		pairs = append(pairs, KeyValue[K, V]{key, value})
+	}); output.err != nil {
+		return output
+	}
+
+	if job.Combine != nil {
+		sortByKey(pairs)
+		pairs = group(pairs, func(key K, values []V) KeyValue[K, V] {
+			return KeyValue[K, V]{key, job.Combine(key, values)}
+		})
+	}
+
+	output.parts = make([][]KeyValue[K, V], job.partitions())
+	for _, pair := range pairs {
+		p := job.partitionOf(pair.Key)
+		output.parts[p] = append(output.parts[p], pair)
+	}
+
+	return output
+
+}
+
+// Pairs of the partition from every document, sorted by key
+func shuffle[K cmp.Ordered, V any](mapped [][][]KeyValue[K, V], p int) []KeyValue[K, V] {
+
+	pairs := make([]KeyValue[K, V], 0)
+	for _, parts := range mapped {
+		// a failed document has no output
+		if parts != nil {
+			pairs = append(pairs, parts[p]...)
+		}
+	}
+
+	sortByKey(pairs)
+
+	return pairs
+
+}
+
+// Pairs of equal keys keep their order
+func sortByKey[K cmp.Ordered, V any](pairs []KeyValue[K, V]) {
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+}
+
+// Fold values of every key, pairs of a key must follow each other
+func group[K cmp.Ordered, V, R any](pairs []KeyValue[K, V], fold func(K, []V) KeyValue[K, R]) []KeyValue[K, R] {
+
+	result := make([]KeyValue[K, R], 0)
+	for i := 0; i < len(pairs); {
+		j := i
+		values := make([]V, 0)
+		for ; j < len(pairs) && pairs[j].Key == pairs[i].Key; j++ {
+			values = append(values, pairs[j].Value)
+		}
+		result = append(result, fold(pairs[i].Key, values))
+		i = j
+	}
+
+	return result
+
+}
@@ -0,0 +1,110 @@
+package map_reduce
+
+import (
+	"../corpus"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testDocuments(texts ...string) chan corpus.DocumentInfo {
+
+	documents := make(chan corpus.DocumentInfo, len(texts))
+	for i, text := range texts {
+		documents <- corpus.DocumentInfo{ID: i, Path: fmt.Sprintf("doc%d", i), Title: text}
+	}
+	close(documents)
+
+	return documents
+
+}
+
+func TestMapReduceCombiner(t *testing.T) {
+
+	combined := 0
+	// collection frequency of every term, the text is the title
+	job := &MapReduce[string, int, int]{
+		Map: func(document corpus.DocumentInfo, emit func(string, int)) error {
+			for _, term := range strings.Fields(document.Title) {
+				emit(term, 1)
+			}
+			return nil
+		},
+		Combine: func(term string, counts []int) int {
+			combined++
+			sum := 0
+			for _, c := range counts {
+				sum += c
+			}
+			return sum
+		},
+		Partitions: 2,
+		Reduce: func(term string, counts []int) int {
+			sum := 0
+			for _, c := range counts {
+				sum += c
+			}
+			return sum
+		},
+		Workers: 1,
+	}
+
+	result, err := job.Run(testDocuments("to be or not to be", "be quick", "not now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one value per distinct term of every document reaches the shuffle
+	if combined != 8 {
+		t.Errorf("expected 8 combined terms, got %d", combined)
+	}
+
+	counts := make(map[string]int)
+	for p, pairs := range result {
+		for i, pair := range pairs {
+			if i > 0 && pairs[i-1].Key >= pair.Key {
+				t.Errorf("expected partition %d sorted by key, got %v", p, pairs)
+			}
+			if job.partitionOf(pair.Key) != p {
+				t.Errorf("expected %q in partition %d, got it in %d", pair.Key, job.partitionOf(pair.Key), p)
+			}
+			counts[pair.Key] = pair.Value
+		}
+	}
+	expected := map[string]int{"to": 2, "be": 3, "or": 1, "not": 2, "quick": 1, "now": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v, got %v", expected, counts)
+	}
+
+}
+
+func TestMapReduceShuffleOrder(t *testing.T) {
+
+	// values of a key come in the order of documents, whatever order mappers finish in
+	job := &MapReduce[string, int, []int]{
+		Map: func(document corpus.DocumentInfo, emit func(string, int)) error {
+			if document.ID == 2 {
+				return errors.New("unreadable")
+			}
+			for _, term := range strings.Fields(document.Title) {
+				emit(term, document.ID)
+			}
+			return nil
+		},
+		Reduce: func(term string, ids []int) []int {
+			return ids
+		},
+	}
+
+	result, err := job.Run(testDocuments("b a", "a", "a b", "b b", "c a"))
+	if err == nil || !strings.Contains(err.Error(), "unreadable") {
+		t.Errorf("expected the failed document reported, got %v", err)
+	}
+
+	expected := [][]KeyValue[string, []int]{{{"a", []int{0, 1, 4}}, {"b", []int{0, 3, 3}}, {"c", []int{4}}}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+
+}
@@ -3,190 +3,146 @@ package map_reduce
 import (
 	"../corpus"
 	"fmt"
-	"io"
-	"log"
-	"os"
+	"strings"
 	"sync"
-	"time"
 )
 
 // Flow:
 // a) Parser:
 // 1) parse documents and get tokens
-// 2) map function => sent parsed tokens into reducer
-// 3) divide parsed tokens into diapasons of different first letters
-// 4) reduce function => save results into segment files
+// 2) map function => emit every token under its term
+// 3) partitioner => divide terms into diapasons of different first letters
+// 4) shuffle => sort tokens of every diapason by term
 // b) Inverter:
-// 5) inverter => create 1 big inverted index from segment files
-
-// MapperCollector is a channel that collects the output from mapper tasks
-type MapperCollector chan chan interface{}
+// 5) reduce function => postings of every term
+// 6) inverter => one inverter per diapason creates an index shard from its postings
+
+// Mapper of the documents registered by enumerateFiles, the mapper parses the file again
+// and takes the part of the document. Lines of the text have the ID of the document and positions
+// run on from line to line. The registry learns the length, the store keeps the text and fields.
+// A file that can not be read or parsed or a document that can not be stored is removed
+// from the registry and fails the document.
+func newMapper(registry *corpus.Registry, store *corpus.DocumentStore, config corpus.ParserConfig) Mapper[string, corpus.Token] {
+
+	// documents of a file come one after another, so the last parsed file is kept
+	last := struct {
+		path  string
+		docs  []corpus.ParsedDocument
+		mutex sync.Mutex
+	}{}
+	// mappers parse different files at the same time, the lock guards the cache only
+	parse := func(path string) ([]corpus.ParsedDocument, error) {
+		last.mutex.Lock()
+		if last.path == path {
+			docs := last.docs
+			last.mutex.Unlock()
+			return docs, nil
+		}
+		last.mutex.Unlock()
 
-// MapperFunc is a function that performs the mapping part of the MapReduce job
-type MapperFunc func(interface{}, chan interface{})
+		docs, err := parseFile(path, config)
+		if err != nil {
+			return nil, err
+		}
 
-// ReducerFunc is a function that performs the reduce part of the MapReduce job
-type ReducerFunc func(chan interface{}, chan interface{})
+		last.mutex.Lock()
+		last.path, last.docs = path, docs
+		last.mutex.Unlock()
+		return docs, nil
+	}
 
-// InverterFunc is a function that performs the invert part of the MapReduce job
-type InverterFunc func(chan interface{}, chan interface{}, int)
+	return func(info corpus.DocumentInfo, emit func(string, corpus.Token)) error {
 
-func mapper(filename interface{}, output chan interface{}) {
+		length := 0
 
-	tokens := make([]corpus.Token, 0)
+		docs, err := parse(info.Path)
+		if err == nil && info.Part >= len(docs) {
+			err = fmt.Errorf("%s: document %d is gone from the file", info.Path, info.Part)
+		}
+		if err != nil {
+			registry.Remove(info.ID)
+			return err
+		}
+		doc := docs[info.Part]
+		if err := store.Put(corpus.StoredDocument{ID: info.ID, Path: info.Path, Text: doc.Text, Fields: doc.Fields}); err != nil {
+			registry.Remove(info.ID)
+			return err
+		}
 
-	docID := 0
+		// start the enumeration of each line in the document
+		for _, line := range strings.SplitAfter(doc.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			for _, term := range tokenize(line) {
+				length++
+				emit(term, corpus.Token{
+					Term:     term,
+					Position: length,
+					DocID:    info.ID,
+					File:     info.Path,
+				})
+			}
+		}
 
-	// start the enumeration of each line in the file
-	for line := range enumerateFile(filename.(string)) {
-		terms := tokenize(line)
+		info.Title = doc.Title
+		info.Length = length
+		registry.Put(info)
 
-		for pos, term := range terms {
-			tokens = append(tokens, corpus.Token{
-				Term:     term,
-				Position: pos + 1,
-				DocID:    docID,
-				File: 	  filename.(string),
-			})
-		}
+		return nil
 
-		docID++
 	}
 
-	output <- tokens
-
 }
 
-func reducer(input, output chan interface{}) {
-	//results := make(blocks, 0)
-	results := make(chan string)
-	idx := 0
-	for tokens := range input {
-		go func(tokens []corpus.Token, idx int) {
-			results <- createSegmentFiles(tokens, idx)
-		}(tokens.([]corpus.Token), idx)
-		// write tokens into segment file and save filename
-		//results = append(results, createSegmentFiles(tokens.([]corpus.Token), idx))
-		idx++
+// IndexJob inverts documents into postings of every term, partitioned by term diapasons
+type IndexJob = MapReduce[string, corpus.Token, []corpus.Token]
+
+// Job of the mapper, the postings of a term are its tokens in the order of documents and positions
+func newIndexJob(mapper Mapper[string, corpus.Token]) *IndexJob {
+	return &IndexJob{
+		Map:        mapper,
+		Partition:  func(term string, _ int) int { return partitionOf(term) },
+		Partitions: len(partitions),
+		Reduce: func(term string, tokens []corpus.Token) []corpus.Token {
+			return tokens
+		},
 	}
-	for res := range results {
-		output <- res
-	}
-
-	close(results)
-
 }
 
-// open segment files and create Corpus
-func inverter (input, output chan interface{}, length int) {
-	// corpus
-	result := make(chan []corpus.Token)
+// One inverter per partition builds its shard from the postings of the partition
+func invert(postings [][]KeyValue[string, []corpus.Token]) TermPartitionedIndex {
 
+	shards := make(TermPartitionedIndex, len(postings))
 	wg := &sync.WaitGroup{}
-
-	counter := 0
-
-	go func() {
-
-		// it is just a hack not to get error that input gourutine if asleep
-		for counter != length {
-
-			b := <-input
-
-			wg.Add(1)
-
-			go func(filename string) {
-
-				f, err := os.Open(b.(string))
-				if err != nil {
-					log.Println(err)
-				}
-
-				defer f.Close()
-
-				stat, err := f.Stat()
-				if err != nil {
-					log.Println(err)
-				}
-
-				time.Sleep(2 * time.Second)
-
-				data := make([]byte, stat.Size())
-
-				for {
-					_, err = f.Read(data)
-					if err != nil {
-						if err == io.EOF {
-							break // end of the file
-						} else {
-							fmt.Println("Error reading file");
-							os.Exit(1)
-						}
-					}
-				}
-
-				result <- FromGOB64(string(data))
-				wg.Done()
-
-			}(b.(string))
-
-			counter++
-		}
-
-		go func() {
-			wg.Wait()
-			close(result)
-		}()
-
-	}()
-
-	c := corpus.NewCorpus(2)
-
-	for res := range result {
-		go func() {
-			c.BuildIndexFromParsedTokens(res)
-		}()
+	wg.Add(len(postings))
+
+	for p := range postings {
+		shards[p] = corpus.NewCorpus(2)
+		go func(shard *corpus.Corpus, postings []KeyValue[string, []corpus.Token]) {
+			defer wg.Done()
+			tokens := make([]corpus.Token, 0)
+			for _, term := range postings {
+				tokens = append(tokens, term.Value...)
+			}
+			shard.BuildIndexFromParsedTokens(tokens)
+		}(shards[p], postings[p])
 	}
+	wg.Wait()
 
-	output <- c
-}
-
-// The mapperDispatcher function is responsible to listen on the data channel that receives each filename
-// to be processed and invoke a mapper for each file, pushing the output of the job into a MapperCollector
-func mapperDispatcher(mapper MapperFunc, input chan interface{}, collector MapperCollector) {
-	for item := range input {
-		taskOutput := make(chan interface{})
-		go mapper(item, taskOutput)
-		collector <- taskOutput
-	}
-	close(collector)
-}
+	return shards
 
-// The reducerDispatcher function is responsible to listen on the collector channel
-// and push each item as the data for the Reducer task.
-func reducerDispatcher(collector MapperCollector, reducerInput chan interface{}) {
-	for output := range collector {
-		reducerInput <- <-output
-	}
-	close(reducerInput)
 }
 
 const (
 	MaxWorkers = 10
 )
 
-func mapReduce(mapper MapperFunc, reducer ReducerFunc, inverter InverterFunc, input chan interface{}, length int) interface{} {
+// Index documents in one process, documents that failed are reported along with the index of the rest
+func buildIndex(mapper Mapper[string, corpus.Token], documents <-chan corpus.DocumentInfo) (TermPartitionedIndex, error) {
 
-	reducerInput := make(chan interface{}, length)
-	reducerOutput := make(chan interface{}, length)
-	inverterOutput := make(chan interface{})
-	mapperCollector := make(MapperCollector, MaxWorkers)
+	postings, err := newIndexJob(mapper).Run(documents)
 
-	go reducer(reducerInput, reducerOutput)
-	go reducerDispatcher(mapperCollector, reducerInput)
-	go mapperDispatcher(mapper, input, mapperCollector)
-	go inverter(reducerOutput, inverterOutput, length)
+	return invert(postings), err
 
-	return <-inverterOutput
-
-}
\ No newline at end of file
+}
@@ -3,7 +3,10 @@ package map_reduce
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"../corpus"
 )
@@ -23,16 +26,138 @@ func TestMapReduce(t *testing.T) {
 	//TODO: I don't know why, but big files rape this program
 	// RAM is fully loaded
 
+	// documents of every file get their IDs here and their text is kept
+	registry := corpus.NewRegistry()
+	store := corpus.NewDocumentStore()
+
 	// start the enumeration of files to be processed into a channel
-	input := enumerateFiles("data")
+	input := enumerateFiles("data", registry, corpus.ParserConfig{})
 
-	// get amount of files in dir, just a `hack`
 	length := getFilesLength("data")
 
 	// this will start the map reduce work
-	c := mapReduce(mapper, reducer, inverter, input, length)
+	index, err := buildIndex(newMapper(registry, store, corpus.ParserConfig{}), input)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	fmt.Println(c.(*corpus.Corpus).FuzzySearch("world", 1))
+	fmt.Println(index.Shard("world").FuzzySearch("world", 1))
+
+	// every shard holds terms of its own diapason only
+	for p, shard := range index {
+		if shard.Size() == 0 {
+			t.Errorf("expected terms in shard %s", partitions[p])
+		}
+		for _, term := range shard.Keys() {
+			if partitionOf(term.(string)) != p {
+				t.Errorf("expected %q in shard %s, got it in %s", term, partitions[partitionOf(term.(string))], partitions[p])
+				break
+			}
+		}
+	}
+	if _, ok := index.Shard("world").Get("world"); !ok {
+		t.Error("expected world in the q-z shard")
+	}
+
+	if registry.Size() != length {
+		t.Errorf("expected %d registered documents, got %d", length, registry.Size())
+	}
+
+	dir, err := ioutil.TempDir("", "map_reduce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := createStoreFile(dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := corpus.NewDocumentStore()
+	if err := stored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range registry.Documents() {
+		text, _ := ioutil.ReadFile(info.Path)
+		if doc, err := stored.Get(info.ID); err != nil || doc.Path != info.Path || len(doc.Text) == 0 || !strings.HasPrefix(string(text), doc.Text) {
+			t.Errorf("expected text of %s, got %d bytes, %v", info.Path, len(doc.Text), err)
+		}
+	}
 
 	fmt.Println("Done!")
 }
+
+func TestPartitionOf(t *testing.T) {
+	for term, expected := range map[string]int{"Apple": 0, "fear": 0, "1st": 0, "": 0, "hamlet": 1, "Player": 1, "queen": 2, "zebra": 2, "~": 2} {
+		if p := partitionOf(term); p != expected {
+			t.Errorf("expected %q in shard %s, got %s", term, partitions[expected], partitions[p])
+		}
+	}
+}
+
+func TestMapReduceUnreadableFile(t *testing.T) {
+	data, _ := newTestJob(t)
+	defer os.RemoveAll(filepath.Dir(data))
+
+	// a file that is gone between the listing and its mapper
+	if err := os.Symlink(filepath.Join(data, "missing.txt"), filepath.Join(data, "doc9.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := corpus.NewRegistry()
+	index, err := buildIndex(newMapper(registry, corpus.NewDocumentStore(), corpus.ParserConfig{}), enumerateFiles(data, registry, corpus.ParserConfig{}))
+	if err == nil || !strings.Contains(err.Error(), "doc9.txt") {
+		t.Errorf("expected the unreadable file reported, got %v", err)
+	}
+
+	if docs, _ := index.Shard("zebra5").Get("zebra5"); docs == nil {
+		t.Error("expected the readable files indexed")
+	}
+	if registry.Size() != 6 {
+		t.Errorf("expected the unreadable file out of the registry, got %d documents", registry.Size())
+	}
+}
+
+func TestMapReduceDocumentsOfFile(t *testing.T) {
+	data, _ := newTestJob(t)
+	defer os.RemoveAll(filepath.Dir(data))
+
+	ioutil.WriteFile(filepath.Join(data, "rows.csv"), []byte("id,title,text\nz,Zebra,what did giraffe say\ny,,lion\n"), 0666)
+	ioutil.WriteFile(filepath.Join(data, "page.html"), []byte("<title>Page</title><p>what did <b>okapi</b> say</p>"), 0666)
+
+	registry := corpus.NewRegistry()
+	store := corpus.NewDocumentStore()
+	index, err := buildIndex(newMapper(registry, store, corpus.ParserConfig{}), enumerateFiles(data, registry, corpus.ParserConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// doc0.txt to doc5.txt, page.html and two rows of rows.csv
+	if registry.Size() != 9 {
+		t.Fatalf("expected every row registered, got %d documents", registry.Size())
+	}
+	docs := registry.Documents()
+	for i, expected := range []corpus.DocumentInfo{
+		{ID: 6, Path: filepath.Join(data, "page.html"), Title: "Page", Length: 4},
+		{ID: 7, Path: filepath.Join(data, "rows.csv"), Title: "Zebra", Length: 4},
+		{ID: 8, Path: filepath.Join(data, "rows.csv"), Title: "lion", Part: 1, Length: 1},
+	} {
+		info := docs[6+i]
+		info.Added, info.Modified = expected.Added, expected.Modified
+		if info != expected {
+			t.Errorf("expected %v, got %v", expected, info)
+		}
+	}
+
+	if doc, err := store.Get(7); err != nil || doc.Text != "what did giraffe say" || doc.Fields["id"] != "z" {
+		t.Errorf("expected the first row stored with its id, got %v, %v", doc, err)
+	}
+	for term, id := range map[string]int{"okapi": 6, "giraffe": 7, "lion": 8} {
+		if docs, _ := index.Shard(term).Get(term); docs == nil {
+			t.Errorf("expected %s of document %d indexed", term, id)
+		}
+	}
+}
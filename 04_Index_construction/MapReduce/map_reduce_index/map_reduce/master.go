@@ -0,0 +1,513 @@
+package map_reduce
+
+import (
+	"../corpus"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Master hands out tasks of one job to worker processes over net/rpc:
+// a map task per document first, then a reduce task per term partition.
+// Segment files of map tasks and shards of reduce tasks are exchanged through dir,
+// every worker must see it under the same path.
+// Tasks of workers that fail, die or fall behind are given again as the RetryPolicy says,
+// the first result of a task is taken and later ones are ignored.
+type Master struct {
+	dir      string
+	registry *corpus.Registry
+	policy   RetryPolicy
+	maps     []*mapTask
+	reduces  []*reduceTask
+	listener net.Listener
+	// stops the monitor of timeouts
+	done chan struct{}
+	// guards tasks, workers asking for a task wait on it until there is one
+	mutex   *sync.Mutex
+	changed *sync.Cond
+}
+
+// RetryPolicy tells when a task is given to a worker again
+type RetryPolicy struct {
+	// Running task is given again when no attempt reported for this long, its workers are presumed dead
+	TaskTimeout time.Duration
+	// Task is given up after this many failed attempts, the job goes on without it
+	MaxAttempts int
+	// Running task gets a backup attempt after this long when no task is idle
+	SpeculativeAfter time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	TaskTimeout:      time.Minute,
+	MaxAttempts:      3,
+	SpeculativeAfter: 10 * time.Second,
+}
+
+type taskState int
+
+const (
+	taskIdle taskState = iota
+	taskRunning
+	taskDone
+	// every attempt failed
+	taskFailed
+)
+
+// task is the state of a map or reduce task
+type task struct {
+	state taskState
+	// IDs of attempts running now, the last given ID and start of the latest attempt.
+	// Reports of attempts that are not running anymore are ignored.
+	running  map[int]bool
+	attempts int
+	started  time.Time
+	// failed attempts and the last error
+	failures int
+	err      string
+}
+
+type mapTask struct {
+	task
+	document corpus.DocumentInfo
+	segments []SegmentFile
+	// file of the stored document, empty when the worker keeps no documents
+	stored string
+}
+
+type reduceTask struct {
+	task
+	shard string
+}
+
+// Register documents of every file of dataDir, map tasks follow the order of the registry.
+// Workers must parse files with the same config.
+func NewMaster(dataDir, dir string, config corpus.ParserConfig) *Master {
+
+	m := &Master{
+		dir:      dir,
+		registry: corpus.NewRegistry(),
+		policy:   DefaultRetryPolicy,
+		done:     make(chan struct{}),
+		mutex:    &sync.Mutex{},
+	}
+	m.changed = sync.NewCond(m.mutex)
+
+	for document := range enumerateFiles(dataDir, m.registry, config) {
+		m.maps = append(m.maps, &mapTask{document: document})
+	}
+	for range partitions {
+		m.reduces = append(m.reduces, &reduceTask{})
+	}
+
+	return m
+
+}
+
+// Policy for the tasks given after the call
+func (m *Master) SetRetryPolicy(policy RetryPolicy) {
+
+	m.mutex.Lock()
+	m.policy = policy
+	m.mutex.Unlock()
+
+}
+
+// Listen on a free port of localhost, returns the address workers dial
+func (m *Master) Serve() (string, error) {
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Master", &MasterService{m}); err != nil {
+		return "", err
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
+	}
+	m.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			// the master is closed
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	go m.monitor()
+
+	return listener.Addr().String(), nil
+
+}
+
+// Stop accepting workers, workers that are connected get errors on their next call
+func (m *Master) Close() error {
+
+	close(m.done)
+
+	return m.listener.Close()
+
+}
+
+// Documents of the job, lengths are known after their map tasks
+func (m *Master) Registry() *corpus.Registry {
+	return m.registry
+}
+
+// Wake waiting workers now and then, so tasks that timed out or fell behind are given again
+func (m *Master) monitor() {
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.mutex.Lock()
+			m.timeOut(time.Now())
+			m.changed.Broadcast()
+			m.mutex.Unlock()
+		}
+	}
+
+}
+
+// Fail running tasks that no attempt reported for too long, a timeout counts as a failed attempt
+func (m *Master) timeOut(now time.Time) {
+
+	err := fmt.Sprintf("map_reduce: no report for %v", m.policy.TaskTimeout)
+	for _, t := range m.maps {
+		if m.expired(&t.task, now) {
+			m.failMap(t, err)
+		}
+	}
+	for _, t := range m.reduces {
+		if m.expired(&t.task, now) {
+			m.fail(&t.task, err)
+		}
+	}
+
+}
+
+// Drop attempts of the task that ran out of time, their workers are presumed dead
+func (m *Master) expired(t *task, now time.Time) bool {
+
+	if t.state != taskRunning || now.Sub(t.started) <= m.policy.TaskTimeout {
+		return false
+	}
+	t.running = nil
+
+	return true
+
+}
+
+// Map tasks and then reduce tasks
+func (m *Master) tasks() []*task {
+
+	tasks := make([]*task, 0, len(m.maps)+len(m.reduces))
+	for _, t := range m.maps {
+		tasks = append(tasks, &t.task)
+	}
+	for _, t := range m.reduces {
+		tasks = append(tasks, &t.task)
+	}
+
+	return tasks
+
+}
+
+// Wait until every reduce task is over and build the index from the shards, one inverter
+// per partition like the in-process job. Tasks that were given up and shards that can not
+// be read are reported along with the index of the rest.
+func (m *Master) Wait() (TermPartitionedIndex, error) {
+
+	m.mutex.Lock()
+	for !m.reducesOver() {
+		m.changed.Wait()
+	}
+	shards := make([]string, len(m.reduces))
+	for p, t := range m.reduces {
+		if t.state == taskDone {
+			shards[p] = t.shard
+		}
+	}
+	failed := make([]string, 0)
+	for _, t := range m.tasks() {
+		if t.state == taskFailed {
+			failed = append(failed, t.err)
+		}
+	}
+	m.mutex.Unlock()
+
+	errs := make([]error, 0)
+	if len(failed) > 0 {
+		errs = append(errs, fmt.Errorf("map_reduce: %d tasks failed, first: %s", len(failed), failed[0]))
+	}
+
+	index := make(TermPartitionedIndex, len(shards))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(shards))
+
+	for p, path := range shards {
+		index[p] = corpus.NewCorpus(2)
+		go func(shard *corpus.Corpus, path string) {
+			defer wg.Done()
+			if path == "" {
+				return
+			}
+			data, readErr := ioutil.ReadFile(path)
+			var tokens []corpus.Token
+			if readErr == nil {
+				tokens, readErr = FromGOB64(string(data))
+			}
+			if readErr != nil {
+				m.mutex.Lock()
+				errs = append(errs, fmt.Errorf("map_reduce: shard %s: %v", path, readErr))
+				m.mutex.Unlock()
+				return
+			}
+			shard.BuildIndexFromParsedTokens(tokens)
+		}(index[p], path)
+	}
+	wg.Wait()
+
+	return index, errors.Join(errs...)
+
+}
+
+// Gather documents stored by map tasks that are done into the store file of the shared dir,
+// returns its path. It is called after Wait.
+func (m *Master) WriteStore() (string, error) {
+
+	m.mutex.Lock()
+	files := make([]string, 0, len(m.maps))
+	for _, t := range m.maps {
+		if t.state == taskDone && t.stored != "" {
+			files = append(files, t.stored)
+		}
+	}
+	m.mutex.Unlock()
+
+	store := corpus.NewDocumentStore()
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if err := store.UnmarshalBinary(data); err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return createStoreFile(m.dir, store)
+
+}
+
+func (t *task) over() bool {
+	return t.state == taskDone || t.state == taskFailed
+}
+
+func (m *Master) mapsOver() bool {
+	for _, t := range m.maps {
+		if !t.over() {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Master) reducesOver() bool {
+	for _, t := range m.reduces {
+		if !t.over() {
+			return false
+		}
+	}
+	return true
+}
+
+// Start an attempt of the task, gives its ID
+func (t *task) start() int {
+
+	if t.running == nil {
+		t.running = make(map[int]bool)
+	}
+	t.attempts++
+	t.running[t.attempts] = true
+	t.state = taskRunning
+	t.started = time.Now()
+
+	return t.attempts
+
+}
+
+// Next idle task, reduce tasks are given only when every map task is over.
+// When nothing is idle a straggler gets a backup attempt, otherwise the caller waits.
+func (m *Master) nextTask() Task {
+
+	for {
+		if !m.mapsOver() {
+			for id, t := range m.maps {
+				if t.state == taskIdle {
+					return m.mapTask(id, t.start())
+				}
+			}
+			for id, t := range m.maps {
+				if m.straggles(&t.task) {
+					return m.mapTask(id, t.start())
+				}
+			}
+		} else if !m.reducesOver() {
+			for p, t := range m.reduces {
+				if t.state == taskIdle {
+					return m.reduceTask(p, t.start())
+				}
+			}
+			for p, t := range m.reduces {
+				if m.straggles(&t.task) {
+					return m.reduceTask(p, t.start())
+				}
+			}
+		} else {
+			return Task{Kind: ExitTask}
+		}
+
+		m.changed.Wait()
+	}
+
+}
+
+// Running task of one attempt only that runs for too long
+func (m *Master) straggles(t *task) bool {
+	return t.state == taskRunning && len(t.running) == 1 && time.Since(t.started) > m.policy.SpeculativeAfter
+}
+
+func (m *Master) mapTask(id, attempt int) Task {
+	return Task{Kind: MapTask, ID: id, Attempt: attempt, Document: m.maps[id].document, Dir: m.dir}
+}
+
+func (m *Master) reduceTask(p, attempt int) Task {
+	return Task{Kind: ReduceTask, ID: p, Attempt: attempt, Files: m.partitionFiles(p), Dir: m.dir}
+}
+
+// Segment files of the partition written by every map task that is done
+func (m *Master) partitionFiles(p int) []string {
+
+	files := make([]string, 0, len(m.maps))
+	for _, t := range m.maps {
+		for _, s := range t.segments {
+			if s.Partition == p {
+				files = append(files, s.Path)
+			}
+		}
+	}
+
+	return files
+
+}
+
+// Count the failed attempt, the task is given again unless another attempt
+// is still running or it has failed too many times
+func (m *Master) fail(t *task, err string) {
+
+	t.failures++
+	t.err = err
+
+	switch {
+	case t.failures >= m.policy.MaxAttempts:
+		t.state = taskFailed
+	case len(t.running) == 0:
+		t.state = taskIdle
+	}
+
+}
+
+// Failed map task takes its document out of the registry
+func (m *Master) failMap(t *mapTask, err string) {
+
+	m.fail(&t.task, err)
+	if t.state == taskFailed {
+		m.registry.Remove(t.document.ID)
+	}
+
+}
+
+// MasterService is what workers call, the master itself is not exposed
+type MasterService struct {
+	master *Master
+}
+
+// Block until there is a task for the worker
+func (s *MasterService) GetTask(args *TaskArgs, reply *Task) error {
+
+	m := s.master
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	*reply = m.nextTask()
+
+	return nil
+
+}
+
+// Record the result of the attempt. The first success commits the task,
+// results of attempts that come after it or timed out are ignored.
+func (s *MasterService) TaskDone(args *TaskResult, reply *bool) error {
+
+	m := s.master
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch args.Kind {
+	case MapTask:
+		if args.ID < 0 || args.ID >= len(m.maps) {
+			return errors.New("map_reduce: unknown map task")
+		}
+		t := m.maps[args.ID]
+		switch {
+		case t.over() || !t.running[args.Attempt]:
+		case args.Error != "":
+			delete(t.running, args.Attempt)
+			m.failMap(t, args.Error)
+		default:
+			t.state = taskDone
+			t.segments = args.Segments
+			t.stored = args.Stored
+			t.document.Length = args.Length
+			m.registry.Put(t.document)
+		}
+	case ReduceTask:
+		if args.ID < 0 || args.ID >= len(m.reduces) {
+			return errors.New("map_reduce: unknown reduce task")
+		}
+		t := m.reduces[args.ID]
+		switch {
+		case t.over() || !t.running[args.Attempt]:
+		case args.Error != "":
+			delete(t.running, args.Attempt)
+			m.fail(&t.task, args.Error)
+		default:
+			t.state = taskDone
+			t.shard = args.Shard
+		}
+	}
+
+	*reply = true
+	m.changed.Broadcast()
+
+	return nil
+
+}
+
+// Shard file of the partition in the shared dir
+func shardPath(dir string, p int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard_%s.dat", partitions[p]))
+}
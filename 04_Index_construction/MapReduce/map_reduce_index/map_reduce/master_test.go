@@ -0,0 +1,373 @@
+package map_reduce
+
+import (
+	"../corpus"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Small documents in a temp dir, the dir for segment files is next to them
+func newTestJob(t *testing.T) (string, string) {
+
+	root, err := ioutil.TempDir("", "map_reduce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(root, "data")
+	dir := filepath.Join(root, "shared")
+	os.Mkdir(data, 0777)
+	os.Mkdir(dir, 0777)
+
+	for i := 0; i < 6; i++ {
+		text := fmt.Sprintf("what did zebra%d say\nthe apple of hamlet %d\nquite a world\n", i, i)
+		if err := ioutil.WriteFile(filepath.Join(data, fmt.Sprintf("doc%d.txt", i)), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return data, dir
+
+}
+
+// Runs as a worker process when the master test starts the test binary again
+func TestWorkerProcess(t *testing.T) {
+
+	addr := os.Getenv("MAP_REDUCE_MASTER")
+	if addr == "" {
+		t.Skip("started by TestMasterWorkers only")
+	}
+
+	if err := RunWorker(addr, corpus.ParserConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestMasterWorkers(t *testing.T) {
+
+	data, dir := newTestJob(t)
+	defer os.RemoveAll(filepath.Dir(data))
+
+	m := NewMaster(data, dir, corpus.ParserConfig{})
+	addr, err := m.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	process := exec.Command(os.Args[0], "-test.run=TestWorkerProcess")
+	process.Env = append(os.Environ(), "MAP_REDUCE_MASTER="+addr)
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	workers := make(chan error, 2)
+	for i := 0; i < cap(workers); i++ {
+		go func() { workers <- RunWorker(addr, corpus.ParserConfig{}) }()
+	}
+
+	index, err := m.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cap(workers); i++ {
+		if err := <-workers; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := process.Wait(); err != nil {
+		t.Errorf("expected worker process to finish the job, got %v", err)
+	}
+
+	// the same documents give the same shards in one process
+	registry := corpus.NewRegistry()
+	expected, err := buildIndex(newMapper(registry, corpus.NewDocumentStore(), corpus.ParserConfig{}), enumerateFiles(data, registry, corpus.ParserConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p := range partitions {
+		if !reflect.DeepEqual(index[p].Keys(), expected[p].Keys()) {
+			t.Errorf("expected terms %v in shard %s, got %v", expected[p].Keys(), partitions[p], index[p].Keys())
+		}
+	}
+	docs, _ := index.Shard("zebra3").Get("zebra3")
+	if docs == nil {
+		t.Error("expected zebra3 in the q-z shard")
+	}
+
+	for _, info := range m.Registry().Documents() {
+		if expected, _ := registry.Get(info.ID); info.Path != expected.Path || info.Length != expected.Length || info.Length == 0 {
+			t.Errorf("expected %v, got %v", expected, info)
+		}
+	}
+
+	// workers of both kinds send the text of their documents to the store of the shared dir
+	path, err := m.WriteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "store.dat") {
+		t.Errorf("expected store in the shared dir, got %s", path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := corpus.NewDocumentStore()
+	if err := store.UnmarshalBinary(content); err != nil {
+		t.Fatal(err)
+	}
+	if store.Size() != 6 {
+		t.Errorf("expected 6 stored documents, got %d", store.Size())
+	}
+	for _, info := range m.Registry().Documents() {
+		text, _ := ioutil.ReadFile(info.Path)
+		if doc, err := store.Get(info.ID); err != nil || doc.Path != info.Path || doc.Text != string(text) {
+			t.Errorf("expected text of %s, got %q, %v", info.Path, doc.Text, err)
+		}
+	}
+
+}
+
+// Short policy, so tests do not wait for the default timeouts
+var testRetryPolicy = RetryPolicy{
+	TaskTimeout:      2 * time.Second,
+	MaxAttempts:      3,
+	SpeculativeAfter: 300 * time.Millisecond,
+}
+
+// Master of the test job and workers with the mapper, errors of workers are not checked,
+// a worker may be cut off when the master closes
+func runTestJob(t *testing.T, mapper func(Mapper[string, corpus.Token]) Mapper[string, corpus.Token], workers int) (*Master, TermPartitionedIndex, error) {
+
+	data, dir := newTestJob(t)
+	defer os.RemoveAll(filepath.Dir(data))
+
+	m := NewMaster(data, dir, corpus.ParserConfig{})
+	m.SetRetryPolicy(testRetryPolicy)
+	addr, err := m.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for i := 0; i < workers; i++ {
+		store := corpus.NewDocumentStore()
+		go Worker(addr, mapper(newMapper(corpus.NewRegistry(), store, corpus.ParserConfig{})), store)
+	}
+
+	index, err := m.Wait()
+
+	return m, index, err
+
+}
+
+func TestMasterRetriesFailedTask(t *testing.T) {
+
+	attempts := int32(0)
+	flaky := func(mapper Mapper[string, corpus.Token]) Mapper[string, corpus.Token] {
+		return func(document corpus.DocumentInfo, emit func(string, corpus.Token)) error {
+			if strings.HasSuffix(document.Path, "doc2.txt") && atomic.AddInt32(&attempts, 1) == 1 {
+				panic("worker lost its disk")
+			}
+			return mapper(document, emit)
+		}
+	}
+
+	m, index, err := runTestJob(t, flaky, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("expected the failed map task to run twice, ran %d times", attempts)
+	}
+	if docs, _ := index.Shard("zebra2").Get("zebra2"); docs == nil {
+		t.Error("expected zebra2 indexed by the second attempt")
+	}
+	if m.Registry().Size() != 6 {
+		t.Errorf("expected 6 documents, got %d", m.Registry().Size())
+	}
+
+}
+
+func TestMasterGivesUpTask(t *testing.T) {
+
+	attempts := int32(0)
+	broken := func(mapper Mapper[string, corpus.Token]) Mapper[string, corpus.Token] {
+		return func(document corpus.DocumentInfo, emit func(string, corpus.Token)) error {
+			if strings.HasSuffix(document.Path, "doc4.txt") {
+				atomic.AddInt32(&attempts, 1)
+				return errors.New("doc4.txt: bad sector")
+			}
+			return mapper(document, emit)
+		}
+	}
+
+	m, index, err := runTestJob(t, broken, 2)
+	if err == nil || !strings.Contains(err.Error(), "bad sector") {
+		t.Errorf("expected the failed task to be reported, got %v", err)
+	}
+	if atomic.LoadInt32(&attempts) != int32(testRetryPolicy.MaxAttempts) {
+		t.Errorf("expected %d attempts, got %d", testRetryPolicy.MaxAttempts, attempts)
+	}
+
+	// the rest of the job is indexed
+	if docs, _ := index.Shard("zebra4").Get("zebra4"); docs != nil {
+		t.Error("expected no zebra4")
+	}
+	if docs, _ := index.Shard("zebra5").Get("zebra5"); docs == nil {
+		t.Error("expected zebra5")
+	}
+	if m.Registry().Size() != 5 {
+		t.Errorf("expected the failed document out of the registry, got %d documents", m.Registry().Size())
+	}
+
+}
+
+func TestMasterBacksUpStraggler(t *testing.T) {
+
+	hung := make(chan struct{})
+	defer close(hung)
+
+	attempts := int32(0)
+	straggling := func(mapper Mapper[string, corpus.Token]) Mapper[string, corpus.Token] {
+		return func(document corpus.DocumentInfo, emit func(string, corpus.Token)) error {
+			if strings.HasSuffix(document.Path, "doc0.txt") && atomic.AddInt32(&attempts, 1) == 1 {
+				<-hung
+			}
+			return mapper(document, emit)
+		}
+	}
+
+	start := time.Now()
+	_, index, err := runTestJob(t, straggling, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs, _ := index.Shard("zebra0").Get("zebra0"); docs == nil {
+		t.Error("expected zebra0 indexed by the backup attempt")
+	}
+	if elapsed := time.Since(start); elapsed >= testRetryPolicy.TaskTimeout {
+		t.Errorf("expected the backup attempt before the timeout, took %v", elapsed)
+	}
+
+}
+
+func TestMasterTimesOutTask(t *testing.T) {
+
+	hung := make(chan struct{})
+	defer close(hung)
+
+	attempts := int32(0)
+	dying := func(mapper Mapper[string, corpus.Token]) Mapper[string, corpus.Token] {
+		return func(document corpus.DocumentInfo, emit func(string, corpus.Token)) error {
+			if strings.HasSuffix(document.Path, "doc3.txt") && atomic.AddInt32(&attempts, 1) <= 2 {
+				<-hung
+			}
+			return mapper(document, emit)
+		}
+	}
+
+	// the first two attempts hang both backup workers, the third comes after the timeout
+	_, index, err := runTestJob(t, dying, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs, _ := index.Shard("zebra3").Get("zebra3"); docs == nil {
+		t.Error("expected zebra3 indexed after the timeout")
+	}
+	if atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+}
+
+// Timeouts count as failed attempts, reports of attempts that timed out are ignored
+func TestMasterIgnoresStaleAttempts(t *testing.T) {
+
+	data, dir := newTestJob(t)
+	defer os.RemoveAll(filepath.Dir(data))
+
+	m := NewMaster(data, dir, corpus.ParserConfig{})
+	m.SetRetryPolicy(testRetryPolicy)
+	service := &MasterService{m}
+	later := time.Now().Add(2 * testRetryPolicy.TaskTimeout)
+
+	m.mutex.Lock()
+	first := m.nextTask()
+	m.timeOut(later)
+	second := m.nextTask()
+	m.mutex.Unlock()
+	if second.ID != first.ID || second.Attempt == first.Attempt {
+		t.Fatalf("expected a new attempt of the timed out task, got %v after %v", second, first)
+	}
+
+	// the late failure of the first attempt is not a failure of the second one
+	done := false
+	service.TaskDone(&TaskResult{Kind: MapTask, ID: first.ID, Attempt: first.Attempt, Error: "late"}, &done)
+	task := m.maps[first.ID]
+	if task.state != taskRunning || task.failures != 1 || len(task.running) != 1 {
+		t.Errorf("expected the second attempt running after one failure, got state %v, %d failures", task.state, task.failures)
+	}
+
+	m.mutex.Lock()
+	m.timeOut(later)
+	m.nextTask()
+	m.timeOut(later)
+	m.mutex.Unlock()
+	if task.state != taskFailed || task.failures != testRetryPolicy.MaxAttempts {
+		t.Errorf("expected the task given up after %d timeouts, got state %v, %d failures", testRetryPolicy.MaxAttempts, task.state, task.failures)
+	}
+	if m.Registry().Size() != 5 {
+		t.Errorf("expected the document out of the registry, got %d documents", m.Registry().Size())
+	}
+
+}
+
+// Segment and shard files that are not tokens fail their task and the index, no postings are dropped silently
+func TestCorruptTokensFile(t *testing.T) {
+
+	data, dir := newTestJob(t)
+	defer os.RemoveAll(filepath.Dir(data))
+
+	corrupt := filepath.Join(dir, "segment9_a-h.dat")
+	ioutil.WriteFile(corrupt, []byte("not a segment"), 0666)
+	if _, err := FromGOB64("not a segment"); err == nil {
+		t.Error("expected decoding to fail")
+	}
+
+	valid := filepath.Join(dir, "segment8_a-h.dat")
+	if err := writeTokensFile(valid, []corpus.Token{{Term: "apple", DocID: 8, File: "doc8.txt"}}); err != nil {
+		t.Fatal(err)
+	}
+	result := doReduce(Task{Kind: ReduceTask, ID: 0, Files: []string{valid, corrupt}, Dir: dir})
+	if !strings.Contains(result.Error, corrupt) {
+		t.Errorf("expected reduce task to fail on %s, got %q", corrupt, result.Error)
+	}
+	if _, err := os.Stat(shardPath(dir, 0)); !os.IsNotExist(err) {
+		t.Errorf("expected no shard of the failed task, got %v", err)
+	}
+
+	m := NewMaster(data, dir, corpus.ParserConfig{})
+	for _, r := range m.reduces {
+		r.state = taskDone
+		r.shard = corrupt
+	}
+	m.reduces[0].state = taskFailed
+	m.reduces[0].err = "bad sector"
+	if _, err := m.Wait(); err == nil || !strings.Contains(err.Error(), corrupt) || !strings.Contains(err.Error(), "bad sector") {
+		t.Errorf("expected failed task and corrupt shard reported, got %v", err)
+	}
+
+}
@@ -7,7 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,13 +16,29 @@ import (
 
 type WalkFunc func(path string, info os.FileInfo, err error) error
 
-// get filenames in dir
-func enumerateFiles(dirname string) chan interface{} {
-	output := make(chan interface{})
+// get documents of files in dir, they are registered in the order of the walk, so IDs do not depend on mappers.
+// Every file is parsed by the parser its config picks and documents of a file get consecutive IDs,
+// a file that can not be read or parsed is one document and its mapper reports the error.
+func enumerateFiles(dirname string, registry *corpus.Registry, config corpus.ParserConfig) chan corpus.DocumentInfo {
+	output := make(chan corpus.DocumentInfo)
 	go func() {
 		filepath.Walk(dirname, func(path string, f os.FileInfo, err error) error {
-			if !f.IsDir() {
-				output <- path
+			// an unreadable entry has no file info
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			if f.IsDir() {
+				return nil
+			}
+			docs, err := parseFile(path, config)
+			if err != nil {
+				docs = []corpus.ParsedDocument{{}}
+			}
+			for part, doc := range docs {
+				info := corpus.DocumentInfo{Path: path, Title: doc.Title, Part: part, Modified: f.ModTime()}
+				info.ID = registry.Register(info)
+				output <- info
 			}
 			return nil
 		})
@@ -31,29 +47,16 @@ func enumerateFiles(dirname string) chan interface{} {
 	return output
 }
 
-// read file by line
-func enumerateFile(filename string) chan string {
-	output := make(chan string)
-	go func() {
-		file, err := os.Open(filename)
-		if err != nil {
-			return
-		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
-		for {
-			line, err := reader.ReadString('\n')
-
-			if err == io.EOF {
-				break
-			}
+// read and parse the file
+func parseFile(filename string, config corpus.ParserConfig) ([]corpus.ParsedDocument, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return corpus.ParseFile(filename, content, config)
 
-			// add each line to our enumeration channel
-			output <- line
-		}
-		close(output)
-	}()
-	return output
 }
 
 // Split line
@@ -81,26 +84,91 @@ func tokenize(line string) []string {
 	return tokens
 }
 
-func createSegmentFiles(tokens []corpus.Token, idx int) string {
+// write tokens of one document and one partition
+func createSegmentFile(dir string, tokens []corpus.Token, partition int) (string, error) {
+
+	outputFile := filepath.Join(dir, fmt.Sprintf("segment%d_%s.dat", tokens[0].DocID, partitions[partition]))
+
+	return outputFile, writeTokensFile(outputFile, tokens)
+
+}
+
+// save tokens as base64 gob, like every segment file
+func writeTokensFile(outputFile string, tokens []corpus.Token) error {
 
-	outputFile := fmt.Sprintf("output/segment%d.dat", idx)
+	data, err := SerializedTokens{tokens}.ToGOB64()
+	if err != nil {
+		return err
+	}
 
-	st := SerializedTokens{tokens}
+	return writeFileAside(outputFile, []byte(data))
 
-	file, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// The file is written aside and renamed, so readers never see a partial file
+// and attempts of the same task may commit it more than once.
+func writeFileAside(outputFile string, data []byte) error {
+
+	file, err := ioutil.TempFile(filepath.Dir(outputFile), filepath.Base(outputFile)+".tmp")
 	if err != nil {
-		log.Println(err)
+		return err
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
 	w := bufio.NewWriter(file)
-	_, err = w.Write([]byte(st.ToGOB64()))
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), outputFile)
+
+}
+
+// save compressed documents of the build into dir next to the segment files
+func createStoreFile(dir string, store *corpus.DocumentStore) (string, error) {
+
+	outputFile := filepath.Join(dir, "store.dat")
+
+	return outputFile, writeStoreFile(outputFile, store)
+
+}
+
+// save the stored document of one map task, it is named by the document like its segment files
+func createDocumentFile(dir string, store *corpus.DocumentStore, id int) (string, error) {
+
+	doc, err := store.Get(id)
+	if err != nil {
+		return "", err
+	}
+	// the worker keeps a document until it is written only
+	store.Remove(id)
+
+	one := corpus.NewDocumentStore()
+	if err := one.Put(doc); err != nil {
+		return "", err
+	}
+
+	outputFile := filepath.Join(dir, fmt.Sprintf("document%d.dat", id))
+
+	return outputFile, writeStoreFile(outputFile, one)
+
+}
+
+func writeStoreFile(outputFile string, store *corpus.DocumentStore) error {
+
+	data, err := store.MarshalBinary()
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-	w.Flush()
 
-	return outputFile
+	return writeFileAside(outputFile, data)
 
 }
 
@@ -109,36 +177,31 @@ type SerializedTokens struct {
 }
 
 // Serialize tokens
-func (st SerializedTokens) ToGOB64() string {
+func (st SerializedTokens) ToGOB64() (string, error) {
 
 	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(&st)
-	if err != nil { fmt.Println(`failed gob Encode`, err) }
+	if err := gob.NewEncoder(&b).Encode(&st); err != nil {
+		return "", err
+	}
 
-	return base64.StdEncoding.EncodeToString(b.Bytes())
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
 
 }
 
-// Deserialize tokens
+// Deserialize tokens, a file that is not base64 gob of tokens is an error
 // Go binary decoder
-func FromGOB64(str string) []corpus.Token {
-
-	st := &SerializedTokens{}
+func FromGOB64(str string) ([]corpus.Token, error) {
 
 	by, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
-		fmt.Println(`failed base64 Decode`, err);
+		return nil, err
 	}
 
-	b := bytes.Buffer{}
-	b.Write(by)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(st)
-	if err != nil {
-		fmt.Println(`failed gob Decode`, err);
+	st := &SerializedTokens{}
+	if err := gob.NewDecoder(bytes.NewReader(by)).Decode(st); err != nil {
+		return nil, err
 	}
 
-	return st.Tokens
+	return st.Tokens, nil
 
-}
\ No newline at end of file
+}
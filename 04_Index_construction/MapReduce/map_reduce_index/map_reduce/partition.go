@@ -0,0 +1,58 @@
+package map_reduce
+
+import (
+	"../corpus"
+	"strings"
+)
+
+// Term partition is a range of first letters, one inverter builds the shard of every partition
+type partition struct {
+	first byte
+	last  byte
+}
+
+func (p partition) String() string {
+	return string([]byte{p.first, '-', p.last})
+}
+
+// Diapasons of the flow, terms that do not start with a letter go to the nearest one
+var partitions = []partition{{'a', 'f'}, {'g', 'p'}, {'q', 'z'}}
+
+// Partition of the term by its first letter
+func partitionOf(term string) int {
+
+	if term == "" {
+		return 0
+	}
+
+	c := strings.ToLower(term[:1])[0]
+	for p := range partitions[:len(partitions)-1] {
+		if c <= partitions[p].last {
+			return p
+		}
+	}
+
+	return len(partitions) - 1
+
+}
+
+// Tokens of every partition in the order they came
+func splitByPartition(tokens []corpus.Token) [][]corpus.Token {
+
+	parts := make([][]corpus.Token, len(partitions))
+	for _, t := range tokens {
+		p := partitionOf(t.Term)
+		parts[p] = append(parts[p], t)
+	}
+
+	return parts
+
+}
+
+// TermPartitionedIndex is the result of the job, a shard of every partition
+type TermPartitionedIndex []*corpus.Corpus
+
+// Shard that holds the term if it is indexed at all
+func (index TermPartitionedIndex) Shard(term string) *corpus.Corpus {
+	return index[partitionOf(term)]
+}
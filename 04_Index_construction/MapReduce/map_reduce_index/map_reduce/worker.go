@@ -0,0 +1,177 @@
+package map_reduce
+
+import (
+	"../corpus"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"sort"
+)
+
+type TaskKind int
+
+const (
+	MapTask TaskKind = iota + 1
+	ReduceTask
+	// every task of the job is done, the worker stops
+	ExitTask
+)
+
+// Task is what the master gives a worker: a document to map
+// or segment files of one partition to reduce into a shard.
+// The worker reports the attempt back, so reports of stale attempts are told apart.
+type Task struct {
+	Kind     TaskKind
+	ID       int
+	Attempt  int
+	Document corpus.DocumentInfo
+	Files    []string
+	Dir      string
+}
+
+type TaskArgs struct{}
+
+// SegmentFile is a segment file written by a map task
+type SegmentFile struct {
+	Partition int
+	Path      string
+}
+
+// TaskResult is what the worker reports, Error is empty when the task succeeded
+type TaskResult struct {
+	Kind     TaskKind
+	ID       int
+	Attempt  int
+	Segments []SegmentFile
+	// tokens of the mapped document and the file of its stored text
+	Length int
+	Stored string
+	Shard  string
+	Error  string
+}
+
+// Ask the master at addr for tasks until the job is over. Map tasks run the mapper over one document
+// and write a segment file of every partition to the dir the master shares. The document the mapper
+// puts into store is written there too, nil store keeps no documents.
+func Worker(addr string, mapper Mapper[string, corpus.Token], store *corpus.DocumentStore) error {
+
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		task := Task{}
+		if err := client.Call("Master.GetTask", &TaskArgs{}, &task); err != nil {
+			return err
+		}
+
+		var result TaskResult
+		switch task.Kind {
+		case MapTask:
+			result = doMap(task, mapper, store)
+		case ReduceTask:
+			result = doReduce(task)
+		default:
+			return nil
+		}
+		result.Attempt = task.Attempt
+
+		done := false
+		if err := client.Call("Master.TaskDone", &result, &done); err != nil {
+			return err
+		}
+	}
+
+}
+
+// Worker with the mapper of the in-process job, files are parsed with the config of the master
+func RunWorker(addr string, config corpus.ParserConfig) error {
+	store := corpus.NewDocumentStore()
+
+	return Worker(addr, newMapper(corpus.NewRegistry(), store, config), store)
+}
+
+// Errors and panics of the mapper fail the task, the master gives it again.
+// Segment and document files are named by the document, so every attempt writes the same ones.
+func doMap(task Task, mapper Mapper[string, corpus.Token], store *corpus.DocumentStore) (result TaskResult) {
+
+	result = TaskResult{Kind: MapTask, ID: task.ID}
+	defer func() {
+		if r := recover(); r != nil {
+			result.Segments = nil
+			result.Stored = ""
+			result.Error = fmt.Sprintf("map_reduce: map task %d: %v", task.ID, r)
+		}
+	}()
+
+	tokens := make([]corpus.Token, 0)
+	if err := mapper(task.Document, func(term string, token corpus.Token) {
+		tokens = append(tokens, token)
+	}); err != nil {
+		panic(err)
+	}
+
+	result.Length = len(tokens)
+	for p, part := range splitByPartition(tokens) {
+		// a document may have no terms of the partition
+		if len(part) == 0 {
+			continue
+		}
+		path, err := createSegmentFile(task.Dir, part, p)
+		if err != nil {
+			panic(err)
+		}
+		result.Segments = append(result.Segments, SegmentFile{p, path})
+	}
+
+	if store != nil {
+		path, err := createDocumentFile(task.Dir, store, task.Document.ID)
+		if err != nil {
+			panic(err)
+		}
+		result.Stored = path
+	}
+
+	return result
+
+}
+
+// Merge segment files of the partition into one shard sorted by term, document and position
+func doReduce(task Task) TaskResult {
+
+	result := TaskResult{Kind: ReduceTask, ID: task.ID, Shard: shardPath(task.Dir, task.ID)}
+
+	tokens := make([]corpus.Token, 0)
+	for _, path := range task.Files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		segment, err := FromGOB64(string(data))
+		if err != nil {
+			result.Error = fmt.Sprintf("map_reduce: segment %s: %v", path, err)
+			return result
+		}
+		tokens = append(tokens, segment...)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Term != tokens[j].Term {
+			return tokens[i].Term < tokens[j].Term
+		}
+		if tokens[i].DocID != tokens[j].DocID {
+			return tokens[i].DocID < tokens[j].DocID
+		}
+		return tokens[i].Position < tokens[j].Position
+	})
+
+	if err := writeTokensFile(result.Shard, tokens); err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+
+}
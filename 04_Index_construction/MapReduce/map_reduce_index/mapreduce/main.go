@@ -0,0 +1,76 @@
+package main
+
+import (
+	"../corpus"
+	"../map_reduce"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Index the data dir with a master and local worker processes, the same binary runs both.
+// Workers are started with -master and exchange segment files through -dir, the master tells them where it is.
+// The store of the documents' text is written to -dir too.
+// Files are parsed by their extensions unless -format names the parser of every file, workers get the same flags.
+//
+//	go run main.go -data ../map_reduce/data -dir ../map_reduce/output -workers 4
+//	go run main.go -data rows -format jsonl -text-field body
+func main() {
+
+	data := flag.String("data", "data", "directory of the documents to index")
+	dir := flag.String("dir", "output", "directory shared by the master and workers for segment files and shards")
+	workers := flag.Int("workers", 4, "amount of local worker processes")
+	master := flag.String("master", "", "address of the master, the process runs as a worker when it is set")
+	config := corpus.ParserConfig{}
+	flag.StringVar(&config.Format, "format", "", "parser of every file: text, html, markdown, jsonl or csv")
+	flag.StringVar(&config.TextField, "text-field", "", "field or column of JSON Lines and CSV with the text")
+	flag.StringVar(&config.TitleField, "title-field", "", "field or column of JSON Lines and CSV with the title")
+	flag.Parse()
+
+	if *master != "" {
+		if err := map_reduce.RunWorker(*master, config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	m := map_reduce.NewMaster(*data, *dir, config)
+	addr, err := m.Serve()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	cmds := make([]*exec.Cmd, *workers)
+	for i := range cmds {
+		cmds[i] = exec.Command(os.Args[0], "-master", addr,
+			"-format", config.Format, "-text-field", config.TextField, "-title-field", config.TitleField)
+		cmds[i].Stdout = os.Stdout
+		cmds[i].Stderr = os.Stderr
+		if err := cmds[i].Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the index is built without the tasks that failed every attempt
+	index, err := m.Wait()
+	if err != nil {
+		log.Println(err)
+	}
+	// workers stop when they are told the job is over
+	for _, cmd := range cmds {
+		cmd.Wait()
+	}
+
+	// documents of the tasks that are done, the index gives their text back
+	if _, err := m.WriteStore(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, shard := range index {
+		fmt.Println(shard.Size(), "terms")
+	}
+
+}
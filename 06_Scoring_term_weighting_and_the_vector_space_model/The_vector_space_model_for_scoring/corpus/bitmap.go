@@ -0,0 +1,116 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+//Page 78:
+//Deletions are stored in an invalidation bit vector. We can then filter out
+//deleted documents before returning the search result. Documents are updated
+//by deleting and reinserting them.
+
+// Bitmap is the invalidation bit vector, bit i is set when document i is deleted
+type Bitmap struct {
+	words []uint64
+}
+
+func NewBitmap() *Bitmap {
+	return &Bitmap{}
+}
+
+func (b *Bitmap) Set(id int) {
+	for id/64 >= len(b.words) {
+		b.words = append(b.words, 0)
+	}
+	b.words[id/64] |= 1 << uint(id%64)
+}
+
+func (b *Bitmap) Clear(id int) {
+	if id/64 < len(b.words) {
+		b.words[id/64] &^= 1 << uint(id%64)
+	}
+}
+
+// Nil bitmap contains nothing
+func (b *Bitmap) Contains(id int) bool {
+	return b != nil && id >= 0 && id/64 < len(b.words) && b.words[id/64]&(1<<uint(id%64)) != 0
+}
+
+// Amount of set bits
+func (b *Bitmap) Count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Set bits in ascending order
+func (b *Bitmap) IDs() []int {
+	ids := make([]int, 0)
+	for i, w := range b.words {
+		for w != 0 {
+			ids = append(ids, 64*i+bits.TrailingZeros64(w))
+			w &= w - 1
+		}
+	}
+	return ids
+}
+
+// Copy that can be changed while the original is read
+func (b *Bitmap) Clone() *Bitmap {
+	return &Bitmap{append([]uint64(nil), b.words...)}
+}
+
+// Words of the bitmap, little endian
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+
+	data := make([]byte, 8*len(b.words))
+	for i, w := range b.words {
+		binary.LittleEndian.PutUint64(data[8*i:], w)
+	}
+
+	return data, nil
+
+}
+
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+
+	if len(data)%8 != 0 {
+		return ErrCorruptBlock
+	}
+
+	b.words = make([]uint64, len(data)/8)
+	for i := range b.words {
+		b.words[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+
+	return nil
+
+}
+
+// Encode the bitmap into file of the current format version
+func (b *Bitmap) MarshalFile() []byte {
+	data, _ := b.MarshalBinary()
+	return EncodeFile(KindBitmap, Section{SectionBitmap, data})
+}
+
+// Decode bitmap file, bitmaps appeared in version 2, so there is nothing to upgrade
+func ReadBitmap(data []byte) (*Bitmap, error) {
+
+	f, err := DecodeFile(data, KindBitmap)
+	if err != nil {
+		return nil, err
+	}
+
+	section, err := f.Section(SectionBitmap)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bitmap{}
+
+	return b, b.UnmarshalBinary(section)
+
+}
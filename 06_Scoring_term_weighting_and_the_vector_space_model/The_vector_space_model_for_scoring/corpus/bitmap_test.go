@@ -0,0 +1,44 @@
+package corpus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+
+	b := NewBitmap()
+	b.Set(3)
+	b.Set(64)
+	b.Set(200)
+	b.Clear(64)
+
+	loaded, err := ReadBitmap(b.MarshalFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int{3, 200} {
+		if !loaded.Contains(id) {
+			t.Errorf("expected %d to be set", id)
+		}
+	}
+	for _, id := range []int{-1, 0, 64, 1000} {
+		if loaded.Contains(id) {
+			t.Errorf("expected %d to be clear", id)
+		}
+	}
+	if loaded.Count() != 2 {
+		t.Errorf("expected 2 bits, got %d", loaded.Count())
+	}
+	if ids := loaded.IDs(); len(ids) != 2 || ids[0] != 3 || ids[1] != 200 {
+		t.Errorf("expected [3 200], got %v", ids)
+	}
+
+	data := b.MarshalFile()
+	data[len(data)-1] ^= 1
+	if _, err := ReadBitmap(data); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+
+}
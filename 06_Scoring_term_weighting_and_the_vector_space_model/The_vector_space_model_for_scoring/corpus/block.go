@@ -0,0 +1,346 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+// ErrCorruptBlock is returned when a block does not follow the binary layout
+var ErrCorruptBlock = errors.New("corpus: corrupt block")
+
+// Binary block layout, stored as the postings section of a block file. Numbers are uvarints unless said otherwise, so a block
+// can be read straight from a memory-mapped file without copying it first:
+//
+//	uint32 terms count
+//	uint32 offsets[terms count]   offset of every term entry, entries are sorted by term
+//	entry:
+//	  term length, term
+//	  total frequency
+//	  uint32 inverse document frequency (float32 bits)
+//	  docs count
+//	  doc IDs length, PForDelta encoded doc IDs
+//	  doc: file length, file, frequency, uint32 idf bits, positions length, VB encoded positions
+//
+// Doc IDs and positions are handed out as slices of the block, positions are
+// decoded only when asked for.
+const blockHeaderSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC32C of block bytes
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// Encode serialized corpus into the binary block layout
+func (sc *SerializedCorpus) ToBlock() []byte {
+
+	tokens := make([]SerializedToken, len(sc.Tokens))
+	copy(tokens, sc.Tokens)
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Term < tokens[j].Term })
+
+	entries := make([]byte, 0)
+	offsets := make([]int, len(tokens))
+	for i, t := range tokens {
+		offsets[i] = len(entries)
+		entries = appendToken(entries, t)
+	}
+
+	dirSize := blockHeaderSize + 4*len(tokens)
+	data := make([]byte, dirSize, dirSize+len(entries))
+	binary.LittleEndian.PutUint32(data, uint32(len(tokens)))
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint32(data[blockHeaderSize+4*i:], uint32(dirSize+offset))
+	}
+
+	return append(data, entries...)
+
+}
+
+func appendToken(buf []byte, t SerializedToken) []byte {
+
+	buf = appendString(buf, t.Term)
+	buf = appendUvarint(buf, uint64(t.TotalFrequency))
+	buf = appendFloat32(buf, t.InverseDocumentFrequency)
+	buf = appendUvarint(buf, uint64(len(t.Docs)))
+
+	docs := make([]SerializedDoc, len(t.Docs))
+	copy(docs, t.Docs)
+	sort.Slice(docs, func(i, j int) bool { return docs[i].DocID < docs[j].DocID })
+
+	ids := make([]int, len(docs))
+	for i, d := range docs {
+		ids[i] = d.DocID
+	}
+	buf = appendBytes(buf, EncodePFor(ids))
+
+	for _, d := range docs {
+		buf = appendString(buf, d.File)
+		buf = appendUvarint(buf, uint64(d.Frequency))
+		buf = appendFloat32(buf, d.InverseDocumentFrequency)
+		buf = appendBytes(buf, d.Positions)
+	}
+
+	return buf
+
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendFloat32(buf []byte, f float32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(f))
+	return append(buf, tmp[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// BlockReader decodes postings in place from a block's bytes.
+// It never modifies the data, so one reader can be shared between goroutines.
+type BlockReader struct {
+	data  []byte
+	count int
+}
+
+// Wrap block bytes, only the header is checked here
+func NewBlockReader(data []byte) (*BlockReader, error) {
+
+	if len(data) < blockHeaderSize {
+		return nil, ErrCorruptBlock
+	}
+
+	count := int(binary.LittleEndian.Uint32(data))
+	if count < 0 || blockHeaderSize+4*count > len(data) {
+		return nil, ErrCorruptBlock
+	}
+
+	return &BlockReader{data, count}, nil
+
+}
+
+// Encode serialized corpus into block file of the current format version
+func (sc *SerializedCorpus) ToBlockFile() []byte {
+	return EncodeFile(KindBlock, Section{SectionPostings, sc.ToBlock()})
+}
+
+// Read block file of any known version, returns the version it was written with.
+// Current files are read in place, older ones are upgraded into memory first.
+func ReadBlock(data []byte) (*BlockReader, int, error) {
+
+	data, version, err := Upgrade(KindBlock, data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	f, err := DecodeFile(data, KindBlock)
+	if err != nil {
+		return nil, version, err
+	}
+
+	postings, err := f.Section(SectionPostings)
+	if err != nil {
+		return nil, version, err
+	}
+
+	br, err := NewBlockReader(postings)
+
+	return br, version, err
+
+}
+
+// Amount of terms in the block
+func (br *BlockReader) Len() int {
+	return br.count
+}
+
+// Term stored at i-th position of the directory
+func (br *BlockReader) Term(i int) string {
+	return string(br.term(i))
+}
+
+func (br *BlockReader) term(i int) []byte {
+	d := blockDecoder{data: br.data, pos: br.offset(i)}
+	return d.bytes()
+}
+
+func (br *BlockReader) offset(i int) int {
+	return int(binary.LittleEndian.Uint32(br.data[blockHeaderSize+4*i:]))
+}
+
+// Find the postings list of the term using binary search over the directory.
+// False means the block has no such term, an entry that can not be decoded is ErrCorruptBlock.
+func (br *BlockReader) Find(term string) (SerializedToken, bool, error) {
+
+	i := sort.Search(br.count, func(i int) bool {
+		return string(br.term(i)) >= term
+	})
+
+	if i == br.count || string(br.term(i)) != term {
+		return SerializedToken{}, false, nil
+	}
+
+	token, err := br.Token(i)
+	if err != nil {
+		return SerializedToken{}, false, err
+	}
+
+	return token, true, nil
+
+}
+
+// Decode i-th token of the block
+func (br *BlockReader) Token(i int) (SerializedToken, error) {
+
+	if i < 0 || i >= br.count {
+		return SerializedToken{}, ErrCorruptBlock
+	}
+
+	return decodeEntry(br.data, br.offset(i))
+
+}
+
+// Decode term entry that starts at pos, doc IDs and positions stay slices of data
+func decodeEntry(data []byte, pos int) (SerializedToken, error) {
+
+	token, _, err := decodeEntryEnd(data, pos)
+
+	return token, err
+
+}
+
+// Decode term entry that starts at pos, gives the position after it too
+func decodeEntryEnd(data []byte, pos int) (SerializedToken, int, error) {
+
+	d := blockDecoder{data: data, pos: pos}
+
+	token := SerializedToken{
+		Term:                     string(d.bytes()),
+		TotalFrequency:           int(d.uvarint()),
+		InverseDocumentFrequency: d.float32(),
+	}
+
+	docsNum := d.count()
+	token.DocIDs = PForList(d.bytes())
+	token.Docs = make([]SerializedDoc, 0, docsNum)
+
+	// doc IDs are decoded block by block
+	ids := token.DocIDs.Iterator()
+	var values []int
+
+	for j := 0; j < docsNum && d.err == nil; j++ {
+		if len(values) == 0 {
+			if !ids.Next() {
+				return SerializedToken{}, 0, ErrCorruptBlock
+			}
+			var err error
+			if values, err = ids.Values(); err != nil {
+				return SerializedToken{}, 0, err
+			}
+		}
+		doc := SerializedDoc{
+			DocID:                    values[0],
+			File:                     string(d.bytes()),
+			Frequency:                int(d.uvarint()),
+			InverseDocumentFrequency: d.float32(),
+		}
+		doc.Positions = PositionList(d.bytes())
+		token.Docs = append(token.Docs, doc)
+		values = values[1:]
+	}
+
+	if d.err != nil {
+		return SerializedToken{}, 0, d.err
+	}
+
+	return token, d.pos, nil
+
+}
+
+// Decode the whole block
+func (br *BlockReader) Corpus() (*SerializedCorpus, error) {
+
+	tokens := make([]SerializedToken, 0, br.count)
+
+	for i := 0; i < br.count; i++ {
+		token, err := br.Token(i)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return &SerializedCorpus{Tokens: tokens}, nil
+
+}
+
+// blockDecoder walks over block bytes and remembers the first error
+type blockDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *blockDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos < 0 || d.pos >= len(d.data) {
+		d.err = ErrCorruptBlock
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.err = ErrCorruptBlock
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+// count reads a length and makes sure the block is big enough to hold it
+func (d *blockDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)-d.pos) {
+		d.err = ErrCorruptBlock
+		return 0
+	}
+	return int(n)
+}
+
+func (d *blockDecoder) float32() float32 {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos+4 > len(d.data) {
+		d.err = ErrCorruptBlock
+		return 0
+	}
+	f := math.Float32frombits(binary.LittleEndian.Uint32(d.data[d.pos:]))
+	d.pos += 4
+	return f
+}
+
+func (d *blockDecoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
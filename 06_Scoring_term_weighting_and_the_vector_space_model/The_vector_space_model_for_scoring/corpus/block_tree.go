@@ -7,16 +7,107 @@ import (
 	"fmt"
 	"github.com/emirpasic/gods/maps/hashmap"
 	"github.com/emirpasic/gods/maps/treemap"
+	"io"
+	"strings"
 	"sync"
 )
 
 type BlockTree struct{
 	*hashmap.Map
 	Documents *DocumentTree
+	// Filter is persisted separately from the tree, nil when it is missing
+	Filter *BloomFilter
+	// CRC32C of every block file by its path
+	Checksums map[string]uint32
+	// Path of every document by its ID, empty for trees written before it was kept
+	Files map[int]string
+	// Documents of the build, nil for segments and trees written before it was kept
+	Registry *Registry
+	// Store is persisted separately from the tree, nil when it is missing
+	Store *DocumentStore
+}
+
+// New empty block tree over the given documents
+func NewBlockTree(documents *DocumentTree) *BlockTree {
+	return &BlockTree{hashmap.New(), documents, nil, make(map[string]uint32), make(map[int]string), nil, nil}
+}
+
+// New empty document tree
+func NewDocumentTree() *DocumentTree {
+	return &DocumentTree{
+		treemap.NewWithIntComparator(),
+		&sync.Mutex{},
+		&sync.WaitGroup{},
+	}
 }
 
 func (bt *BlockTree) ToGOB64() string {
-	// convert to serialized block tree
+	b := bytes.Buffer{}
+	e := gob.NewEncoder(&b)
+	err := e.Encode(bt.serialize())
+	if err != nil { fmt.Println(`failed gob Encode`, err) }
+
+	return base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+// Encode the tree into index file of the current format version
+func (bt *BlockTree) MarshalFile() ([]byte, error) {
+	return bt.serialize().toFile(bt.Registry)
+}
+
+// Decode index file of any known version, returns the version it was written with
+func ReadBlockTree(data []byte) (*BlockTree, int, error) {
+
+	data, version, err := Upgrade(KindBlockTree, data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	f, err := DecodeFile(data, KindBlockTree)
+	if err != nil {
+		return nil, version, err
+	}
+
+	sbt := &SerializedBlockTree{}
+	sections := []struct {
+		id uint32
+		v  interface{}
+	}{
+		{SectionDictionary, &sbt.Blocks},
+		{SectionDocuments, &sbt.Documents},
+		{SectionChecksums, &sbt.Checksums},
+	}
+	for _, s := range sections {
+		section, err := f.Section(s.id)
+		if err != nil {
+			return nil, version, err
+		}
+		if err := decodeGob(section, s.v); err != nil {
+			return nil, version, err
+		}
+	}
+
+	// files and the registry were added to version 2 later, trees without them are still valid
+	if section, err := f.Section(SectionFiles); err == nil {
+		if err := decodeGob(section, &sbt.Files); err != nil {
+			return nil, version, err
+		}
+	}
+
+	bt := sbt.blockTree()
+	if section, err := f.Section(SectionRegistry); err == nil {
+		bt.Registry = NewRegistry()
+		if err := bt.Registry.UnmarshalBinary(section); err != nil {
+			return nil, version, err
+		}
+	}
+
+	return bt, version, nil
+
+}
+
+// convert to serialized block tree
+func (bt *BlockTree) serialize() *SerializedBlockTree {
 	blocks := make([]SerializedBlock, 0)
 	for _, key := range bt.Keys() {
 		block, _ := bt.Get(key)
@@ -27,7 +118,11 @@ func (bt *BlockTree) ToGOB64() string {
 	}
 	docs := make([]SerializedBlockDoc, 0)
 	bt.Documents.Each(func(key, value interface{}) {
-		doc := value.(DocumentIndex)
+		// built trees keep values, loaded trees keep pointers
+		doc, ok := value.(DocumentIndex)
+		if !ok {
+			doc = *value.(*DocumentIndex)
+		}
 		terms := make([]SerializeBlockTerm, 0)
 		doc.Each(func(key, value interface{}) {
 			terms = append(terms, SerializeBlockTerm{
@@ -40,32 +135,71 @@ func (bt *BlockTree) ToGOB64() string {
 			Terms: terms,
 		})
 	})
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(&SerializedBlockTree{blocks, docs})
-	if err != nil { fmt.Println(`failed gob Encode`, err) }
+	checksums := make([]SerializedBlockChecksum, 0, len(bt.Checksums))
+	for block, crc := range bt.Checksums {
+		checksums = append(checksums, SerializedBlockChecksum{block, crc})
+	}
+	files := make([]SerializedBlockFile, 0, len(bt.Files))
+	for id, file := range bt.Files {
+		files = append(files, SerializedBlockFile{id, file})
+	}
+	return &SerializedBlockTree{blocks, docs, checksums, files}
+}
+
+// Every part of the tree is a separate section with its own checksum
+func (sbt *SerializedBlockTree) toFile(registry *Registry) ([]byte, error) {
+
+	sections := []struct {
+		id uint32
+		v  interface{}
+	}{
+		{SectionDictionary, sbt.Blocks},
+		{SectionDocuments, sbt.Documents},
+		{SectionChecksums, sbt.Checksums},
+		{SectionFiles, sbt.Files},
+	}
+
+	encoded := make([]Section, 0, len(sections))
+	for _, s := range sections {
+		data, err := encodeGob(s.v)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, Section{s.id, data})
+	}
+
+	if registry != nil {
+		data, err := registry.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, Section{SectionRegistry, data})
+	}
+
+	return EncodeFile(KindBlockTree, encoded...), nil
 
-	return base64.StdEncoding.EncodeToString(b.Bytes())
 }
 
 func BlockTreeFromGOB64(str string) *BlockTree {
-	sbt := &SerializedBlockTree{}
-	by, err := base64.StdEncoding.DecodeString(str)
-	if err != nil { fmt.Println(`failed base64 Decode`, err); }
-	b := bytes.Buffer{}
-	b.Write(by)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(sbt)
+	bt, err := BlockTreeFromReader(strings.NewReader(str))
 	if err != nil { fmt.Println(`failed gob Decode`, err); }
 
-	bt := &BlockTree{
-		hashmap.New(),
-		&DocumentTree{
-			treemap.NewWithIntComparator(),
-			&sync.Mutex{},
-			&sync.WaitGroup{},
-		},
-	}
+	return bt
+}
+
+// Decode base64 gob stream without reading it into memory first
+func BlockTreeFromReader(r io.Reader) (*BlockTree, error) {
+	sbt := &SerializedBlockTree{}
+	d := gob.NewDecoder(base64.NewDecoder(base64.StdEncoding, r))
+	err := d.Decode(sbt)
+
+	return sbt.blockTree(), err
+
+}
+
+func (sbt *SerializedBlockTree) blockTree() *BlockTree {
+
+	bt := NewBlockTree(NewDocumentTree())
 
 	for _, b := range sbt.Blocks {
 		bt.Put(b.Term, b.Block)
@@ -79,6 +213,14 @@ func BlockTreeFromGOB64(str string) *BlockTree {
 		bt.Documents.Put(d.DocID, docs)
 	}
 
+	for _, c := range sbt.Checksums {
+		bt.Checksums[c.Block] = c.CRC
+	}
+
+	for _, f := range sbt.Files {
+		bt.Files[f.DocID] = f.File
+	}
+
 	return bt
 
 }
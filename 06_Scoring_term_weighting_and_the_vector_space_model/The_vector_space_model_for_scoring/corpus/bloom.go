@@ -0,0 +1,170 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCorruptBloomFilter is returned when persisted filter can not be decoded
+var ErrCorruptBloomFilter = errors.New("corpus: corrupt bloom filter")
+
+// BloomFilter answers whether the term is definitely absent from the segment.
+// False positives are possible, false negatives are not.
+type BloomFilter struct {
+	bits   []uint64
+	m      uint64 // amount of bits
+	hashes uint32
+}
+
+// New filter sized for n terms with the given false positive probability
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+
+	if n < 1 {
+		n = 1
+	}
+
+	// m = -n*ln(p) / ln(2)^2, k = m/n * ln(2)
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &BloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		m:      m,
+		hashes: k,
+	}
+
+}
+
+func (bf *BloomFilter) Add(term string) {
+	h1, h2 := bloomHash(term)
+	for i := uint32(0); i < bf.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// False means the term was never added, true means it probably was
+func (bf *BloomFilter) MayContain(term string) bool {
+	h1, h2 := bloomHash(term)
+	for i := uint32(0); i < bf.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Two hashes for double hashing: FNV-1a and its murmur3 finalizer mix
+func bloomHash(term string) (uint64, uint64) {
+
+	h1 := uint64(14695981039346656037)
+	for i := 0; i < len(term); i++ {
+		h1 ^= uint64(term[i])
+		h1 *= 1099511628211
+	}
+
+	h2 := h1
+	h2 ^= h2 >> 33
+	h2 *= 0xff51afd7ed558ccd
+	h2 ^= h2 >> 33
+	h2 *= 0xc4ceb9fe1a85ec53
+	h2 ^= h2 >> 33
+
+	// odd step visits different bits for every i
+	return h1, h2 | 1
+
+}
+
+// Layout: uint32 hashes, uint64 bits count, bit words, all little endian
+func (bf *BloomFilter) MarshalBinary() ([]byte, error) {
+
+	data := make([]byte, 12+8*len(bf.bits))
+	binary.LittleEndian.PutUint32(data, bf.hashes)
+	binary.LittleEndian.PutUint64(data[4:], bf.m)
+	for i, w := range bf.bits {
+		binary.LittleEndian.PutUint64(data[12+8*i:], w)
+	}
+
+	return data, nil
+
+}
+
+func (bf *BloomFilter) UnmarshalBinary(data []byte) error {
+
+	if len(data) < 12 {
+		return ErrCorruptBloomFilter
+	}
+
+	hashes := binary.LittleEndian.Uint32(data)
+	m := binary.LittleEndian.Uint64(data[4:])
+
+	// words come from the length of data, so a crafted bits count can not overflow it
+	if (len(data)-12)%8 != 0 {
+		return ErrCorruptBloomFilter
+	}
+	words := uint64(len(data)-12) / 8
+	if hashes == 0 || words == 0 || m <= 64*(words-1) || m > 64*words {
+		return ErrCorruptBloomFilter
+	}
+
+	bf.bits = make([]uint64, words)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[12+8*i:])
+	}
+	bf.m = m
+	bf.hashes = hashes
+
+	return nil
+
+}
+
+// Encode the filter into bloom file of the current format version
+func (bf *BloomFilter) MarshalFile() ([]byte, error) {
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeFile(KindBloomFilter, Section{SectionBloomFilter, data}), nil
+
+}
+
+// Read bloom file of any known version, returns the version it was written with
+func ReadBloomFilter(data []byte) (*BloomFilter, int, error) {
+
+	data, version, err := Upgrade(KindBloomFilter, data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	f, err := DecodeFile(data, KindBloomFilter)
+	if err != nil {
+		return nil, version, err
+	}
+
+	section, err := f.Section(SectionBloomFilter)
+	if err != nil {
+		return nil, version, err
+	}
+
+	bf := &BloomFilter{}
+
+	return bf, version, bf.UnmarshalBinary(section)
+
+}
+
+// Filter is persisted next to the segment's index file: blocks/index.dat -> blocks/index.bloom
+func BloomFilterPath(indexFile string) string {
+	return strings.TrimSuffix(indexFile, filepath.Ext(indexFile)) + ".bloom"
+}
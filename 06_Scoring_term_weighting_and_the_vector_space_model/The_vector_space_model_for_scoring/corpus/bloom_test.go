@@ -0,0 +1,63 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+
+	n := 1000
+	bf := NewBloomFilter(n, 0.01)
+	for i := 0; i < n; i++ {
+		bf.Add(fmt.Sprintf("term%d", i))
+	}
+
+	data, _ := bf.MarshalBinary()
+	loaded := &BloomFilter{}
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if !loaded.MayContain(fmt.Sprintf("term%d", i)) {
+			t.Fatalf("term%d is added, but filter says it is absent", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if loaded.MayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/20 {
+		t.Errorf("too many false positives: %d of %d", falsePositives, n)
+	}
+
+}
+
+func TestBloomFilterCorrupt(t *testing.T) {
+
+	data, _ := NewBloomFilter(10, 0.01).MarshalBinary()
+
+	// a bits count that overflows the words of it, or does not fit them
+	for _, m := range []uint64{1<<64 - 1, 1<<64 - 63, 0, uint64(len(data)-12)*8 + 1} {
+		corrupt := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(corrupt[4:], m)
+		if err := (&BloomFilter{}).UnmarshalBinary(corrupt); err != ErrCorruptBloomFilter {
+			t.Errorf("expected bits count %d rejected, got %v", m, err)
+		}
+	}
+	// words of the overflowed count match a filter without bits
+	header := append([]byte(nil), data[:12]...)
+	binary.LittleEndian.PutUint64(header[4:], 1<<64-1)
+	if err := (&BloomFilter{}).UnmarshalBinary(header); err != ErrCorruptBloomFilter {
+		t.Errorf("expected filter without bits rejected, got %v", err)
+	}
+	if err := (&BloomFilter{}).UnmarshalBinary(data[:len(data)-3]); err != ErrCorruptBloomFilter {
+		t.Errorf("expected truncated filter rejected, got %v", err)
+	}
+
+}
@@ -12,9 +12,11 @@ func (corpus *Corpus) BuildIndexFromSlice(data []string) {
 
 	corpus.wg.Add(len(data) * 4)
 
-	for i, s := range data {
+	for _, s := range data {
 		words := splitRaw(s)
-		go corpus.createIndex(words, i)
+		// IDs are given in the order of the slice, before the goroutines race
+		id := corpus.Registry.Register(DocumentInfo{Title: Title([]byte(s)), Length: len(words)})
+		go corpus.createIndex(words, id)
 		go corpus.buildKGrammIndexFromTerms(words)
 		go corpus.buildSoundexIndexFromTerms(words)
 		go corpus.buildAutomatonIndexFromTerms(words)
@@ -77,7 +79,6 @@ func (corpus *Corpus) BuildIndexFromSerializedTokens(tokens []SerializedToken) {
 // Create or update index for terms
 func (corpus *Corpus) createIndex(words []string, id int) {
 
-	id++
 	file := fmt.Sprintf("Doc%d", id)
 	corpus.DocsNum++
 
@@ -175,7 +176,7 @@ func (corpus *Corpus) createIndexFromSerializedToken(token SerializedToken) {
 				ID:        d.DocID,
 				File:      d.File,
 				Frequency: d.Frequency,
-				Positions: d.Positions,
+				Positions: d.Positions.Decode(),
 			})
 		}
 		corpus.Put(token.Term, Index{Docs{docs}, token.TotalFrequency, 0, 0})
@@ -189,11 +190,11 @@ func (corpus *Corpus) createIndexFromSerializedToken(token SerializedToken) {
 					ID:        d.DocID,
 					File:      d.File,
 					Frequency: d.Frequency,
-					Positions: d.Positions,
+					Positions: d.Positions.Decode(),
 				})
 				documents.DocsNum++
 			} else {
-				documents.UpdateDocument(d.DocID, d.Positions)
+				documents.UpdateDocument(d.DocID, d.Positions.Decode())
 			}
 		}
 		corpus.Put(token.Term, documents)
@@ -0,0 +1,84 @@
+package corpus
+
+// CommitPoint lists the segments that make up the index at one moment.
+// Segments are never changed after they are written, so the index changes only
+// when a new commit point replaces the old one.
+type CommitPoint struct {
+	Segments []CommitSegment
+	// Deleted documents that are still in the segments
+	Deleted *Bitmap
+	// Documents of every segment and the ID of the next added one
+	Registry *Registry
+	// Number of the last written segment, numbers are never reused
+	Sequence int
+}
+
+type CommitSegment struct {
+	IndexFile string
+}
+
+type serializedCommit struct {
+	Segments []CommitSegment
+	Sequence int
+}
+
+// Encode commit point into file of the current format version
+func (c *CommitPoint) MarshalFile() ([]byte, error) {
+
+	segments, err := encodeGob(serializedCommit{c.Segments, c.Sequence})
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := c.Deleted.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := c.Registry.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeFile(KindCommit, Section{SectionSegments, segments}, Section{SectionBitmap, deleted}, Section{SectionRegistry, registry}), nil
+
+}
+
+// Decode commit point, commit points appeared in version 2, so there is nothing to upgrade
+func ReadCommitPoint(data []byte) (*CommitPoint, error) {
+
+	f, err := DecodeFile(data, KindCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	section, err := f.Section(SectionSegments)
+	if err != nil {
+		return nil, err
+	}
+	sc := serializedCommit{}
+	if err := decodeGob(section, &sc); err != nil {
+		return nil, err
+	}
+
+	section, err = f.Section(SectionBitmap)
+	if err != nil {
+		return nil, err
+	}
+	deleted := NewBitmap()
+	if err := deleted.UnmarshalBinary(section); err != nil {
+		return nil, err
+	}
+
+	section, err = f.Section(SectionRegistry)
+	if err != nil {
+		return nil, err
+	}
+	registry := NewRegistry()
+	if err := registry.UnmarshalBinary(section); err != nil {
+		return nil, err
+	}
+
+	return &CommitPoint{sc.Segments, deleted, registry, sc.Sequence}, nil
+
+}
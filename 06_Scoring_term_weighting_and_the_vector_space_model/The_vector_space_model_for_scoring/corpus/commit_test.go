@@ -0,0 +1,44 @@
+package corpus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommitPoint(t *testing.T) {
+
+	deleted := NewBitmap()
+	deleted.Set(5)
+
+	registry := NewRegistry()
+	registry.Put(DocumentInfo{ID: 8, Path: "new.txt", Title: "what did zebra say", Length: 4, Added: time.Unix(1, 0).UTC()})
+
+	commit := &CommitPoint{
+		Segments: []CommitSegment{{"blocks/index.dat"}, {"blocks/segment3/index.dat"}},
+		Deleted:  deleted,
+		Registry: registry,
+		Sequence: 3,
+	}
+
+	data, err := commit.MarshalFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := ReadCommitPoint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Segments, commit.Segments) || !reflect.DeepEqual(loaded.Deleted, deleted) || loaded.Sequence != 3 {
+		t.Errorf("expected %+v, got %+v", commit, loaded)
+	}
+	if loaded.Registry.NextID() != 9 || !reflect.DeepEqual(loaded.Registry.Documents(), registry.Documents()) {
+		t.Errorf("expected registry %v, got %v", registry.Documents(), loaded.Registry.Documents())
+	}
+
+	if _, err := ReadCommitPoint(deleted.MarshalFile()); err != ErrWrongKind {
+		t.Errorf("bitmap is read as a commit point, %v", err)
+	}
+
+}
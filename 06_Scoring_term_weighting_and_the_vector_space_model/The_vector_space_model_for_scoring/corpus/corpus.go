@@ -15,6 +15,7 @@ type Corpus struct {
 	soundex   *SoundexIndex
 	automaton *Automaton
 	Documents *DocumentTree
+	Registry  *Registry
 	mutex     *sync.Mutex
 	wg        *sync.WaitGroup
 }
@@ -47,6 +48,7 @@ func NewCorpus() *Corpus{
 			&sync.Mutex{},
 			&sync.WaitGroup{},
 		},
+		NewRegistry(),
 		&sync.Mutex{},
 		&sync.WaitGroup{},
 	}
@@ -0,0 +1,84 @@
+package corpus
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrTermNotFound is returned when the term is neither in the dictionary nor in its block
+	ErrTermNotFound = errors.New("corpus: term not found")
+	// ErrMissingSegment is returned when an index, block or source file does not exist
+	ErrMissingSegment = errors.New("corpus: missing segment")
+	// ErrDocumentNotFound is returned when no part of the index has the document or it is deleted
+	ErrDocumentNotFound = errors.New("corpus: document not found")
+	// ErrDuplicateDocument is returned when a store already has a document of the ID
+	ErrDuplicateDocument = errors.New("corpus: duplicate document")
+)
+
+// FileError is a failure of one file. errors.Is matches both its kind,
+// ErrCorruptBlock or ErrMissingSegment, and the underlying error.
+type FileError struct {
+	Path string
+	Kind error
+	Err  error
+}
+
+// Classify failure of reading or decoding the file
+func NewFileError(path string, err error) *FileError {
+
+	kind := ErrCorruptBlock
+	if errors.Is(err, os.ErrNotExist) {
+		kind = ErrMissingSegment
+	}
+
+	return &FileError{path, kind, err}
+
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FileError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError collects failures of independent parts of a job,
+// results of the parts that did not fail are still returned along with it
+type PartialError struct {
+	Errors []error
+}
+
+// Add the failure of one part, failures of nested jobs are flattened
+func (e *PartialError) Add(err error) {
+	if nested, ok := err.(*PartialError); ok {
+		e.Errors = append(e.Errors, nested.Errors...)
+	} else if err != nil {
+		e.Errors = append(e.Errors, err)
+	}
+}
+
+func (e *PartialError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	return fmt.Sprintf("%d failures, first: %v", len(e.Errors), e.Errors[0])
+}
+
+func (e *PartialError) Unwrap() []error {
+	return e.Errors
+}
+
+// Nil when nothing failed, so the result can be returned as error directly
+func (e *PartialError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,289 @@
+package corpus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// On-disk format versions:
+//
+//	0 - headerless base64 gob, what chapters 4-6 write (positions are []int)
+//	2 - header with magic and version, every section is protected by CRC32C
+//
+// Files of version 0 are upgraded to the current version by migrations.
+const FormatVersion = 2
+
+const formatMagic = "IRFX"
+
+// File layout, little endian:
+//
+//	magic "IRFX", uint16 version, uint16 kind, uint32 sections count
+//	section: uint32 id, uint32 CRC32C of data, uint64 data length, data
+const (
+	fileHeaderSize    = 12
+	sectionHeaderSize = 16
+)
+
+// FileKind tells what is stored in the file, so a block can not be loaded as a tree
+type FileKind uint16
+
+const (
+	KindBlock FileKind = iota + 1
+	KindBlockTree
+	KindCorpus
+	KindBloomFilter
+	KindRun
+	KindBitmap
+	KindCommit
+	KindLog
+	KindStore
+)
+
+func (k FileKind) String() string {
+	switch k {
+	case KindBlock:
+		return "block"
+	case KindBlockTree:
+		return "block tree"
+	case KindCorpus:
+		return "corpus"
+	case KindBloomFilter:
+		return "bloom filter"
+	case KindRun:
+		return "run"
+	case KindBitmap:
+		return "bitmap"
+	case KindCommit:
+		return "commit point"
+	case KindLog:
+		return "write-ahead log"
+	case KindStore:
+		return "document store"
+	}
+	return fmt.Sprintf("kind %d", uint16(k))
+}
+
+// Section IDs
+const (
+	SectionPostings uint32 = iota + 1
+	SectionDictionary
+	SectionDocuments
+	SectionChecksums
+	SectionCorpus
+	SectionBloomFilter
+	SectionEntries
+	SectionBitmap
+	SectionFiles
+	SectionSegments
+	SectionRegistry
+	SectionStoredDocuments
+)
+
+var (
+	ErrBadMagic           = errors.New("corpus: not an index file")
+	ErrUnsupportedVersion = errors.New("corpus: unsupported format version")
+	ErrChecksumMismatch   = errors.New("corpus: section checksum mismatch")
+	ErrWrongKind          = errors.New("corpus: unexpected file kind")
+	ErrMissingSection     = errors.New("corpus: missing section")
+	ErrUnknownFileFormat  = errors.New("corpus: unknown file format")
+)
+
+type Section struct {
+	ID   uint32
+	Data []byte
+}
+
+// Decoded file, sections point into the original data
+type FormatFile struct {
+	Version  int
+	Kind     FileKind
+	Sections []Section
+}
+
+// Encode sections into a file of the current version
+func EncodeFile(kind FileKind, sections ...Section) []byte {
+
+	size := fileHeaderSize
+	for _, s := range sections {
+		size += sectionHeaderSize + len(s.Data)
+	}
+
+	data := make([]byte, 0, size)
+	data = append(data, fileHeader(kind, len(sections))...)
+
+	for _, s := range sections {
+		data = append(data, sectionHeader(s.ID, Checksum(s.Data), uint64(len(s.Data)))...)
+		data = append(data, s.Data...)
+	}
+
+	return data
+
+}
+
+func fileHeader(kind FileKind, sections int) []byte {
+
+	header := make([]byte, fileHeaderSize)
+	copy(header, formatMagic)
+	binary.LittleEndian.PutUint16(header[4:], FormatVersion)
+	binary.LittleEndian.PutUint16(header[6:], uint16(kind))
+	binary.LittleEndian.PutUint32(header[8:], uint32(sections))
+
+	return header
+
+}
+
+func sectionHeader(id uint32, crc uint32, length uint64) []byte {
+
+	header := make([]byte, sectionHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], id)
+	binary.LittleEndian.PutUint32(header[4:], crc)
+	binary.LittleEndian.PutUint64(header[8:], length)
+
+	return header
+
+}
+
+// FileWriter writes a file of the current version section by section, so data of
+// a section can be streamed from a reader instead of being kept in memory.
+// The file is the same EncodeFile gives for these sections.
+type FileWriter struct {
+	w        io.Writer
+	sections int
+}
+
+// Write the file header, exactly sections sections must follow
+func NewFileWriter(w io.Writer, kind FileKind, sections int) (*FileWriter, error) {
+
+	if _, err := w.Write(fileHeader(kind, sections)); err != nil {
+		return nil, err
+	}
+
+	return &FileWriter{w, sections}, nil
+
+}
+
+func (f *FileWriter) WriteSection(s Section) error {
+	return f.StreamSection(s.ID, Checksum(s.Data), int64(len(s.Data)), bytes.NewReader(s.Data))
+}
+
+// Copy length bytes of the section from r. CRC32C and length go before the data,
+// so the caller knows them in advance, data that does not match them is an error.
+func (f *FileWriter) StreamSection(id uint32, crc uint32, length int64, r io.Reader) error {
+
+	if f.sections == 0 {
+		return errors.New("corpus: more sections than the file header declares")
+	}
+	f.sections--
+
+	if _, err := f.w.Write(sectionHeader(id, crc, uint64(length))); err != nil {
+		return err
+	}
+
+	actual := crc32.New(castagnoli)
+	if _, err := io.CopyN(io.MultiWriter(f.w, actual), r, length); err != nil {
+		return err
+	}
+	if actual.Sum32() != crc {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+
+}
+
+// Decode file of the current version and check every section's CRC32C
+func DecodeFile(data []byte, kind FileKind) (*FormatFile, error) {
+
+	if len(data) < fileHeaderSize || string(data[:4]) != formatMagic {
+		return nil, ErrBadMagic
+	}
+	if binary.LittleEndian.Uint16(data[4:]) != FormatVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	f := &FormatFile{
+		Version: int(binary.LittleEndian.Uint16(data[4:])),
+		Kind:    FileKind(binary.LittleEndian.Uint16(data[6:])),
+	}
+	if f.Kind != kind {
+		return nil, ErrWrongKind
+	}
+
+	count := int(binary.LittleEndian.Uint32(data[8:]))
+	pos := fileHeaderSize
+
+	for i := 0; i < count; i++ {
+		if pos+sectionHeaderSize > len(data) {
+			return nil, ErrCorruptBlock
+		}
+		id := binary.LittleEndian.Uint32(data[pos:])
+		crc := binary.LittleEndian.Uint32(data[pos+4:])
+		length := binary.LittleEndian.Uint64(data[pos+8:])
+		pos += sectionHeaderSize
+		if length > uint64(len(data)-pos) {
+			return nil, ErrCorruptBlock
+		}
+		section := data[pos : pos+int(length)]
+		if Checksum(section) != crc {
+			return nil, ErrChecksumMismatch
+		}
+		f.Sections = append(f.Sections, Section{id, section})
+		pos += int(length)
+	}
+
+	return f, nil
+
+}
+
+func (f *FormatFile) Section(id uint32) ([]byte, error) {
+	for _, s := range f.Sections {
+		if s.ID == id {
+			return s.Data, nil
+		}
+	}
+	return nil, ErrMissingSection
+}
+
+// Version of the file, headerless files of version 0 are recognized by their content.
+// Data that has no header and is not base64 is ErrUnknownFileFormat.
+func DetectVersion(data []byte) (int, error) {
+
+	if len(data) >= fileHeaderSize && string(data[:4]) == formatMagic {
+		return int(binary.LittleEndian.Uint16(data[4:])), nil
+	}
+
+	if isBase64(data) {
+		return 0, nil
+	}
+
+	return 0, ErrUnknownFileFormat
+
+}
+
+// Gob streams of version 0 were always base64 encoded
+func isBase64(data []byte) bool {
+
+	if len(data) == 0 {
+		return false
+	}
+
+	n := len(data)
+	if n > 64 {
+		n = 64
+	}
+
+	for _, c := range data[:n] {
+		isLetter := c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !isDigit && c != '+' && c != '/' && c != '=' {
+			return false
+		}
+	}
+
+	return true
+
+}
@@ -0,0 +1,171 @@
+package corpus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestFileRoundTrip(t *testing.T) {
+
+	data := EncodeFile(KindBlock, Section{SectionPostings, []byte("postings")}, Section{SectionChecksums, nil})
+
+	if v, err := DetectVersion(data); err != nil || v != FormatVersion {
+		t.Errorf("expected version %d, got %d, %v", FormatVersion, v, err)
+	}
+
+	f, err := DecodeFile(data, KindBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if section, err := f.Section(SectionPostings); err != nil || string(section) != "postings" {
+		t.Errorf("unexpected section %q, %v", section, err)
+	}
+	if _, err := f.Section(SectionDocuments); err != ErrMissingSection {
+		t.Errorf("expected missing section, got %v", err)
+	}
+
+	if _, err := DecodeFile(data, KindBlockTree); err != ErrWrongKind {
+		t.Errorf("block is decoded as a tree, %v", err)
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[fileHeaderSize+sectionHeaderSize] ^= 1
+	if _, err := DecodeFile(corrupted, KindBlock); err != ErrChecksumMismatch {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+
+	if _, err := DecodeFile(data[:len(data)-3], KindBlock); err != ErrCorruptBlock {
+		t.Errorf("expected corrupt file, got %v", err)
+	}
+
+}
+
+// Streamed sections give the file EncodeFile gives
+func TestFileWriter(t *testing.T) {
+
+	sections := []Section{{SectionEntries, []byte("entries")}, {SectionStoredDocuments, []byte("documents")}}
+
+	b := bytes.Buffer{}
+	w, err := NewFileWriter(&b, KindStore, len(sections))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteSection(sections[0]); err != nil {
+		t.Fatal(err)
+	}
+	data := sections[1].Data
+	if err := w.StreamSection(sections[1].ID, Checksum(data), int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := EncodeFile(KindStore, sections...); !bytes.Equal(b.Bytes(), expected) {
+		t.Error("streamed file differs from the encoded one")
+	}
+	if err := w.WriteSection(sections[0]); err == nil {
+		t.Error("expected an error for a section the header does not declare")
+	}
+
+	w, _ = NewFileWriter(&bytes.Buffer{}, KindStore, 2)
+	if err := w.StreamSection(SectionEntries, Checksum(data)^1, int64(len(data)), bytes.NewReader(data)); err != ErrChecksumMismatch {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if err := w.StreamSection(SectionEntries, Checksum(data), int64(len(data))+1, bytes.NewReader(data)); err == nil {
+		t.Error("expected an error for a short section")
+	}
+
+}
+
+func encodeGob64(t *testing.T, v interface{}) []byte {
+	b := bytes.Buffer{}
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(b.Bytes()))
+}
+
+// Blocks of chapters 4-6 keep positions as []int
+func TestMigrateGobBlock(t *testing.T) {
+
+	legacy := encodeGob64(t, &legacySerializedCorpus{[]legacySerializedToken{
+		{Term: "say", TotalFrequency: 2, Docs: []legacySerializedDoc{
+			{DocID: 1, File: "text1.txt", Frequency: 2, Positions: []int{7, 3}},
+		}},
+	}})
+
+	if v, err := DetectVersion(legacy); err != nil || v != 0 {
+		t.Errorf("expected version 0, got %d, %v", v, err)
+	}
+
+	block, version, err := ReadBlock(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("expected version 0, got %d", version)
+	}
+
+	token, ok, _ := block.Find("say")
+	if !ok {
+		t.Fatal("say is not found")
+	}
+	if positions := token.Docs[0].Positions.Decode(); !reflect.DeepEqual(positions, []int{3, 7}) {
+		t.Errorf("unexpected positions %v", positions)
+	}
+
+}
+
+// Block trees of chapter 5 have no documents
+func TestMigrateGobBlockTree(t *testing.T) {
+
+	legacy := encodeGob64(t, &struct{ Blocks []SerializedBlock }{
+		[]SerializedBlock{{"say", "blocks/block0.dat"}, {"mean", "blocks/block1.dat"}},
+	})
+
+	bt, version, err := ReadBlockTree(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || bt.Size() != 2 || bt.Documents.Size() != 0 {
+		t.Errorf("unexpected tree of version %d with %d terms", version, bt.Size())
+	}
+
+	data, err := bt.MarshalFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, version, err = ReadBlockTree(data)
+	if err != nil || version != FormatVersion {
+		t.Fatalf("expected version %d, got %d, %v", FormatVersion, version, err)
+	}
+	if block, _ := bt.Get("mean"); block != "blocks/block1.dat" {
+		t.Errorf("unexpected block %v", block)
+	}
+
+}
+
+// Files of versions that were never written and data that is not an index file are refused
+func TestUnknownVersions(t *testing.T) {
+
+	sc := &SerializedCorpus{Tokens: []SerializedToken{{Term: "mean", Docs: []SerializedDoc{{DocID: 4}}}}}
+
+	// headerless binary postings are not gob, nothing is guessed about them
+	if _, err := DetectVersion(sc.ToBlock()); err != ErrUnknownFileFormat {
+		t.Errorf("expected unknown format, got %v", err)
+	}
+	if _, _, err := ReadBlock(sc.ToBlock()); err != ErrUnknownFileFormat {
+		t.Errorf("expected unknown format, got %v", err)
+	}
+
+	data := sc.ToBlockFile()
+	binary.LittleEndian.PutUint16(data[4:], 1)
+	if v, err := DetectVersion(data); err != nil || v != 1 {
+		t.Errorf("expected version 1, got %d, %v", v, err)
+	}
+	if _, _, err := ReadBlock(data); err != ErrUnsupportedVersion {
+		t.Errorf("expected unsupported version, got %v", err)
+	}
+
+}
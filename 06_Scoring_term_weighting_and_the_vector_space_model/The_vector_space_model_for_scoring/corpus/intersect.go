@@ -249,6 +249,66 @@ func (corpus *Corpus) Intersect(term1, term2 string) Docs {
 	return answer
 }
 
+// Intersect 2 PForDelta compressed postings lists block by block.
+// Returns ordinals of common doc IDs in both lists. Blocks that end before
+// the current doc ID of the other list are skipped without decoding.
+// A corrupt block of either list gives ErrCorruptBlock.
+func IntersectPFor(p1, p2 PForList) ([][2]int, error) {
+
+	answer := make([][2]int, 0)
+
+	it1, it2 := p1.Iterator(), p2.Iterator()
+	ok1, ok2 := it1.Next(), it2.Next()
+	i, j := 0, 0
+
+	for ok1 && ok2 {
+		// a block is decoded only when the other one does not skip it
+		docs2, err := it2.Values()
+		if err != nil {
+			return nil, err
+		}
+		if it1.Last() < docs2[j] {
+			ok1, i = it1.Next(), 0
+			continue
+		}
+		docs1, err := it1.Values()
+		if err != nil {
+			return nil, err
+		}
+		if it2.Last() < docs1[i] {
+			ok2, j = it2.Next(), 0
+			continue
+		}
+
+		if docs1[i] == docs2[j] {
+			answer = append(answer, [2]int{it1.Offset() + i, it2.Offset() + j})
+			i++
+			j++
+		} else if docs1[i] < docs2[j] {
+			i++
+		} else {
+			j++
+		}
+
+		if i == len(docs1) {
+			ok1, i = it1.Next(), 0
+		}
+		if j == len(docs2) {
+			ok2, j = it2.Next(), 0
+		}
+	}
+
+	if err := it1.Err(); err != nil {
+		return nil, err
+	}
+	if err := it2.Err(); err != nil {
+		return nil, err
+	}
+
+	return answer, nil
+
+}
+
 //INTERSECT(p1, p2)
 //1 answer ← ()
 //2 while p1 != NIL and p2 != NIL
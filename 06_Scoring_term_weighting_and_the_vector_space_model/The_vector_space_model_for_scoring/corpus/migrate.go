@@ -0,0 +1,121 @@
+package corpus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+)
+
+// Migration upgrades file data of version 0 to the current format version
+type migration func(data []byte) ([]byte, error)
+
+// Migrations of every kind that was written in version 0. Bloom filters and
+// temp corpus files appeared in the current version, so they are never migrated.
+var migrations = map[FileKind]migration{
+	KindBlock:     migrateGobBlock,
+	KindBlockTree: migrateGobBlockTree,
+}
+
+// Version 0 postings of chapters 4-6, positions are plain numbers
+type legacySerializedDoc struct {
+	Positions                []int
+	DocID                    int
+	File                     string
+	Frequency                int
+	InverseDocumentFrequency float32
+}
+
+type legacySerializedToken struct {
+	Term                     string
+	Docs                     []legacySerializedDoc
+	TotalFrequency           int
+	InverseDocumentFrequency float32
+}
+
+type legacySerializedCorpus struct {
+	Tokens []legacySerializedToken
+}
+
+// Upgrade file data of any known version to the current one,
+// returns upgraded data and the version the data was written with
+func Upgrade(kind FileKind, data []byte) ([]byte, int, error) {
+
+	version, err := DetectVersion(data)
+	if err != nil {
+		return nil, version, err
+	}
+	if version == FormatVersion {
+		return data, version, nil
+	}
+
+	migrate, ok := migrations[kind]
+	if version != 0 || !ok {
+		return nil, version, ErrUnsupportedVersion
+	}
+	data, err = migrate(data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	return data, version, nil
+
+}
+
+// Base64 gob block of chapters 4-6 into binary block
+func migrateGobBlock(data []byte) ([]byte, error) {
+
+	legacy := &legacySerializedCorpus{}
+	if err := decodeGob64(data, legacy); err != nil {
+		return nil, err
+	}
+
+	sc := &SerializedCorpus{Tokens: make([]SerializedToken, 0, len(legacy.Tokens))}
+	for _, t := range legacy.Tokens {
+		docs := make([]SerializedDoc, 0, len(t.Docs))
+		for _, d := range t.Docs {
+			docs = append(docs, SerializedDoc{
+				Positions:                EncodePositions(d.Positions),
+				DocID:                    d.DocID,
+				File:                     d.File,
+				Frequency:                d.Frequency,
+				InverseDocumentFrequency: d.InverseDocumentFrequency,
+			})
+		}
+		sc.Tokens = append(sc.Tokens, SerializedToken{
+			Term:                     t.Term,
+			Docs:                     docs,
+			TotalFrequency:           t.TotalFrequency,
+			InverseDocumentFrequency: t.InverseDocumentFrequency,
+		})
+	}
+
+	return sc.ToBlockFile(), nil
+
+}
+
+// Base64 gob block tree into sections, trees of chapter 5 have no documents
+func migrateGobBlockTree(data []byte) ([]byte, error) {
+
+	sbt := &SerializedBlockTree{}
+	if err := decodeGob64(data, sbt); err != nil {
+		return nil, err
+	}
+
+	return sbt.toFile(nil)
+
+}
+
+func decodeGob64(data []byte, v interface{}) error {
+	d := gob.NewDecoder(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data)))
+	return d.Decode(v)
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+	b := bytes.Buffer{}
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+
+func decodeGob(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
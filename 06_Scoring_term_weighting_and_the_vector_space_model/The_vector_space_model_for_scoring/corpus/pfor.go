@@ -0,0 +1,291 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// Amount of doc IDs packed together, every block is decoded at once
+const PForBlockSize = 128
+
+// Part of gaps that must fit into the chosen bit width, the rest become exceptions
+const pforCoverage = 0.9
+
+// PForList is a sorted list of doc IDs compressed with PForDelta.
+// IDs are replaced with gaps and split into blocks of PForBlockSize gaps.
+// Every block stores gaps minus the smallest gap of the block (frame of reference)
+// packed into b bits, where b is wide enough for 90% of the gaps. Gaps that do not
+// fit are exceptions: their slots are 0 and the values are stored after the block.
+//
+// List layout, numbers are uvarints:
+//
+//	block: last doc ID, data length, data
+//	data:  byte count, byte b, byte exceptions count, frame of reference,
+//	       packed slots, exceptions (byte index, value)
+//
+// Last doc ID of every block is stored in front of the data, so intersection
+// can skip blocks without decoding them.
+type PForList []byte
+
+// Compress sorted doc IDs
+func EncodePFor(ids []int) PForList {
+
+	pl := make(PForList, 0)
+	prev := 0
+
+	for begin := 0; begin < len(ids); begin += PForBlockSize {
+		end := begin + PForBlockSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		gaps := make([]uint64, end-begin)
+		for i, id := range ids[begin:end] {
+			gaps[i] = uint64(id - prev)
+			prev = id
+		}
+
+		data := encodePForBlock(gaps)
+		pl = appendUvarint(pl, uint64(prev))
+		pl = appendUvarint(pl, uint64(len(data)))
+		pl = append(pl, data...)
+	}
+
+	return pl
+
+}
+
+func encodePForBlock(gaps []uint64) []byte {
+
+	sorted := make([]uint64, len(gaps))
+	copy(sorted, gaps)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	base := sorted[0]
+	covered := sorted[int(float64(len(sorted)-1)*pforCoverage)] - base
+	b := uint(bits.Len64(covered))
+
+	data := []byte{byte(len(gaps)), byte(b), 0}
+	data = appendUvarint(data, base)
+
+	slots := make([]uint64, len(gaps))
+	exceptions := make([]byte, 0)
+	exceptionsNum := 0
+	for i, g := range gaps {
+		v := g - base
+		if bits.Len64(v) > int(b) {
+			exceptions = append(exceptions, byte(i))
+			exceptions = appendUvarint(exceptions, v)
+			exceptionsNum++
+			continue
+		}
+		slots[i] = v
+	}
+	data[2] = byte(exceptionsNum)
+
+	data = packBits(data, slots, b)
+
+	return append(data, exceptions...)
+
+}
+
+// Append values packed into b bits each, least significant bits first
+func packBits(buf []byte, values []uint64, b uint) []byte {
+
+	start := len(buf)
+	buf = append(buf, make([]byte, (uint(len(values))*b+7)/8)...)
+	out := buf[start:]
+
+	bit := uint(0)
+	for _, v := range values {
+		for written := uint(0); written < b; {
+			idx := (bit + written) / 8
+			offset := (bit + written) % 8
+			take := 8 - offset
+			if take > b-written {
+				take = b - written
+			}
+			out[idx] |= byte((v>>written)&(1<<take-1)) << offset
+			written += take
+		}
+		bit += b
+	}
+
+	return buf
+
+}
+
+// Unpack n values of b bits each into out, data must hold them
+func unpackBits(data []byte, out []uint64, b uint) {
+
+	bit := uint(0)
+	for i := range out {
+		var v uint64
+		for read := uint(0); read < b; {
+			idx := (bit + read) / 8
+			offset := (bit + read) % 8
+			take := 8 - offset
+			if take > b-read {
+				take = b - read
+			}
+			v |= (uint64(data[idx]>>offset) & (1<<take - 1)) << read
+			read += take
+		}
+		out[i] = v
+		bit += b
+	}
+
+}
+
+// Decode the whole list
+func (pl PForList) Decode() ([]int, error) {
+
+	ids := make([]int, 0)
+
+	it := pl.Iterator()
+	for it.Next() {
+		values, err := it.Values()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, values...)
+	}
+
+	return ids, it.Err()
+
+}
+
+// PForIterator walks over blocks of the list and decodes only requested blocks.
+// A corrupt block stops the iteration, Err tells it from the end of the list.
+type PForIterator struct {
+	list    PForList
+	pos     int
+	block   []byte
+	first   int // previous block's last ID, gaps of the block start from it
+	last    int
+	offset  int
+	size    int
+	decoded bool
+	err     error
+	gaps    [PForBlockSize]uint64
+	values  [PForBlockSize]int
+}
+
+func (pl PForList) Iterator() *PForIterator {
+	return &PForIterator{list: pl}
+}
+
+// Move to the next block without decoding it
+func (it *PForIterator) Next() bool {
+
+	if it.err != nil || it.pos >= len(it.list) {
+		return false
+	}
+
+	last, n := binary.Uvarint(it.list[it.pos:])
+	if n <= 0 {
+		return it.fail()
+	}
+	length, m := binary.Uvarint(it.list[it.pos+n:])
+	start := it.pos + n + m
+	if m <= 0 || length < 3 || length > uint64(len(it.list)-start) {
+		return it.fail()
+	}
+	block := it.list[start : start+int(length)]
+	if size := int(block[0]); size == 0 || size > PForBlockSize {
+		return it.fail()
+	}
+
+	it.first = it.last
+	it.offset += it.size
+	it.last = int(last)
+	it.block = block
+	it.size = int(block[0])
+	it.pos = start + int(length)
+	it.decoded = false
+
+	return true
+
+}
+
+// Stop the iteration at a corrupt block
+func (it *PForIterator) fail() bool {
+
+	it.err = ErrCorruptBlock
+	it.pos = len(it.list)
+
+	return false
+
+}
+
+// ErrCorruptBlock when the iteration stopped at a corrupt block, nil at the end of the list
+func (it *PForIterator) Err() error {
+	return it.err
+}
+
+// Last doc ID of the current block, known without decoding
+func (it *PForIterator) Last() int {
+	return it.last
+}
+
+// Ordinal of the first doc ID of the current block in the whole list
+func (it *PForIterator) Offset() int {
+	return it.offset
+}
+
+// Decode the current block into absolute doc IDs, the slice is reused by the next block.
+// Bit width, exceptions and lengths are checked, so corrupt bytes give ErrCorruptBlock.
+func (it *PForIterator) Values() ([]int, error) {
+
+	if it.decoded {
+		return it.values[:it.size], nil
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+
+	n := it.size
+	b := uint(it.block[1])
+	exceptionsNum := int(it.block[2])
+	if b > 64 || exceptionsNum > n {
+		it.fail()
+		return nil, it.err
+	}
+
+	base, k := binary.Uvarint(it.block[3:])
+	pos := 3 + k
+	packed := (n*int(b) + 7) / 8
+	if k <= 0 || packed > len(it.block)-pos {
+		it.fail()
+		return nil, it.err
+	}
+	unpackBits(it.block[pos:pos+packed], it.gaps[:n], b)
+	pos += packed
+
+	for e := 0; e < exceptionsNum; e++ {
+		if pos >= len(it.block) || int(it.block[pos]) >= n {
+			it.fail()
+			return nil, it.err
+		}
+		idx := int(it.block[pos])
+		v, k := binary.Uvarint(it.block[pos+1:])
+		if k <= 0 {
+			it.fail()
+			return nil, it.err
+		}
+		it.gaps[idx] = v
+		pos += 1 + k
+	}
+
+	prev := it.first
+	for i := 0; i < n; i++ {
+		prev += int(it.gaps[i] + base)
+		it.values[i] = prev
+	}
+
+	it.decoded = true
+
+	return it.values[:n], nil
+
+}
@@ -0,0 +1,110 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func randomIDs(r *rand.Rand, n, maxGap int) []int {
+	ids := make([]int, n)
+	prev := 0
+	for i := range ids {
+		prev += 1 + r.Intn(maxGap)
+		// rare big gaps turn into exceptions
+		if r.Intn(50) == 0 {
+			prev += 1 << 20
+		}
+		ids[i] = prev
+	}
+	return ids
+}
+
+func TestPForRoundTrip(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{0, 1, 127, 128, 129, 1000} {
+		ids := randomIDs(r, n, 10)
+		decoded, err := EncodePFor(ids).Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) == 0 && len(decoded) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(ids, decoded) {
+			t.Errorf("%d ids: round trip mismatch", n)
+		}
+	}
+
+	// doc IDs start from 0 in SPIMI
+	if decoded, _ := EncodePFor([]int{0, 1, 2}).Decode(); !reflect.DeepEqual(decoded, []int{0, 1, 2}) {
+		t.Errorf("unexpected %v", decoded)
+	}
+
+}
+
+func TestIntersectPFor(t *testing.T) {
+
+	r := rand.New(rand.NewSource(2))
+	ids1 := randomIDs(r, 1000, 4)
+	ids2 := randomIDs(r, 300, 16)
+
+	expected := make([][2]int, 0)
+	for i, a := range ids1 {
+		for j, b := range ids2 {
+			if a == b {
+				expected = append(expected, [2]int{i, j})
+			}
+		}
+	}
+
+	if answer, err := IntersectPFor(EncodePFor(ids1), EncodePFor(ids2)); err != nil || !reflect.DeepEqual(answer, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, answer, err)
+	}
+
+}
+
+func TestPForCorrupt(t *testing.T) {
+
+	r := rand.New(rand.NewSource(3))
+	pl := EncodePFor(randomIDs(r, 300, 10))
+
+	// header of the first block: last doc ID and data length, then size, bit width and exceptions
+	_, n := binary.Uvarint(pl)
+	_, m := binary.Uvarint(pl[n:])
+	header := n + m
+
+	cases := map[string]func(PForList){
+		"size":       func(c PForList) { c[header] = PForBlockSize + 1 },
+		"empty":      func(c PForList) { c[header] = 0 },
+		"bit width":  func(c PForList) { c[header+1] = 65 },
+		"exceptions": func(c PForList) { c[header+2] = 255 },
+		"length":     func(c PForList) { c[n] = 0x7f },
+	}
+	for name, corrupt := range cases {
+		c := append(PForList(nil), pl...)
+		corrupt(c)
+		if _, err := c.Decode(); !errors.Is(err, ErrCorruptBlock) {
+			t.Errorf("%s: expected corrupt block, got %v", name, err)
+		}
+		if _, err := IntersectPFor(c, pl); !errors.Is(err, ErrCorruptBlock) {
+			t.Errorf("%s: expected intersection to fail, got %v", name, err)
+		}
+	}
+
+	// a block cut short and random damage never panic
+	if _, err := pl[:len(pl)/2].Decode(); !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("expected truncated list to fail, got %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		c := append(PForList(nil), pl...)
+		c[r.Intn(len(c))] = byte(r.Intn(256))
+		c.Decode()
+		IntersectPFor(c, pl)
+	}
+
+}
@@ -0,0 +1,97 @@
+package corpus
+
+import "sort"
+
+// PositionList keeps positions of a term in a document as VB encoded gaps.
+// Positions are decoded only on demand, so scoring that needs frequencies
+// only never pays for them.
+type PositionList []byte
+
+// Sort positions, replace them with gaps and VB encode every gap
+func EncodePositions(positions []int) PositionList {
+
+	sorted := make([]int, len(positions))
+	copy(sorted, positions)
+	sort.Ints(sorted)
+
+	return PositionList(VBEncodeGaps(sorted))
+
+}
+
+// Decode gaps back into sorted positions
+func (pl PositionList) Decode() []int {
+	return VBDecodeGaps(pl, pl.Len())
+}
+
+// Amount of encoded positions, every number ends with a byte that has the high bit set
+func (pl PositionList) Len() int {
+
+	count := 0
+	for _, b := range pl {
+		if b >= 128 {
+			count++
+		}
+	}
+
+	return count
+
+}
+
+// VB encode gaps between sorted numbers
+func VBEncodeGaps(sorted []int) []byte {
+
+	buf := make([]byte, 0, len(sorted))
+	prev := 0
+	for _, n := range sorted {
+		buf = VBEncodeNumber(buf, n-prev)
+		prev = n
+	}
+
+	return buf
+
+}
+
+// Decode VB encoded gaps into sorted numbers, size is only a capacity hint
+func VBDecodeGaps(data []byte, size int) []int {
+
+	numbers := make([]int, 0, size)
+	n, prev := 0, 0
+
+	for _, b := range data {
+		if b < 128 {
+			n = 128*n + int(b)
+		} else {
+			prev += 128*n + int(b-128)
+			numbers = append(numbers, prev)
+			n = 0
+		}
+	}
+
+	return numbers
+
+}
+
+// VBENCODENUMBER(n)
+// 1 bytes ← ()
+// 2 while true
+// 3 do PREPEND(bytes, n mod 128)
+// 4 if n < 128
+// 5 then BREAK
+// 6 n ← n div 128
+// 7 bytes[LENGTH(bytes)] += 128
+// 8 return bytes
+func VBEncodeNumber(buf []byte, n int) []byte {
+
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(n%128) + 128
+
+	for n >= 128 {
+		n /= 128
+		i--
+		tmp[i] = byte(n % 128)
+	}
+
+	return append(buf, tmp[i:]...)
+
+}
@@ -0,0 +1,66 @@
+package corpus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPositionList(t *testing.T) {
+
+	positions := []int{824, 5, 829, 215406, 5}
+	pl := EncodePositions(positions)
+
+	if pl.Len() != len(positions) {
+		t.Errorf("expected %d positions, got %d", len(positions), pl.Len())
+	}
+
+	expected := []int{5, 5, 824, 829, 215406}
+	if decoded := pl.Decode(); !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("expected %v, got %v", expected, decoded)
+	}
+
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+
+	sc := &SerializedCorpus{Tokens: []SerializedToken{
+		{
+			Term:           "say",
+			TotalFrequency: 3,
+			Docs: []SerializedDoc{
+				{DocID: 1, File: "text1.txt", Frequency: 2, Positions: EncodePositions([]int{7, 3})},
+				{DocID: 2, File: "text2.txt", Frequency: 1, Positions: EncodePositions([]int{4})},
+			},
+		},
+		{Term: "mean", TotalFrequency: 1, Docs: []SerializedDoc{{DocID: 2, File: "text2.txt", Frequency: 1}}},
+	}}
+
+	block, err := NewBlockReader(sc.ToBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if block.Len() != 2 || block.Term(0) != "mean" {
+		t.Errorf("terms must be sorted, got %d terms starting with %q", block.Len(), block.Term(0))
+	}
+
+	token, ok, err := block.Find("say")
+	if err != nil || !ok {
+		t.Fatalf("say is not found, %v", err)
+	}
+	if len(token.Docs) != 2 || token.Docs[1].File != "text2.txt" {
+		t.Errorf("unexpected postings %v", token.Docs)
+	}
+	if positions := token.Docs[0].Positions.Decode(); !reflect.DeepEqual(positions, []int{3, 7}) {
+		t.Errorf("unexpected positions %v", positions)
+	}
+
+	if _, ok, err := block.Find("absent"); ok || err != nil {
+		t.Error("absent term is found")
+	}
+
+	if _, err := NewBlockReader(sc.ToBlock()[:5]); err != ErrCorruptBlock {
+		t.Errorf("expected ErrCorruptBlock, got %v", err)
+	}
+
+}
@@ -0,0 +1,56 @@
+package corpus
+
+import (
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+
+	r := NewRegistry()
+
+	first := r.Register(DocumentInfo{Path: "a.txt"})
+	second := r.Register(DocumentInfo{Path: "b.txt"})
+	if first != 0 || second != 1 {
+		t.Fatalf("expected IDs 0 and 1, got %d and %d", first, second)
+	}
+
+	// removed IDs are not given again
+	r.Remove(second)
+	if id := r.Register(DocumentInfo{Path: "c.txt"}); id != 2 {
+		t.Errorf("expected ID 2, got %d", id)
+	}
+
+	info, ok := r.Get(first)
+	if !ok || info.Path != "a.txt" || info.Added.IsZero() {
+		t.Errorf("expected registered a.txt, got %+v", info)
+	}
+
+	// described later, the time of registration stays
+	r.Put(DocumentInfo{ID: first, Path: "a.txt", Title: "Title", Length: 3})
+	if described, _ := r.Get(first); described.Title != "Title" || described.Length != 3 || described.Added != info.Added {
+		t.Errorf("expected a.txt to be described, got %+v", described)
+	}
+
+	// documents put under their own IDs move the next one
+	r.Put(DocumentInfo{ID: 10, Path: "d.txt"})
+	if r.NextID() != 11 || r.Size() != 3 {
+		t.Errorf("expected 3 documents and next ID 11, got %d and %d", r.Size(), r.NextID())
+	}
+
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewRegistry()
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NextID() != 11 || len(loaded.Documents()) != 3 || loaded.Documents()[2].Path != "d.txt" {
+		t.Errorf("expected registry to be decoded, got %v", loaded.Documents())
+	}
+
+	if title := Title([]byte("\n  Hamlet  \nPrince of Denmark")); title != "Hamlet" {
+		t.Errorf("expected first line as title, got %q", title)
+	}
+
+}
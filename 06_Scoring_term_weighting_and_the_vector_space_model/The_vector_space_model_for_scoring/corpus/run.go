@@ -0,0 +1,117 @@
+package corpus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Run is a temp block of SPIMI: term entries sorted by term that are read strictly
+// one after another, so merging many runs needs memory for one entry of every run only.
+// The file has the only section, a sequence of (uvarint entry length, block entry).
+// The section checksum is computed while reading and checked after the last entry.
+func (sc *SerializedCorpus) ToRunFile() []byte {
+
+	tokens := make([]SerializedToken, len(sc.Tokens))
+	copy(tokens, sc.Tokens)
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Term < tokens[j].Term })
+
+	entries := make([]byte, 0)
+	for _, t := range tokens {
+		entry := appendToken(nil, t)
+		entries = appendUvarint(entries, uint64(len(entry)))
+		entries = append(entries, entry...)
+	}
+
+	return EncodeFile(KindRun, Section{SectionEntries, entries})
+
+}
+
+// TokenIterator yields postings sorted by term, io.EOF after the last term
+type TokenIterator interface {
+	Next() (SerializedToken, error)
+}
+
+// RunReader decodes run entries from a stream
+type RunReader struct {
+	r         *bufio.Reader
+	crc       hash.Hash32
+	remaining uint64
+	expected  uint32
+}
+
+// Read and check the file header, entries are not touched yet
+func NewRunReader(r io.Reader) (*RunReader, error) {
+
+	br := bufio.NewReader(r)
+
+	header := make([]byte, fileHeaderSize+sectionHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrCorruptBlock
+	}
+
+	if string(header[:4]) != formatMagic {
+		return nil, ErrBadMagic
+	}
+	if binary.LittleEndian.Uint16(header[4:]) != FormatVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if FileKind(binary.LittleEndian.Uint16(header[6:])) != KindRun {
+		return nil, ErrWrongKind
+	}
+	if binary.LittleEndian.Uint32(header[8:]) != 1 || binary.LittleEndian.Uint32(header[fileHeaderSize:]) != SectionEntries {
+		return nil, ErrMissingSection
+	}
+
+	return &RunReader{
+		r:         br,
+		crc:       crc32.New(castagnoli),
+		expected:  binary.LittleEndian.Uint32(header[fileHeaderSize+4:]),
+		remaining: binary.LittleEndian.Uint64(header[fileHeaderSize+8:]),
+	}, nil
+
+}
+
+// Next entry of the run, io.EOF after the last one
+func (rr *RunReader) Next() (SerializedToken, error) {
+
+	if rr.remaining == 0 {
+		if rr.crc.Sum32() != rr.expected {
+			return SerializedToken{}, ErrChecksumMismatch
+		}
+		return SerializedToken{}, io.EOF
+	}
+
+	prefix := make([]byte, 0, binary.MaxVarintLen64)
+	for {
+		b, err := rr.r.ReadByte()
+		if err != nil || len(prefix) == binary.MaxVarintLen64 {
+			return SerializedToken{}, ErrCorruptBlock
+		}
+		prefix = append(prefix, b)
+		if b < 0x80 {
+			break
+		}
+	}
+	length, _ := binary.Uvarint(prefix)
+
+	if uint64(len(prefix)) > rr.remaining || length > rr.remaining-uint64(len(prefix)) {
+		return SerializedToken{}, ErrCorruptBlock
+	}
+
+	// every entry gets its own buffer, decoded postings keep slices of it
+	entry := make([]byte, length)
+	if _, err := io.ReadFull(rr.r, entry); err != nil {
+		return SerializedToken{}, ErrCorruptBlock
+	}
+
+	rr.crc.Write(prefix)
+	rr.crc.Write(entry)
+	rr.remaining -= uint64(len(prefix)) + length
+
+	return decodeEntry(entry, 0)
+
+}
@@ -0,0 +1,58 @@
+package corpus
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRunReader(t *testing.T) {
+
+	sc := &SerializedCorpus{Tokens: []SerializedToken{
+		{Term: "say", TotalFrequency: 2, Docs: []SerializedDoc{{DocID: 3, Frequency: 2, Positions: EncodePositions([]int{1, 5})}}},
+		{Term: "mean", TotalFrequency: 1, Docs: []SerializedDoc{{DocID: 1, Frequency: 1}}},
+		{Term: "did", TotalFrequency: 1, Docs: []SerializedDoc{{DocID: 2, Frequency: 1}}},
+	}}
+	data := sc.ToRunFile()
+
+	rr, err := NewRunReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	terms := make([]string, 0)
+	for {
+		token, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		terms = append(terms, token.Term)
+		if token.Term == "say" && token.Docs[0].Positions.Len() != 2 {
+			t.Errorf("unexpected positions %v", token.Docs[0].Positions.Decode())
+		}
+	}
+	if len(terms) != 3 || terms[0] != "did" || terms[2] != "say" {
+		t.Errorf("terms must be sorted, got %v", terms)
+	}
+
+	// corruption is found after the last entry at the latest
+	data[len(data)-1] ^= 1
+	rr, err = NewRunReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = rr.Next()
+	}
+	if err == io.EOF {
+		t.Error("corrupted run is read without errors")
+	}
+
+	if _, err := NewRunReader(bytes.NewReader(sc.ToBlockFile())); err != ErrWrongKind {
+		t.Errorf("expected wrong kind, got %v", err)
+	}
+
+}
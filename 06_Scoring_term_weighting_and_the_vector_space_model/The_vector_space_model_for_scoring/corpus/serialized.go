@@ -10,12 +10,14 @@ import (
 type SerializedToken struct {
 	Term string
 	Docs []SerializedDoc
+	// DocIDs are set only for tokens read from binary blocks
+	DocIDs PForList
 	TotalFrequency int
 	InverseDocumentFrequency float32
 }
 
 type SerializedDoc struct {
-	Positions []int
+	Positions PositionList
 	DocID int
 	File string
 	Frequency int
@@ -62,6 +64,18 @@ func (this *SerializedCorpus) Filter(filter func(token SerializedToken) bool) *S
 type SerializedBlockTree struct {
 	Blocks []SerializedBlock
 	Documents []SerializedBlockDoc
+	Checksums []SerializedBlockChecksum
+	Files []SerializedBlockFile
+}
+
+type SerializedBlockChecksum struct {
+	Block string
+	CRC   uint32
+}
+
+type SerializedBlockFile struct {
+	DocID int
+	File  string
 }
 
 type SerializedBlock struct {
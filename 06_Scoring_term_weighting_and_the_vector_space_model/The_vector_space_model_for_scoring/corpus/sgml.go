@@ -0,0 +1,157 @@
+package corpus
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var ErrNoDocNo = errors.New("corpus: document has no DOCNO")
+
+// Stored fields of SGML collections, judgements of the collection refer to documents by docno
+const (
+	DocNoField  = "docno"
+	TopicsField = "topics"
+)
+
+var (
+	trecDocument = regexp.MustCompile(`(?is)<DOC>(.*?)</DOC>`)
+	trecDocNo    = regexp.MustCompile(`(?is)<DOCNO>(.*?)</DOCNO>`)
+	trecText     = regexp.MustCompile(`(?is)<TEXT\b[^>]*>(.*?)</TEXT>`)
+	// collections name the headline differently
+	trecTitles = []*regexp.Regexp{
+		regexp.MustCompile(`(?is)<TITLE>(.*?)</TITLE>`),
+		regexp.MustCompile(`(?is)<HEADLINE>(.*?)</HEADLINE>`),
+		regexp.MustCompile(`(?is)<HEAD>(.*?)</HEAD>`),
+	}
+)
+
+// TRECParser splits a file of TREC collections into its <DOC> elements. DOCNO is kept
+// as a stored field, the title is <TITLE>, <HEADLINE> or <HEAD> and is empty without them,
+// the text is the title and every <TEXT> of the document. A document without <TEXT>
+// is indexed as a whole, its title leads the text the same way.
+type TRECParser struct{}
+
+func (TRECParser) Parse(content []byte) ([]ParsedDocument, error) {
+
+	docs := make([]ParsedDocument, 0)
+
+	for i, m := range trecDocument.FindAllSubmatch(content, -1) {
+		element := string(m[1])
+
+		docNo := trecDocNo.FindStringSubmatch(element)
+		if docNo == nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, ErrNoDocNo)
+		}
+
+		doc := ParsedDocument{Fields: map[string]string{DocNoField: strings.TrimSpace(docNo[1])}}
+		rest := trecDocNo.ReplaceAllString(element, "")
+		for _, title := range trecTitles {
+			if t := title.FindStringSubmatch(element); t != nil {
+				doc.Title = htmlText(t[1])
+				rest = title.ReplaceAllString(rest, "")
+				break
+			}
+		}
+
+		texts := make([]string, 0)
+		for _, t := range trecText.FindAllStringSubmatch(element, -1) {
+			texts = append(texts, sgmlText(t[1]))
+		}
+		if len(texts) == 0 {
+			texts = append(texts, sgmlText(rest))
+		}
+		doc.Text = titledText(doc.Title, strings.Join(texts, "\n"))
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+
+}
+
+var (
+	reutersDocument  = regexp.MustCompile(`(?is)<REUTERS\b([^>]*)>(.*?)</REUTERS>`)
+	reutersAttribute = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	reutersTitle     = regexp.MustCompile(`(?is)<TITLE>(.*?)</TITLE>`)
+	reutersBody      = regexp.MustCompile(`(?is)<BODY>(.*?)</BODY>`)
+	reutersText      = regexp.MustCompile(`(?is)<TEXT\b[^>]*>(.*?)</TEXT>`)
+	reutersTopics    = regexp.MustCompile(`(?is)<TOPICS>(.*?)</TOPICS>`)
+	reutersTopic     = regexp.MustCompile(`(?is)<D>(.*?)</D>`)
+)
+
+// ReutersParser splits a .sgm file of Reuters-21578 into its <REUTERS> elements.
+// NEWID is kept as the docno and the topics as a stored field separated by spaces,
+// the title is <TITLE> and the text is the title and the <BODY>. Brief and unprocessed
+// stories have no body, their text is the title and the rest of the <TEXT>.
+type ReutersParser struct{}
+
+func (ReutersParser) Parse(content []byte) ([]ParsedDocument, error) {
+
+	docs := make([]ParsedDocument, 0)
+
+	for i, m := range reutersDocument.FindAllSubmatch(content, -1) {
+		attributes := make(map[string]string)
+		for _, a := range reutersAttribute.FindAllStringSubmatch(string(m[1]), -1) {
+			attributes[strings.ToUpper(a[1])] = a[2]
+		}
+		if attributes["NEWID"] == "" {
+			return nil, fmt.Errorf("document %d: %w", i+1, ErrNoDocNo)
+		}
+		element := string(m[2])
+
+		doc := ParsedDocument{Fields: map[string]string{DocNoField: attributes["NEWID"]}}
+		if topics := reutersTopics.FindStringSubmatch(element); topics != nil {
+			names := make([]string, 0)
+			for _, topic := range reutersTopic.FindAllStringSubmatch(topics[1], -1) {
+				names = append(names, strings.TrimSpace(topic[1]))
+			}
+			if len(names) > 0 {
+				doc.Fields[TopicsField] = strings.Join(names, " ")
+			}
+		}
+
+		if title := reutersTitle.FindStringSubmatch(element); title != nil {
+			doc.Title = htmlText(title[1])
+		}
+		if body := reutersBody.FindStringSubmatch(element); body != nil {
+			doc.Text = sgmlText(body[1])
+		} else if text := reutersText.FindStringSubmatch(element); text != nil {
+			doc.Text = sgmlText(reutersTitle.ReplaceAllString(text[1], ""))
+		}
+		doc.Text = titledText(doc.Title, doc.Text)
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+
+}
+
+// Title is the first line of the text, so its terms are searchable and counted once
+func titledText(title, text string) string {
+	return strings.TrimSpace(title + "\n" + text)
+}
+
+// Text of the SGML fragment, tags are stripped and lines are kept.
+// Entities are resolved and control characters like the &#3; ending Reuters stories are dropped.
+func sgmlText(fragment string) string {
+
+	text := html.UnescapeString(htmlTag.ReplaceAllString(fragment, " "))
+	text = strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' {
+			return ' '
+		}
+		return r
+	}, text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n"))
+
+}
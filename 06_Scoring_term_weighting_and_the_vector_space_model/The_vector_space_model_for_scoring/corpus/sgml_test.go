@@ -0,0 +1,87 @@
+package corpus
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const trecFile = `<DOC>
+<DOCNO> FT911-1 </DOCNO>
+<HEADLINE>Zebra &amp; giraffe</HEADLINE>
+<TEXT>
+What did the zebra say?
+</TEXT>
+<TEXT>Second <F P=1>part</F></TEXT>
+</DOC>
+<DOC>
+<DOCNO>WSJ870101-0001</DOCNO>
+<DATE>870101</DATE>
+A document without text
+</DOC>
+<DOC>
+<DOCNO>AP880212-0001</DOCNO>
+<HEAD>Lion news</HEAD>
+The lion said nothing
+</DOC>
+`
+
+const reutersFile = `<!DOCTYPE lewis SYSTEM "lewis.dtd">
+<REUTERS TOPICS="YES" LEWISSPLIT="TRAIN" CGISPLIT="TRAINING-SET" OLDID="5544" NEWID="1">
+<DATE>26-FEB-1987 15:01:01.79</DATE>
+<TOPICS><D>cocoa</D><D>grain</D></TOPICS>
+<PLACES><D>el-salvador</D></PLACES>
+<TEXT>&#2;
+<TITLE>BAHIA COCOA REVIEW</TITLE>
+<DATELINE>    SALVADOR, Feb 26 - </DATELINE><BODY>Showers continued
+throughout the week &lt;in&gt; the cocoa zone.
+ Reuter
+&#3;</BODY></TEXT>
+</REUTERS>
+<REUTERS TOPICS="NO" LEWISSPLIT="TRAIN" CGISPLIT="TRAINING-SET" OLDID="5545" NEWID="2">
+<TOPICS></TOPICS>
+<TEXT TYPE="BRIEF">&#2;
+******<TITLE>BRIEF STORY</TITLE>
+&#3;</TEXT>
+</REUTERS>
+`
+
+func TestSGMLParsers(t *testing.T) {
+
+	cases := []struct {
+		path     string
+		content  string
+		expected []ParsedDocument
+	}{
+		{"ft911.trec", trecFile, []ParsedDocument{
+			{Title: "Zebra & giraffe", Text: "Zebra & giraffe\nWhat did the zebra say?\nSecond part", Fields: map[string]string{"docno": "FT911-1"}},
+			// no title element leaves the title empty, the first line is not taken
+			{Text: "870101\nA document without text", Fields: map[string]string{"docno": "WSJ870101-0001"}},
+			// the title leads the text once without <TEXT> too
+			{Title: "Lion news", Text: "Lion news\nThe lion said nothing", Fields: map[string]string{"docno": "AP880212-0001"}},
+		}},
+		{"reut2-000.sgm", reutersFile, []ParsedDocument{
+			{Title: "BAHIA COCOA REVIEW", Text: "BAHIA COCOA REVIEW\nShowers continued\nthroughout the week <in> the cocoa zone.\nReuter", Fields: map[string]string{"docno": "1", "topics": "cocoa grain"}},
+			{Title: "BRIEF STORY", Text: "BRIEF STORY\n******", Fields: map[string]string{"docno": "2"}},
+		}},
+	}
+
+	for _, c := range cases {
+		docs, err := ParseFile(c.path, []byte(c.content), ParserConfig{})
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(docs, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.path, c.expected, docs)
+		}
+	}
+
+	if _, err := ParseFile("fr940104.0", []byte("<DOC><TEXT>no docno</TEXT></DOC>"), ParserConfig{Format: "trec"}); !errors.Is(err, ErrNoDocNo) {
+		t.Errorf("expected a document without DOCNO to fail the file, got %v", err)
+	}
+	if _, err := ParseFile("reut2-001.sgm", []byte(`<!DOCTYPE lewis SYSTEM "lewis.dtd">`), ParserConfig{}); !errors.Is(err, ErrNoDocuments) {
+		t.Errorf("expected no documents, got %v", err)
+	}
+
+}
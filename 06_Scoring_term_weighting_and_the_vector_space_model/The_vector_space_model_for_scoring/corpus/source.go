@@ -0,0 +1,406 @@
+package corpus
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownFormat = errors.New("corpus: unknown document format")
+	ErrNoDocuments   = errors.New("corpus: file has no documents")
+)
+
+// ParsedDocument is one document of a file: the text that is indexed and stored,
+// its title and fields that are stored but not indexed
+type ParsedDocument struct {
+	Title  string
+	Text   string
+	Fields map[string]string
+}
+
+// Parser splits content of a file into documents, a file of plain text is one document
+type Parser interface {
+	Parse(content []byte) ([]ParsedDocument, error)
+}
+
+// ParserConfig picks the parser of a file. Format names the parser of every file,
+// when it is empty the extension of the file picks it and files of unknown extensions are plain text.
+type ParserConfig struct {
+	Format string
+	// Field of JSON Lines and column of CSV with the text, "text" when it is empty
+	TextField string
+	// Field or column with the title, "title" when it is empty
+	TitleField string
+}
+
+// Parsers of every format
+var Formats = map[string]func(ParserConfig) Parser{
+	"text":     func(ParserConfig) Parser { return TextParser{} },
+	"html":     func(ParserConfig) Parser { return HTMLParser{} },
+	"markdown": func(ParserConfig) Parser { return MarkdownParser{} },
+	"jsonl":    func(c ParserConfig) Parser { return JSONLinesParser{c.textField(), c.titleField()} },
+	"csv":      func(c ParserConfig) Parser { return CSVParser{c.textField(), c.titleField()} },
+	"trec":     func(ParserConfig) Parser { return TRECParser{} },
+	"reuters":  func(ParserConfig) Parser { return ReutersParser{} },
+}
+
+// Formats of file extensions
+var Extensions = map[string]string{
+	".txt":      "text",
+	".html":     "html",
+	".htm":      "html",
+	".md":       "markdown",
+	".markdown": "markdown",
+	".jsonl":    "jsonl",
+	".ndjson":   "jsonl",
+	".csv":      "csv",
+	".trec":     "trec",
+	".sgml":     "trec",
+	".sgm":      "reuters",
+}
+
+func (c ParserConfig) textField() string {
+	if c.TextField == "" {
+		return "text"
+	}
+	return c.TextField
+}
+
+func (c ParserConfig) titleField() string {
+	if c.TitleField == "" {
+		return "title"
+	}
+	return c.TitleField
+}
+
+// Parser of the file at path
+func (c ParserConfig) Parser(path string) (Parser, error) {
+
+	format := c.Format
+	if format == "" {
+		format = Extensions[strings.ToLower(filepath.Ext(path))]
+	}
+	if format == "" {
+		format = "text"
+	}
+
+	parser, ok := Formats[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+
+	return parser(c), nil
+
+}
+
+// Documents of the file content, errors are reported with the path
+func ParseFile(path string, content []byte, config ParserConfig) ([]ParsedDocument, error) {
+
+	parser, err := config.Parser(path)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := parser.Parse(content)
+	if err != nil {
+		return nil, NewFileError(path, err)
+	}
+	if len(docs) == 0 {
+		return nil, NewFileError(path, ErrNoDocuments)
+	}
+
+	return docs, nil
+
+}
+
+// First line of the text when the format has no title
+func titled(doc ParsedDocument) ParsedDocument {
+	if doc.Title == "" {
+		doc.Title = Title([]byte(doc.Text))
+	}
+	return doc
+}
+
+// TextParser gives the whole file as one document, its first line is the title
+type TextParser struct{}
+
+func (TextParser) Parse(content []byte) ([]ParsedDocument, error) {
+	return []ParsedDocument{titled(ParsedDocument{Text: string(content)})}, nil
+}
+
+var (
+	htmlHidden  = regexp.MustCompile(`(?is)<!--.*?-->|<(script|style|head|title)\b.*?</(script|style|head|title)\s*>`)
+	htmlTitle   = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	htmlHeading = regexp.MustCompile(`(?is)<h1\b[^>]*>(.*?)</h1\s*>`)
+	htmlBlock   = regexp.MustCompile(`(?i)</?(p|div|br|li|tr|h[1-6]|section|article|blockquote|pre|table|ul|ol)\b[^>]*>`)
+	htmlTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLines  = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// HTMLParser strips tags, scripts and styles, the title is the <title> or the first <h1>.
+// Block elements break lines.
+type HTMLParser struct{}
+
+func (HTMLParser) Parse(content []byte) ([]ParsedDocument, error) {
+
+	doc := ParsedDocument{}
+	if m := htmlTitle.FindSubmatch(content); m != nil {
+		doc.Title = htmlText(string(m[1]))
+	} else if m := htmlHeading.FindSubmatch(content); m != nil {
+		doc.Title = htmlText(string(m[1]))
+	}
+
+	text := htmlHidden.ReplaceAllString(string(content), "")
+	text = htmlBlock.ReplaceAllString(text, "\n")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = htmlText(line)
+	}
+	doc.Text = strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n"))
+
+	return []ParsedDocument{titled(doc)}, nil
+
+}
+
+// Text of the HTML fragment on one line
+func htmlText(fragment string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(htmlTag.ReplaceAllString(fragment, " "))), " ")
+}
+
+var (
+	markdownImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownHeading  = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	markdownMarker   = regexp.MustCompile(`^\s*(>\s*)*([-*+]\s+|\d+[.)]\s+)?`)
+	markdownEmphasis = regexp.MustCompile("[*_`~]+")
+	markdownRule     = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+)
+
+// MarkdownParser strips markup and keeps the text of links and images,
+// the title is the first heading
+type MarkdownParser struct{}
+
+func (MarkdownParser) Parse(content []byte) ([]ParsedDocument, error) {
+
+	doc := ParsedDocument{}
+	lines := make([]string, 0)
+	fenced := false
+
+	for _, line := range strings.Split(string(content), "\n") {
+		// code of fenced blocks is kept as it is
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			lines = append(lines, line)
+			continue
+		}
+		if markdownRule.MatchString(line) {
+			continue
+		}
+
+		heading := markdownHeading.MatchString(line)
+		line = markdownHeading.ReplaceAllString(line, "")
+		line = markdownMarker.ReplaceAllString(line, "")
+		line = markdownImage.ReplaceAllString(line, "$1")
+		line = markdownLink.ReplaceAllString(line, "$1")
+		line = strings.TrimSpace(markdownEmphasis.ReplaceAllString(line, ""))
+
+		if heading && doc.Title == "" {
+			doc.Title = line
+		}
+		lines = append(lines, line)
+	}
+	doc.Text = strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n"))
+
+	return []ParsedDocument{titled(doc)}, nil
+
+}
+
+// JSONLinesParser gives every line of JSON objects as a document. Other fields
+// of the object are kept as stored fields.
+type JSONLinesParser struct {
+	TextField  string
+	TitleField string
+}
+
+func (p JSONLinesParser) Parse(content []byte) ([]ParsedDocument, error) {
+
+	docs := make([]ParsedDocument, 0)
+
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		object := make(map[string]interface{})
+		if err := json.Unmarshal(line, &object); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		record := make(map[string]string, len(object))
+		for key, value := range object {
+			if s, ok := value.(string); ok {
+				record[key] = s
+			} else {
+				encoded, _ := json.Marshal(value)
+				record[key] = string(encoded)
+			}
+		}
+		doc, err := recordDocument(record, p.TextField, p.TitleField)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+
+}
+
+// CSVParser gives every row as a document, the first row names the columns.
+// Other columns are kept as stored fields.
+type CSVParser struct {
+	TextField  string
+	TitleField string
+}
+
+func (p CSVParser) Parse(content []byte) ([]ParsedDocument, error) {
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]ParsedDocument, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := make(map[string]string, len(header))
+		for i, column := range header {
+			record[column] = row[i]
+		}
+		doc, err := recordDocument(record, p.TextField, p.TitleField)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+
+}
+
+// Document of the record of fields, the text field is required
+func recordDocument(record map[string]string, textField, titleField string) (ParsedDocument, error) {
+
+	text, ok := record[textField]
+	if !ok {
+		return ParsedDocument{}, fmt.Errorf("no %q field", textField)
+	}
+
+	doc := ParsedDocument{Text: text, Title: record[titleField]}
+	for key, value := range record {
+		if key == textField || key == titleField {
+			continue
+		}
+		if doc.Fields == nil {
+			doc.Fields = make(map[string]string)
+		}
+		doc.Fields[key] = value
+	}
+
+	return titled(doc), nil
+
+}
+
+// SourceDocument is a document of a source. Documents of one file have the same path.
+type SourceDocument struct {
+	Path     string
+	Modified time.Time
+	ParsedDocument
+}
+
+// DocumentSource gives documents of a collection one by one, io.EOF when they are over.
+// A file that can not be read or parsed is reported and the source goes on with the next one.
+type DocumentSource interface {
+	Next() (SourceDocument, error)
+}
+
+// DirectorySource gives documents of every file of the dir in the order of names,
+// every file is parsed by the parser its config picks
+type DirectorySource struct {
+	dir    string
+	files  []os.FileInfo
+	config ParserConfig
+	// documents of the last file that are not given yet
+	pending []SourceDocument
+	// files of the dir that go to the source, every file when it is nil
+	Include func(path string) bool
+}
+
+func NewDirectorySource(dir string, config ParserConfig) (*DirectorySource, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, NewFileError(dir, err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	return &DirectorySource{dir: dir, files: files, config: config}, nil
+
+}
+
+func (s *DirectorySource) Next() (SourceDocument, error) {
+
+	for len(s.pending) == 0 {
+		if len(s.files) == 0 {
+			return SourceDocument{}, io.EOF
+		}
+		f := s.files[0]
+		s.files = s.files[1:]
+
+		path := s.dir + "/" + f.Name()
+		if f.IsDir() || (s.Include != nil && !s.Include(path)) {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return SourceDocument{}, NewFileError(path, err)
+		}
+		docs, err := ParseFile(path, content, s.config)
+		if err != nil {
+			return SourceDocument{}, err
+		}
+		for _, doc := range docs {
+			s.pending = append(s.pending, SourceDocument{path, f.ModTime(), doc})
+		}
+	}
+
+	doc := s.pending[0]
+	s.pending = s.pending[1:]
+
+	return doc, nil
+
+}
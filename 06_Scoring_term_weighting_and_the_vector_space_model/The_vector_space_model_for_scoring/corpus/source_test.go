@@ -0,0 +1,118 @@
+package corpus
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsers(t *testing.T) {
+
+	cases := []struct {
+		path     string
+		content  string
+		config   ParserConfig
+		expected []ParsedDocument
+	}{
+		{"a.txt", "\nfirst line\nsecond line", ParserConfig{}, []ParsedDocument{
+			{Title: "first line", Text: "\nfirst line\nsecond line"},
+		}},
+		{"a.html", `<html><head><title>The &amp; Title</title><style>p {}</style></head>
+<body><h1>Heading</h1><p>Some <b>bold</b> text</p><script>var x = "<p>";</script><!-- note --><p>more</p></body></html>`, ParserConfig{}, []ParsedDocument{
+			{Title: "The & Title", Text: "Heading\nSome bold text\nmore"},
+		}},
+		{"a.htm", "<p>no title</p><h1>But a heading</h1>", ParserConfig{}, []ParsedDocument{
+			{Title: "But a heading", Text: "no title\nBut a heading"},
+		}},
+		{"a.md", "Intro *line*\n\n## The `title`\n\n- item [link](http://x) ![alt](y.png)\n> quote\n---\n```\ncode *kept*\n```", ParserConfig{}, []ParsedDocument{
+			{Title: "The title", Text: "Intro line\nThe title\nitem link alt\nquote\ncode *kept*"},
+		}},
+		{"a.jsonl", "{\"id\": 7, \"title\": \"one\", \"text\": \"first doc\"}\n\n{\"body\": \"second doc\", \"text\": \"x\"}\n", ParserConfig{}, []ParsedDocument{
+			{Title: "one", Text: "first doc", Fields: map[string]string{"id": "7"}},
+			{Title: "x", Text: "x", Fields: map[string]string{"body": "second doc"}},
+		}},
+		{"a.json", "{\"body\": \"configured field\", \"name\": \"doc\"}", ParserConfig{Format: "jsonl", TextField: "body", TitleField: "name"}, []ParsedDocument{
+			{Title: "doc", Text: "configured field"},
+		}},
+		{"a.csv", "id,title,text\n1,one,\"first, row\"\n2,,second row\n", ParserConfig{}, []ParsedDocument{
+			{Title: "one", Text: "first, row", Fields: map[string]string{"id": "1"}},
+			{Title: "second row", Text: "second row", Fields: map[string]string{"id": "2"}},
+		}},
+		// configuration wins over the extension
+		{"a.html", "<b>tags</b>", ParserConfig{Format: "text"}, []ParsedDocument{
+			{Title: "<b>tags</b>", Text: "<b>tags</b>"},
+		}},
+	}
+
+	for _, c := range cases {
+		docs, err := ParseFile(c.path, []byte(c.content), c.config)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(docs, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.path, c.expected, docs)
+		}
+	}
+
+	if _, err := ParseFile("a.jsonl", []byte("{\"text\": \"x\"}\n{broken"), ParserConfig{}); !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("expected broken line to fail the file, got %v", err)
+	}
+	if _, err := ParseFile("a.csv", []byte("id,body\n1,x\n"), ParserConfig{}); err == nil {
+		t.Error("expected rows without text to fail the file")
+	}
+	if _, err := ParseFile("a.csv", []byte("id,text\n"), ParserConfig{}); !errors.Is(err, ErrNoDocuments) {
+		t.Errorf("expected no documents, got %v", err)
+	}
+	if _, err := ParseFile("a.txt", nil, ParserConfig{Format: "pdf"}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("expected unknown format, got %v", err)
+	}
+
+}
+
+func TestDirectorySource(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.jsonl"), []byte("{\"text\": \"one\"}\n{\"text\": \"two\"}\n"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "b.jsonl"), []byte("{broken"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "c.txt"), []byte("three"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "d.txt"), []byte("skipped"), 0666)
+	os.Mkdir(filepath.Join(dir, "e"), 0777)
+
+	source, err := NewDirectorySource(dir, ParserConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Include = func(path string) bool { return filepath.Base(path) != "d.txt" }
+
+	texts := make([]string, 0)
+	failed := 0
+	for {
+		doc, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			failed++
+			continue
+		}
+		if doc.Modified.IsZero() {
+			t.Errorf("expected modification time of %s", doc.Path)
+		}
+		texts = append(texts, filepath.Base(doc.Path)+":"+doc.Text)
+	}
+
+	if expected := []string{"a.jsonl:one", "a.jsonl:two", "c.txt:three"}; !reflect.DeepEqual(texts, expected) || failed != 1 {
+		t.Errorf("expected %v and one failed file, got %v and %d", expected, texts, failed)
+	}
+
+}
@@ -0,0 +1,355 @@
+package corpus
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StoredDocument is what the index gives back for a doc ID: the original text,
+// the path and fields that parsers keep but do not index
+type StoredDocument struct {
+	ID     int
+	Path   string
+	Text   string
+	Fields map[string]string
+}
+
+// DocumentStore keeps every document compressed on its own, so one document
+// is read without decompressing the others. Documents are only added.
+type DocumentStore struct {
+	entries map[int]storeEntry
+	data    []byte
+	mutex   *sync.Mutex
+}
+
+// Compressed document in the data of the store
+type storeEntry struct {
+	ID     int
+	Offset int
+	Length int
+}
+
+// Store file sits next to the index file
+func StorePath(indexFile string) string {
+	return strings.TrimSuffix(indexFile, filepath.Ext(indexFile)) + ".store"
+}
+
+func NewDocumentStore() *DocumentStore {
+	return &DocumentStore{make(map[int]storeEntry), make([]byte, 0), &sync.Mutex{}}
+}
+
+// DocumentWriter takes documents of a build, it is either a store or a StoreWriter
+type DocumentWriter interface {
+	Put(doc StoredDocument) error
+}
+
+// Compress and add the document, ErrDuplicateDocument when the ID is already stored
+func (s *DocumentStore) Put(doc StoredDocument) error {
+
+	compressed, err := compressDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	return s.add(doc.ID, compressed)
+
+}
+
+func compressDocument(doc StoredDocument) ([]byte, error) {
+
+	data, err := encodeGob(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	b := bytes.Buffer{}
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+
+}
+
+// Add the document of the other store as it is compressed
+func (s *DocumentStore) CopyFrom(other *DocumentStore, id int) error {
+
+	other.mutex.Lock()
+	e, ok := other.entries[id]
+	compressed := other.data[e.Offset : e.Offset+e.Length]
+	other.mutex.Unlock()
+
+	if !ok {
+		return ErrDocumentNotFound
+	}
+
+	return s.add(id, compressed)
+
+}
+
+// Documents are never replaced, a replaced one would stay in the data as dead bytes
+func (s *DocumentStore) add(id int, compressed []byte) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.entries[id]; ok {
+		return ErrDuplicateDocument
+	}
+	s.entries[id] = storeEntry{id, len(s.data), len(compressed)}
+	s.data = append(s.data, compressed...)
+
+	return nil
+
+}
+
+// Decompress the document, ErrDocumentNotFound when it is not stored
+func (s *DocumentStore) Get(id int) (StoredDocument, error) {
+
+	s.mutex.Lock()
+	e, ok := s.entries[id]
+	compressed := s.data[e.Offset : e.Offset+e.Length]
+	s.mutex.Unlock()
+
+	if !ok {
+		return StoredDocument{}, ErrDocumentNotFound
+	}
+
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return StoredDocument{}, ErrCorruptBlock
+	}
+
+	doc := StoredDocument{}
+	if err := decodeGob(data, &doc); err != nil {
+		return StoredDocument{}, ErrCorruptBlock
+	}
+
+	return doc, nil
+
+}
+
+func (s *DocumentStore) Contains(id int) bool {
+
+	s.mutex.Lock()
+	_, ok := s.entries[id]
+	s.mutex.Unlock()
+
+	return ok
+
+}
+
+// IDs of the stored documents in ascending order
+func (s *DocumentStore) IDs() []int {
+
+	s.mutex.Lock()
+	ids := make([]int, 0, len(s.entries))
+	for id := range s.entries {
+		ids = append(ids, id)
+	}
+	s.mutex.Unlock()
+
+	sort.Ints(ids)
+
+	return ids
+
+}
+
+func (s *DocumentStore) Size() int {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.entries)
+
+}
+
+// Encode the store into file of the current format version: entries sorted
+// by ID and the compressed documents one after another
+func (s *DocumentStore) MarshalFile() ([]byte, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make([]storeEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	data, err := encodeGob(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeFile(KindStore, Section{SectionEntries, data}, Section{SectionStoredDocuments, s.data}), nil
+
+}
+
+// Decode store file, stores appeared in version 2, so there is nothing to upgrade
+func ReadDocumentStore(data []byte) (*DocumentStore, error) {
+
+	f, err := DecodeFile(data, KindStore)
+	if err != nil {
+		return nil, err
+	}
+
+	section, err := f.Section(SectionEntries)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]storeEntry, 0)
+	if err := decodeGob(section, &entries); err != nil {
+		return nil, err
+	}
+
+	documents, err := f.Section(SectionStoredDocuments)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewDocumentStore()
+	s.data = documents
+	for _, e := range entries {
+		if e.Offset < 0 || e.Length < 0 || e.Offset+e.Length > len(documents) {
+			return nil, ErrCorruptBlock
+		}
+		s.entries[e.ID] = e
+	}
+
+	return s, nil
+
+}
+
+// StoreWriter writes the store file of a build without keeping documents in memory:
+// compressed documents go to a temp file as they come, only their entries are kept
+type StoreWriter struct {
+	temp    *os.File
+	w       *bufio.Writer
+	crc     hash.Hash32
+	entries []storeEntry
+	ids     map[int]bool
+	size    int
+	mutex   *sync.Mutex
+}
+
+// Writer of documents to the temp file, it is removed by Close
+func NewStoreWriter(tempFile string) (*StoreWriter, error) {
+
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return nil, NewFileError(tempFile, err)
+	}
+
+	return &StoreWriter{
+		temp:    file,
+		w:       bufio.NewWriter(file),
+		crc:     crc32.New(castagnoli),
+		entries: make([]storeEntry, 0),
+		ids:     make(map[int]bool),
+		mutex:   &sync.Mutex{},
+	}, nil
+
+}
+
+// Compress the document and append it to the temp file, ErrDuplicateDocument when the ID repeats
+func (s *StoreWriter) Put(doc StoredDocument) error {
+
+	compressed, err := compressDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ids[doc.ID] {
+		return ErrDuplicateDocument
+	}
+	s.ids[doc.ID] = true
+	if _, err := s.w.Write(compressed); err != nil {
+		return NewFileError(s.temp.Name(), err)
+	}
+	s.crc.Write(compressed)
+	s.entries = append(s.entries, storeEntry{doc.ID, s.size, len(compressed)})
+	s.size += len(compressed)
+
+	return nil
+
+}
+
+// Write the store file of the current format version, the same file MarshalFile gives
+// for these documents. Documents are copied from the temp file, not read into memory.
+func (s *StoreWriter) WriteFile(path string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.w.Flush(); err != nil {
+		return NewFileError(s.temp.Name(), err)
+	}
+	if _, err := s.temp.Seek(0, io.SeekStart); err != nil {
+		return NewFileError(s.temp.Name(), err)
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].ID < s.entries[j].ID })
+	entries, err := encodeGob(s.entries)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return NewFileError(path, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fw, err := NewFileWriter(w, KindStore, 2)
+	if err != nil {
+		return NewFileError(path, err)
+	}
+	if err := fw.WriteSection(Section{SectionEntries, entries}); err != nil {
+		return NewFileError(path, err)
+	}
+	if err := fw.StreamSection(SectionStoredDocuments, s.crc.Sum32(), int64(s.size), s.temp); err != nil {
+		return NewFileError(path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return NewFileError(path, err)
+	}
+
+	return file.Close()
+
+}
+
+// Close and remove the temp file
+func (s *StoreWriter) Close() error {
+
+	err := s.temp.Close()
+	if removeErr := os.Remove(s.temp.Name()); err == nil {
+		err = removeErr
+	}
+
+	return err
+
+}
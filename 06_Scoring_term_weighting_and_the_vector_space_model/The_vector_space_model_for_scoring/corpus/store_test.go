@@ -0,0 +1,133 @@
+package corpus
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDocumentStore(t *testing.T) {
+
+	docs := []StoredDocument{
+		{ID: 3, Path: "data/text1.txt", Text: strings.Repeat("what did you mean? ", 50)},
+		{ID: 7, Path: "data/text2.txt", Text: "did brother often mean", Fields: map[string]string{"title": "brother"}},
+	}
+
+	s := NewDocumentStore()
+	for _, d := range docs {
+		if err := s.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.data) >= len(docs[0].Text) {
+		t.Errorf("expected repeated text to be compressed, got %d bytes", len(s.data))
+	}
+
+	data, err := s.MarshalFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadDocumentStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := read.IDs(); !reflect.DeepEqual(ids, []int{3, 7}) {
+		t.Errorf("expected IDs 3 and 7, got %v", ids)
+	}
+	for _, d := range docs {
+		if actual, err := read.Get(d.ID); err != nil || !reflect.DeepEqual(actual, d) {
+			t.Errorf("expected %v, got %v, %v", d, actual, err)
+		}
+	}
+	if _, err := read.Get(5); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected missing document, got %v", err)
+	}
+
+	// merged stores take documents as they are compressed
+	merged := NewDocumentStore()
+	if err := merged.CopyFrom(read, 7); err != nil {
+		t.Fatal(err)
+	}
+	// a stored document is never replaced, its bytes would be left in the data
+	size := len(merged.data)
+	if err := merged.CopyFrom(read, 7); err != ErrDuplicateDocument || len(merged.data) != size {
+		t.Errorf("expected duplicate document and %d bytes, got %v, %d bytes", size, err, len(merged.data))
+	}
+	if err := merged.Put(docs[1]); err != ErrDuplicateDocument || len(merged.data) != size {
+		t.Errorf("expected duplicate document and %d bytes, got %v, %d bytes", size, err, len(merged.data))
+	}
+	if actual, err := merged.Get(7); err != nil || !reflect.DeepEqual(actual, docs[1]) || merged.Contains(3) {
+		t.Errorf("expected only %v, got %v, %v", docs[1], actual, err)
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := ReadDocumentStore(data); err != ErrChecksumMismatch {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+
+}
+
+func TestStoreWriter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	docs := []StoredDocument{
+		{ID: 7, Path: "data/text2.txt", Text: "did brother often mean", Fields: map[string]string{"title": "brother"}},
+		{ID: 3, Path: "data/text1.txt", Text: strings.Repeat("what did you mean? ", 50)},
+	}
+
+	w, err := NewStoreWriter(filepath.Join(dir, "documents.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewDocumentStore()
+	for _, d := range docs {
+		if err := w.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		s.Put(d)
+	}
+	if err := w.Put(docs[0]); err != ErrDuplicateDocument {
+		t.Errorf("expected duplicate document, got %v", err)
+	}
+
+	path := filepath.Join(dir, "index.store")
+	if err := w.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "documents.tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected temp file removed, got %v", err)
+	}
+
+	// streamed file is the one of the store in memory
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := s.MarshalFile()
+	if !bytes.Equal(data, expected) {
+		t.Error("streamed store differs from the marshalled one")
+	}
+	read, err := ReadDocumentStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		if actual, err := read.Get(d.ID); err != nil || !reflect.DeepEqual(actual, d) {
+			t.Errorf("expected %v, got %v, %v", d, actual, err)
+		}
+	}
+
+}
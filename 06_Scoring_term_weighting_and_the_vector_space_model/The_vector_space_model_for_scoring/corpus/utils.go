@@ -13,7 +13,60 @@ import (
 // Go binary encoder
 func (corpus *Corpus) ToGOB64() string {
 
-	// convert to serialized corpus
+	b := bytes.Buffer{}
+	e := gob.NewEncoder(&b)
+	err := e.Encode(corpus.serialize())
+	if err != nil { fmt.Println(`failed gob Encode`, err) }
+
+	return base64.StdEncoding.EncodeToString(b.Bytes())
+
+}
+
+// Encode corpus into temp file of the current format version
+func (corpus *Corpus) MarshalFile() ([]byte, error) {
+
+	data, err := encodeGob(corpus.serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeFile(KindCorpus, Section{SectionCorpus, data}), nil
+
+}
+
+// Encode corpus into a run of SPIMI
+func (corpus *Corpus) ToRunFile() []byte {
+	return corpus.serialize().ToRunFile()
+}
+
+// Decode temp file, temp files are never kept between builds, so only the current version is read
+func CorpusFromFile(data []byte) (*Corpus, error) {
+
+	f, err := DecodeFile(data, KindCorpus)
+	if err != nil {
+		return nil, err
+	}
+
+	section, err := f.Section(SectionCorpus)
+	if err != nil {
+		return nil, err
+	}
+
+	sCorpus := &SerializedCorpus{}
+	if err := decodeGob(section, sCorpus); err != nil {
+		return nil, err
+	}
+
+	corpus := NewCorpus()
+	corpus.BuildIndexFromSerializedTokens(sCorpus.Tokens)
+
+	return corpus, nil
+
+}
+
+// convert to serialized corpus
+func (corpus *Corpus) serialize() *SerializedCorpus {
+
 	tokens := make([]SerializedToken, 0)
 	corpus.Each(func(key, value interface{}) {
 		term := key.(string)
@@ -23,7 +76,7 @@ func (corpus *Corpus) ToGOB64() string {
 		for _, d := range docs {
 			doc := d.(Doc)
 			documents = append(documents, SerializedDoc{
-				Positions: doc.Positions,
+				Positions: EncodePositions(doc.Positions),
 				DocID:     doc.ID,
 				File:      doc.File,
 				Frequency: doc.Frequency,
@@ -36,12 +89,8 @@ func (corpus *Corpus) ToGOB64() string {
 			TotalFrequency: index.TotalFrequency,
 		})
 	})
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(&SerializedCorpus{Tokens:tokens})
-	if err != nil { fmt.Println(`failed gob Encode`, err) }
 
-	return base64.StdEncoding.EncodeToString(b.Bytes())
+	return &SerializedCorpus{Tokens:tokens}
 
 }
 
@@ -157,8 +206,13 @@ func CountInverseDocumentFrequency(N int, frequency int) float32 {
 }
 
 func (corpus *Corpus) CountNormalizedDocumentsFrequency() {
+	corpus.Documents.CountNormalizedFrequency()
+}
+
+// Replace term counts of every document vector with counts divided by the vector size
+func (documents *DocumentTree) CountNormalizedFrequency() {
 
-	corpus.Documents.Each(func(key, value interface{}) {
+	documents.Each(func(key, value interface{}) {
 		docs := value.(DocumentIndex)
 		docs.Each(func(key, value interface{}) {
 			docs.Put(key, float32(value.(int))/float32(docs.Size()))
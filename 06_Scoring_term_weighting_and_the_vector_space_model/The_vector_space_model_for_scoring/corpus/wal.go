@@ -0,0 +1,94 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Write-ahead log layout, little endian:
+//
+//	file header of KindLog without sections
+//	record: uint32 CRC32C of data, uint32 data length, gob of LogRecord
+//
+// Records are only appended, a writer that dies leaves a torn record at the end.
+const logRecordHeaderSize = 8
+
+type LogOp uint8
+
+const (
+	LogAdd LogOp = iota + 1
+	LogDelete
+)
+
+// LogRecord is one change of the index that is not in a segment yet
+type LogRecord struct {
+	Op    LogOp
+	DocID int
+	Path  string
+	// Content of the added file, the file may change before the log is replayed.
+	// It is split into documents by Parser, they get IDs from DocID on.
+	Content []byte
+	Parser  ParserConfig
+	// Documents deleted along with the add, old versions of an updated document
+	Deleted []int
+	// Times of the added document kept by the registry
+	Added    time.Time
+	Modified time.Time
+}
+
+// Header of an empty log
+func NewLog() []byte {
+	return EncodeFile(KindLog)
+}
+
+// Encode record to be appended to the log
+func (r LogRecord) MarshalRecord() ([]byte, error) {
+
+	data, err := encodeGob(r)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, logRecordHeaderSize, logRecordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(record[0:], Checksum(data))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(data)))
+
+	return append(record, data...), nil
+
+}
+
+// Decode records of the log. Reading stops at the first torn or corrupted record,
+// size of the valid part is returned, so the rest can be cut off before appending.
+func ReadLog(data []byte) ([]LogRecord, int, error) {
+
+	if len(data) < fileHeaderSize {
+		return nil, 0, ErrCorruptBlock
+	}
+	if _, err := DecodeFile(data[:fileHeaderSize], KindLog); err != nil {
+		return nil, 0, err
+	}
+
+	records := make([]LogRecord, 0)
+	pos := fileHeaderSize
+
+	for pos+logRecordHeaderSize <= len(data) {
+		crc := binary.LittleEndian.Uint32(data[pos:])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if length > len(data)-pos-logRecordHeaderSize {
+			break
+		}
+		record := data[pos+logRecordHeaderSize : pos+logRecordHeaderSize+length]
+		if Checksum(record) != crc {
+			break
+		}
+		r := LogRecord{}
+		if err := decodeGob(record, &r); err != nil {
+			break
+		}
+		records = append(records, r)
+		pos += logRecordHeaderSize + length
+	}
+
+	return records, pos, nil
+
+}
@@ -0,0 +1,55 @@
+package corpus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+
+	written := []LogRecord{
+		{Op: LogAdd, DocID: 2, Path: "new.txt", Content: []byte("what did zebra say")},
+		{Op: LogDelete, DocID: 0},
+		{Op: LogAdd, DocID: 3, Path: "new.txt", Content: []byte("what did giraffe say"), Deleted: []int{2}},
+	}
+
+	data := NewLog()
+	for _, r := range written {
+		record, err := r.MarshalRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, record...)
+	}
+
+	records, size, err := ReadLog(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, written) || size != len(data) {
+		t.Errorf("expected %v of %d bytes, got %v of %d", written, len(data), records, size)
+	}
+
+	// the writer died in the middle of the last record
+	for _, cut := range []int{1, logRecordHeaderSize, logRecordHeaderSize + 3} {
+		torn := append(append([]byte{}, data...), make([]byte, cut)...)
+		torn[len(data)] = 0xff
+		records, size, err := ReadLog(torn)
+		if err != nil || len(records) != 3 || size != len(data) {
+			t.Errorf("cut %d: expected torn record to be skipped, got %d records of %d bytes, %v", cut, len(records), size, err)
+		}
+	}
+
+	// corrupted record and everything after it are lost
+	last, _ := written[2].MarshalRecord()
+	corrupted := append([]byte{}, data...)
+	corrupted[len(data)-len(last)+logRecordHeaderSize] ^= 1
+	if records, size, _ := ReadLog(corrupted); len(records) != 2 || size != len(data)-len(last) {
+		t.Errorf("expected corrupted record to be skipped, got %d records of %d bytes", len(records), size)
+	}
+
+	if _, _, err := ReadLog(NewBitmap().MarshalFile()); err != ErrWrongKind {
+		t.Errorf("bitmap is read as a log, %v", err)
+	}
+
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"../corpus"
+	"../statistics"
+	"../storage"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Print collection statistics used to size hardware for new collections:
+// Heaps' and Zipf's law fits, top terms and dictionary/postings sizes per codec.
+//
+//	go run main.go -root ../storage -dir blocks
+//	go run main.go -corpus corpus.dat
+func main() {
+
+	root := flag.String("root", ".", "directory the block storage was built in, block paths are relative to it")
+	dir := flag.String("dir", "blocks", "dir of the storage's commit point, relative to root")
+	corpusFile := flag.String("corpus", "", "serialized corpus to analyse instead of block storage")
+	top := flag.Int("top", 20, "amount of top terms to print")
+	flag.Parse()
+
+	var report *statistics.Report
+
+	if *corpusFile != "" {
+		data, err := ioutil.ReadFile(*corpusFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// temp blocks have the current format, corpora of other chapters are base64 gob
+		version, err := corpus.DetectVersion(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var c *corpus.Corpus
+		if version == corpus.FormatVersion {
+			c, err = corpus.CorpusFromFile(data)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			c = corpus.FromGOB64(string(data))
+		}
+		report = statistics.FromCorpus(c)
+	} else {
+		if err := os.Chdir(*root); err != nil {
+			log.Fatal(err)
+		}
+		segments, deleted, err := storage.CommittedSegments(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		trees := make([]*corpus.BlockTree, 0, len(segments))
+		for _, indexFile := range segments {
+			bt, err := storage.OpenStorage(indexFile)
+			if bt == nil {
+				log.Fatalf("cannot open segment %s: %v", indexFile, err)
+			}
+			if err != nil {
+				log.Println(err)
+			}
+			trees = append(trees, bt)
+		}
+		report, err = statistics.FromSegments(trees, deleted)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	report.Print(os.Stdout, *top)
+
+}
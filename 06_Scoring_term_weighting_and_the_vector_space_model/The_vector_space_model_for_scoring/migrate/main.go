@@ -0,0 +1,36 @@
+package main
+
+import (
+	"../storage"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Rewrite files of every segment of the storage written by older versions in the current on-disk format.
+//
+//	go run main.go -root ../storage -dir blocks
+func main() {
+
+	root := flag.String("root", ".", "directory the block storage was built in, block paths are relative to it")
+	dir := flag.String("dir", "blocks", "dir of the storage's commit point, relative to root")
+	flag.Parse()
+
+	if err := os.Chdir(*root); err != nil {
+		log.Fatal(err)
+	}
+
+	migrated, err := storage.MigrateStorage(*dir)
+	for _, m := range migrated {
+		fmt.Printf("%s %s: version %d -> current\n", m.Kind, m.Path, m.From)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(migrated) == 0 {
+		fmt.Println("storage already has the current format")
+	}
+
+}
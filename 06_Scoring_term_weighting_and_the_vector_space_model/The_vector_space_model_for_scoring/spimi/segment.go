@@ -0,0 +1,230 @@
+package spimi
+
+import (
+	. "../corpus"
+	"container/heap"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Cursor of the k-way merge, holds the current entry of one sorted source only
+type cursor struct {
+	source TokenIterator
+	token  SerializedToken
+}
+
+// Move to the next entry, false at the end of the source
+func (c *cursor) next() (bool, error) {
+
+	token, err := c.source.Next()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.token = token
+
+	return true, nil
+
+}
+
+// Cursors ordered by their current term
+type cursorHeap []*cursor
+
+func (h cursorHeap) Len() int            { return len(h) }
+func (h cursorHeap) Less(i, j int) bool  { return h[i].token.Term < h[j].token.Term }
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(*cursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+type segmentWriter struct {
+	outputFile   string
+	termsInBlock int
+	docsNum      int
+	deleted      *Bitmap
+	blockTree    *BlockTree
+}
+
+// Merge sources sorted by term into a segment: blocks of termsInBlock terms, the index file
+// and the bloom filter, blocks are written next to the index file. Only the current entry
+// of every source and the terms of one block are kept in memory.
+// A document must be in one source only, documents are vectors of every document with
+// normalized frequencies, docsNum is used for idf.
+// Documents set in deleted are dropped from postings and vectors, deleted may be nil.
+// Registry of the build is kept in the index file, it is nil for segments of an index.
+func WriteSegment(outputFile string, termsInBlock, docsNum int, documents *DocumentTree, sources []TokenIterator, deleted *Bitmap, registry *Registry) (*BlockTree, error) {
+
+	live := NewDocumentTree()
+	documents.Each(func(key, value interface{}) {
+		if !deleted.Contains(key.(int)) {
+			live.Put(key, value)
+		}
+	})
+
+	w := &segmentWriter{
+		outputFile:   outputFile,
+		termsInBlock: termsInBlock,
+		docsNum:      docsNum,
+		deleted:      deleted,
+		blockTree:    NewBlockTree(live),
+	}
+	w.blockTree.Registry = registry
+
+	h := &cursorHeap{}
+	for _, s := range sources {
+		c := &cursor{source: s}
+		ok, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			*h = append(*h, c)
+		}
+	}
+	heap.Init(h)
+
+	pending := make([]SerializedToken, 0, termsInBlock)
+	blockID := 0
+
+	for h.Len() > 0 {
+		token, err := w.mergeTerm(h)
+		if err != nil {
+			return nil, err
+		}
+		// every document of the term is deleted
+		if len(token.Docs) == 0 {
+			continue
+		}
+		pending = append(pending, token)
+		if len(pending) == termsInBlock {
+			if err := w.addBlock(blockID, pending); err != nil {
+				return nil, err
+			}
+			pending = make([]SerializedToken, 0, termsInBlock)
+			blockID++
+		}
+	}
+
+	if len(pending) > 0 {
+		if err := w.addBlock(blockID, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.createBlockStorage(); err != nil {
+		return nil, err
+	}
+
+	return w.blockTree, nil
+
+}
+
+// Pop every cursor positioned on the smallest term and merge their postings
+func (w *segmentWriter) mergeTerm(h *cursorHeap) (SerializedToken, error) {
+
+	merged := SerializedToken{Term: (*h)[0].token.Term}
+
+	for h.Len() > 0 && (*h)[0].token.Term == merged.Term {
+		c := heap.Pop(h).(*cursor)
+		// a document never spans sources, so postings of different sources never collide
+		for _, d := range c.token.Docs {
+			if w.deleted.Contains(d.DocID) {
+				continue
+			}
+			merged.Docs = append(merged.Docs, d)
+			merged.TotalFrequency += d.Frequency
+			w.blockTree.Files[d.DocID] = d.File
+		}
+
+		ok, err := c.next()
+		if err != nil {
+			return merged, err
+		}
+		if ok {
+			heap.Push(h, c)
+		}
+	}
+
+	// documents count is known before merging, so idf is counted right away
+	merged.InverseDocumentFrequency = CountInverseDocumentFrequency(w.docsNum, merged.TotalFrequency)
+	for i := range merged.Docs {
+		merged.Docs[i].InverseDocumentFrequency = CountInverseDocumentFrequency(w.docsNum, merged.Docs[i].Frequency)
+	}
+
+	return merged, nil
+
+}
+
+// Write one block and point its terms to it
+func (w *segmentWriter) addBlock(blockID int, tokens []SerializedToken) error {
+
+	block, crc, err := w.createBlock(blockID, tokens)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		w.blockTree.Put(t.Term, block)
+	}
+	w.blockTree.Checksums[block] = crc
+
+	return nil
+
+}
+
+func (w *segmentWriter) createBlockStorage() error {
+
+	keys := w.blockTree.Keys()
+	w.blockTree.Filter = NewBloomFilter(len(keys), bloomFalsePositiveRate)
+
+	data, err := w.blockTree.MarshalFile()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(w.outputFile, data); err != nil {
+		return err
+	}
+
+	return w.writeBloomFilter(keys)
+
+}
+
+// Save filter of all terms in the segment next to the index file
+func (w *segmentWriter) writeBloomFilter(terms []interface{}) error {
+
+	for _, t := range terms {
+		w.blockTree.Filter.Add(t.(string))
+	}
+
+	data, err := w.blockTree.Filter.MarshalFile()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(BloomFilterPath(w.outputFile), data)
+
+}
+
+// Write block file, returns its path and checksum
+func (w *segmentWriter) createBlock(blockID int, tokens []SerializedToken) (string, uint32, error) {
+
+	outputFile := filepath.Join(filepath.Dir(w.outputFile), fmt.Sprintf("block%d.dat", blockID))
+
+	sc := &SerializedCorpus{Tokens: tokens}
+	data := sc.ToBlockFile()
+
+	if err := writeFile(outputFile, data); err != nil {
+		return "", 0, err
+	}
+
+	return outputFile, Checksum(data), nil
+
+}
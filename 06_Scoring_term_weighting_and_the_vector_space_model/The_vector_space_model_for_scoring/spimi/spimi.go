@@ -3,13 +3,12 @@ package spimi
 import (
 	. "../corpus"
 	"bufio"
-	"errors"
+	"bytes"
 	"fmt"
-	"github.com/emirpasic/gods/maps/hashmap"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 )
@@ -31,87 +30,160 @@ import (
 //Each call of SPIMI-Invert writes a block to disk.
 //The index of the block is its dictionary and the postings_list.
 
+// Probability for a missing term to pass the segment's bloom filter
+const bloomFalsePositiveRate = 0.01
+
+// Approximate memory taken by the in-memory dictionary, used to decide when it is full
+const (
+	termBytes     = 96 // tree node, Index and postings tree of a new term
+	postingBytes  = 80 // tree node and Doc of a new document in a postings list
+	positionBytes = 8
+)
+
+// Documents parsed at the same time, parsed documents wait for the inverter in a queue of the same size
+const parserWorkers = 4
+
 type SPIMI struct {
-	inputDir      string
+	source        DocumentSource
 	outputFile    string
-	tempBlockSize int
+	memoryBudget  int
 	termsInBlock  int
 	docsNum       int
-	corpus        *Corpus
+	documents     *DocumentTree
+	registry      *Registry
+	store         *StoreWriter
+	tempDir       string
 	blockTree     *BlockTree
+	failed        *PartialError
 	mutex         *sync.Mutex
-	wg            *sync.WaitGroup
 }
 
 
-func Spimi(inputDir, outputFile string, tempBlockSize, termsInBlock int) *BlockTree{
+// Build block storage from documents of the input dir, the extension of every file picks its parser.
+// Documents that can not be read are skipped and reported by *PartialError along with the built tree,
+// any other error leaves no usable tree.
+// Memory budget is the approximate size of the dictionary in bytes, when it is reached
+// the dictionary is written to a temp block and inverting starts over. Temp blocks, document vectors
+// of every block and stored documents wait in a temp dir next to the output file until the merge.
+func Spimi(inputDir, outputFile string, memoryBudget, termsInBlock int) (*BlockTree, error) {
+	return SpimiFiltered(inputDir, outputFile, memoryBudget, termsInBlock, nil)
+}
 
-	spimi := &SPIMI{
-		inputDir:      inputDir,
-		outputFile:    outputFile,
-		tempBlockSize: tempBlockSize,
-		termsInBlock:  termsInBlock,
-		mutex:  	   &sync.Mutex{},
-		wg: 		   &sync.WaitGroup{},
-	}
-	tokenStream := spimi.generateTokens()
-	blocks := spimi.makeTempBlocks(tokenStream)
-	terms := getTerms(tokenStream)
-	spimi.mergeTempBlocks(terms, blocks)
+// Like Spimi, but documents whose path include does not accept are left out,
+// so documents of one dir are split between indexes. Nil include takes every document.
+func SpimiFiltered(inputDir, outputFile string, memoryBudget, termsInBlock int, include func(path string) bool) (*BlockTree, error) {
 
-	spimi.createBlockStorage()
+	source, err := NewDirectorySource(inputDir, ParserConfig{})
+	if err != nil {
+		return nil, err
+	}
+	source.Include = include
 
-	return spimi.blockTree
+	return SpimiSource(source, outputFile, memoryBudget, termsInBlock)
 
 }
 
-func getTerms(tokens []Token) []string {
-
-	res := make([]string, 0)
+// Build block storage from documents of the source, like Spimi
+func SpimiSource(source DocumentSource, outputFile string, memoryBudget, termsInBlock int) (*BlockTree, error) {
 
-	for _, token := range tokens {
-		res = append(res, token.Term)
+	// builds of different outputs never share temp files
+	tempDir, err := ioutil.TempDir(filepath.Dir(outputFile), "spimi")
+	if err != nil {
+		return nil, NewFileError(outputFile, err)
 	}
+	// temp files are useless after the merge, whether it failed or not
+	defer os.RemoveAll(tempDir)
 
-	return res
+	store, err := NewStoreWriter(filepath.Join(tempDir, "documents.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
 
-}
+	spimi := &SPIMI{
+		source:        source,
+		outputFile:    outputFile,
+		memoryBudget:  memoryBudget,
+		termsInBlock:  termsInBlock,
+		documents:     NewDocumentTree(),
+		registry:      NewRegistry(),
+		store:         store,
+		tempDir:       tempDir,
+		failed:        &PartialError{},
+		mutex:  	   &sync.Mutex{},
+	}
+	blocks, err := spimi.makeTempBlocks(spimi.generateTokens())
+	if err != nil {
+		return nil, err
+	}
 
+	if err := spimi.mergeTempBlocks(blocks); err != nil {
+		return nil, err
+	}
 
-// Generate tokens from files in data dir
-// TODO: Maybe good idea is to return chanel, so program could run forward while this method will parse files in dir
-func (spimi *SPIMI) generateTokens() []Token {
+	return spimi.blockTree, spimi.failed.Err()
 
-	tokenStream := make([]Token, 0)
+}
 
-	files, err := ioutil.ReadDir(spimi.inputDir)
-	if err != nil {
-		// TODO: Warning!!!!
-		log.Fatal(err)
-	}
 
-	spimi.docsNum = len(files)
+// Generate tokens from documents of the source, tokens of every document are sent as soon as
+// the document is parsed. Unreadable documents are skipped and collected in spimi.failed.
+func (spimi *SPIMI) generateTokens() <-chan []Token {
 
-	spimi.wg.Add(len(files))
+	type registered struct {
+		info DocumentInfo
+		doc  ParsedDocument
+	}
+	queue := make(chan registered)
+	documents := make(chan []Token, parserWorkers)
 
-	for i, f := range files {
-		// TODO: use concurrency to parse document
-		// 1 gorutine per file
-		go func(i int, filename string) {
-			tokens, err := spimi.parseDocument(i, filename)
+	// IDs are given in the order of the source, whichever parser gets the document
+	go func() {
+		for {
+			doc, err := spimi.source.Next()
+			if err == io.EOF {
+				break
+			}
 			if err != nil {
-				log.Println(err)
-				return
+				spimi.fail(err)
+				continue
 			}
-			tokenStream = append(tokenStream, tokens...)
-		}(i, spimi.inputDir +"/" + f.Name())
-
+			info := DocumentInfo{Path: doc.Path, Modified: doc.Modified}
+			info.ID = spimi.registry.Register(info)
+			queue <- registered{info, doc.ParsedDocument}
+		}
+		close(queue)
+	}()
+
+	parsers := &sync.WaitGroup{}
+	parsers.Add(parserWorkers)
+	for i := 0; i < parserWorkers; i++ {
+		go func() {
+			defer parsers.Done()
+			for r := range queue {
+				tokens, err := RegisterDocument(spimi.registry, spimi.store, r.info, r.doc)
+				if err != nil {
+					spimi.fail(err)
+					continue
+				}
+				documents <- tokens
+			}
+		}()
 	}
 
-	spimi.wg.Wait()
+	go func() {
+		parsers.Wait()
+		close(documents)
+	}()
 
-	return tokenStream
+	return documents
+
+}
 
+func (spimi *SPIMI) fail(err error) {
+	spimi.mutex.Lock()
+	spimi.failed.Add(err)
+	spimi.mutex.Unlock()
 }
 
 
@@ -141,15 +213,60 @@ func tokenize(text string) []string {
 }
 
 // Parse the doc in a stream of term-docId pairs which we call tokens
-func (spimi *SPIMI) parseDocument(docID int, fileName string) ([]Token, error) {
+func ParseDocument(docID int, fileName string) ([]Token, error) {
 
 	file, err := os.Open(fileName)
 	if err != nil {
-		return []Token{}, errors.New(fmt.Sprintf("Cannot open file: %v", err))
+		return []Token{}, NewFileError(fileName, err)
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	return parseReader(docID, fileName, file)
+
+}
+
+// Parse text of the doc that was read before, the file itself is not touched
+func ParseContent(docID int, fileName string, content []byte) ([]Token, error) {
+	return parseReader(docID, fileName, bytes.NewReader(content))
+}
+
+// Parse the registered doc, the registry learns its title and length
+// and the store keeps its text and fields. A doc that fails is removed from the registry,
+// its ID is not given again.
+func RegisterDocument(registry *Registry, store DocumentWriter, info DocumentInfo, doc ParsedDocument) ([]Token, error) {
+
+	tokens, err := DescribeDocument(&info, doc)
+	if err == nil {
+		err = store.Put(StoredDocument{ID: info.ID, Path: info.Path, Text: doc.Text, Fields: doc.Fields})
+	}
+	if err != nil {
+		registry.Remove(info.ID)
+		return []Token{}, err
+	}
+	registry.Put(info)
+
+	return tokens, nil
+
+}
+
+// Parse text of the doc of info, title and length of info are set from it
+func DescribeDocument(info *DocumentInfo, doc ParsedDocument) ([]Token, error) {
+
+	tokens, err := ParseContent(info.ID, info.Path, []byte(doc.Text))
+	if err != nil {
+		return tokens, err
+	}
+
+	info.Title = doc.Title
+	info.Length = len(tokens)
+
+	return tokens, nil
+
+}
+
+func parseReader(docID int, fileName string, r io.Reader) ([]Token, error) {
+
+	reader := bufio.NewReader(r)
 	scanner := bufio.NewScanner(reader)
 	scanner.Split(bufio.ScanLines)
 
@@ -167,7 +284,9 @@ func (spimi *SPIMI) parseDocument(docID int, fileName string) ([]Token, error) {
 		}
 	}
 
-	spimi.wg.Done()
+	if err := scanner.Err(); err != nil {
+		return []Token{}, NewFileError(fileName, err)
+	}
 
 	return tokens, nil
 
@@ -175,226 +294,185 @@ func (spimi *SPIMI) parseDocument(docID int, fileName string) ([]Token, error) {
 
 type blocks []string
 
-// Create block channel of created files with tokens
-func (spimi *SPIMI) makeTempBlocks(tokenStream []Token) blocks {
+// Invert documents into temp blocks until the stream is over
+func (spimi *SPIMI) makeTempBlocks(documents <-chan []Token) (blocks, error) {
 
-	blockID, begin, end := 0, 0, 0
-	tokensCount := len(tokenStream)
+	// parsers must not get stuck on a full queue when inverting fails
+	defer func() {
+		for range documents {
+		}
+	}()
 
 	blocks := make(blocks, 0)
 
-	for end + spimi.tempBlockSize < tokensCount {
-		end += spimi.tempBlockSize
-		blocks  = append(blocks, spimi.Invert(blockID, tokenStream[begin:end]))
-		blockID++
-		begin = end
+	for blockID := 0; ; blockID++ {
+		block, err := spimi.Invert(blockID, documents)
+		if err != nil {
+			return blocks, err
+		}
+		if block == "" {
+			return blocks, nil
+		}
+		blocks = append(blocks, block)
 	}
 
-	blocks  = append(blocks, spimi.Invert(blockID, tokenStream[end:]))
-
-	return blocks
-
 }
 
-// Create inverted Index
-func (spimi *SPIMI) Invert(blockID int, tokens []Token) string{
-
-	outputFile := fmt.Sprintf("temp/block%d.dat", blockID)
+// Create inverted Index of documents from the stream while the memory budget allows
+// and write it to a temp block. Empty path means the stream was already over.
+func (spimi *SPIMI) Invert(blockID int, documents <-chan []Token) (string, error) {
 
 	c := NewCorpus()
-	c.BuildIndexFromTokens(tokens)
+	size := 0
 
-	file, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		log.Println(err)
+	for size < spimi.memoryBudget {
+		tokens, ok := <-documents
+		if !ok {
+			break
+		}
+		size += dictionaryGrowth(c, tokens)
+		c.BuildIndexFromTokens(tokens)
+		spimi.docsNum++
 	}
-	defer file.Close()
 
-	w := bufio.NewWriter(file)
-	_, err = w.Write([]byte(c.ToGOB64()))
+	if size == 0 {
+		return "", nil
+	}
+
+	// a document never spans blocks, so its vector is complete and goes to disk with the block
+	c.Documents.CountNormalizedFrequency()
+	vectors, err := NewBlockTree(c.Documents).MarshalFile()
 	if err != nil {
-		log.Println(err)
+		return "", err
+	}
+	if err := writeFile(spimi.vectorsFile(blockID), vectors); err != nil {
+		return "", err
+	}
+
+	outputFile := filepath.Join(spimi.tempDir, fmt.Sprintf("block%d.dat", blockID))
+
+	if err := writeFile(outputFile, c.ToRunFile()); err != nil {
+		return "", err
 	}
-	w.Flush()
 
-	return outputFile
+	return outputFile, nil
 }
 
-func (spimi *SPIMI) mergeTempBlocks(terms []string, blocks blocks) {
+// Temp file of document vectors of the block
+func (spimi *SPIMI) vectorsFile(blockID int) string {
+	return filepath.Join(spimi.tempDir, fmt.Sprintf("vectors%d.dat", blockID))
+}
 
-	for _, b := range blocks {
-		f , err := os.Open(b)
+// Read back vectors of every temp block, they are normalized already
+func (spimi *SPIMI) loadVectors(blocks blocks) error {
+
+	for blockID := range blocks {
+		path := spimi.vectorsFile(blockID)
+		data, err := ioutil.ReadFile(path)
 		if err != nil {
-			log.Println(err)
+			return NewFileError(path, err)
 		}
-
-		stat, err := f.Stat()
+		bt, _, err := ReadBlockTree(data)
 		if err != nil {
-			log.Println(err)
+			return NewFileError(path, err)
 		}
+		bt.Documents.Each(func(key, value interface{}) {
+			spimi.documents.Put(key, value)
+		})
+	}
 
-		data := make([]byte, stat.Size())
+	return nil
 
-		for {
-			_, err = f.Read(data)
-			if err != nil {
-				if err == io.EOF {
-					break // end of the file
-				} else {
-					fmt.Println("Error reading file");
-					os.Exit(1)
-				}
-			}
-		}
-		corpus := FromGOB64(string(data))
-		spimi.IntersectCorpuses(corpus)
+}
 
-		spimi.corpus.DocsNum = spimi.docsNum
+// Bytes the dictionary grows by after adding tokens of one document
+func dictionaryGrowth(c *Corpus, tokens []Token) int {
 
-		f.Close()
-		//delete file
-		err = os.Remove(b)
-		if err != nil {
-			log.Println(err)
+	size := len(tokens) * positionBytes
+
+	seen := make(map[string]bool)
+	for _, t := range tokens {
+		if seen[t.Term] {
+			continue
+		}
+		seen[t.Term] = true
+		size += postingBytes
+		if _, ok := c.Get(t.Term); !ok {
+			size += termBytes + len(t.Term)
 		}
 	}
 
-}
-
+	// empty documents still count, so the loop always moves on
+	if size == 0 {
+		size = 1
+	}
 
-func (spimi *SPIMI) IntersectCorpuses(c *Corpus) {
-
-	if spimi.corpus == nil {
-		spimi.corpus = c
-		return
-	}
-
-	c.Each(func(key, value interface{}) {
-		term := key.(string)
-		index := value.(Index)
-		if v, ok := spimi.corpus.Get(term); !ok {
-			spimi.corpus.Put(term, Index{index.Docs, index.TotalFrequency, index.DocsNum, index.InverseDocumentFrequency})
-			spimi.corpus.TermsNum++
-		} else {
-			documents := v.(Index)
-			documents.TotalFrequency += index.TotalFrequency
-			index.Docs.Each(func(key, value interface{}) {
-				documents.DocsNum++
-				docID := key.(int)
-				doc := value.(Doc)
-				if !documents.Contains(docID) {
-					documents.Docs.Put(docID, doc)
-				} else {
-					documents.UpdateDocument(docID, doc.Positions)
-				}
-			})
-			spimi.corpus.Put(term, documents)
-		}
-	})
+	return size
 
 }
 
-func (spimi *SPIMI) createBlockStorage() {
+func writeFile(path string, data []byte) error {
 
-	file, err := os.OpenFile(spimi.outputFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		log.Println(err)
+		return NewFileError(path, err)
 	}
 	defer file.Close()
 
-	spimi.corpus.CountInverseDocumentsFrequency()
-
-	spimi.corpus.CountNormalizedDocumentsFrequency()
+	w := bufio.NewWriter(file)
+	if _, err := w.Write(data); err != nil {
+		return NewFileError(path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return NewFileError(path, err)
+	}
 
-	keys := spimi.corpus.Keys()
-	termsCount := len(keys)
-	begin, end, blockID := 0,0,0
+	return file.Close()
 
-	spimi.blockTree = &BlockTree{hashmap.New(), spimi.corpus.Documents}
+}
 
-	spimi.wg.Add((termsCount/spimi.termsInBlock)-1)
+// Merge temp blocks term by term straight into the final segment
+func (spimi *SPIMI) mergeTempBlocks(blocks blocks) error {
 
-	for end + spimi.termsInBlock < termsCount {
-		end += spimi.termsInBlock
-		terms := keys[begin:end]
-		go func(blockID int, terms []interface{}) {
-			block := spimi.createBlock(blockID, terms)
-			for _, t := range terms {
-				spimi.mutex.Lock()
-				spimi.blockTree.Put(t, block)
-				spimi.mutex.Unlock()
-			}
-			spimi.wg.Done()
-		}(blockID, terms)
+	runs := make([]TokenIterator, 0, len(blocks))
+	for _, b := range blocks {
+		file, err := os.Open(b)
+		if err != nil {
+			return NewFileError(b, err)
+		}
+		defer file.Close()
 
-		blockID++
-		begin = end
+		reader, err := NewRunReader(file)
+		if err != nil {
+			return NewFileError(b, err)
+		}
+		runs = append(runs, reader)
 	}
 
-
-	terms := keys[begin:]
-	block := spimi.createBlock(blockID, terms)
-	for _, t := range terms {
-		spimi.mutex.Lock()
-		spimi.blockTree.Put(t, block)
-		spimi.mutex.Unlock()
+	if err := spimi.loadVectors(blocks); err != nil {
+		return err
 	}
 
-	spimi.wg.Wait()
-
-	w := bufio.NewWriter(file)
-	_, err = w.Write([]byte(spimi.blockTree.ToGOB64()))
+	bt, err := WriteSegment(spimi.outputFile, spimi.termsInBlock, spimi.docsNum, spimi.documents, runs, nil, spimi.registry)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-	w.Flush()
-
-}
-
-func (spimi *SPIMI) createBlock(blockID int, terms []interface{}) string {
 
-	outputFile := fmt.Sprintf("blocks/block%d.dat", blockID)
-
-	file, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		log.Println(err)
+	// the tree gives documents back like a loaded index, from the written store file
+	storeFile := StorePath(spimi.outputFile)
+	if err := spimi.store.WriteFile(storeFile); err != nil {
+		return err
 	}
-	defer file.Close()
-
-	tokens := make([]SerializedToken, 0)
-
-	for _, t := range terms {
-		idx, _ := spimi.corpus.Get(t)
-		index := idx.(Index)
-		docs := index.Docs.Values()
-		documents := make([]SerializedDoc, 0)
-		for _, d := range docs {
-			doc := d.(Doc)
-			documents = append(documents, SerializedDoc{
-				Positions: doc.Positions,
-				DocID:     doc.ID,
-				File:      doc.File,
-				Frequency: doc.Frequency,
-				InverseDocumentFrequency: doc.InverseDocumentFrequency,
-			})
-		}
-		tokens = append(tokens, SerializedToken{
-			Term: t.(string),
-			Docs: documents,
-			TotalFrequency: index.TotalFrequency,
-			InverseDocumentFrequency: index.InverseDocumentFrequency,
-		})
+	data, err := ioutil.ReadFile(storeFile)
+	if err != nil {
+		return NewFileError(storeFile, err)
 	}
-
-	sc := &SerializedCorpus{tokens}
-
-	w := bufio.NewWriter(file)
-	_, err = w.Write([]byte(sc.ToGOB64()))
+	bt.Store, err = ReadDocumentStore(data)
 	if err != nil {
-		log.Println(err)
+		return NewFileError(storeFile, err)
 	}
-	w.Flush()
+	spimi.blockTree = bt
 
-	return outputFile
+	return nil
 
-}
\ No newline at end of file
+}
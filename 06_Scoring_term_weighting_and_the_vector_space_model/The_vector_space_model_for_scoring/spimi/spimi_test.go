@@ -1,22 +1,224 @@
 package spimi
 
 import (
+	. "../corpus"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
 )
 
 var spimi =  &SPIMI{
-	inputDir:      "data",
 	outputFile:    "blocks/index.dat",
-	tempBlockSize: 5000,
+	memoryBudget:  32 << 20,
 	termsInBlock:  4,
 	mutex:         &sync.Mutex{},
-	wg:            &sync.WaitGroup{},
 
 }
 
 
+// Index file in a temp dir, so blocks, bloom filter and store of a test are removed with it
+func tempIndex(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "index.dat")
+}
+
 func TestSPIMI(t *testing.T) {
-	fmt.Println(Spimi("data", "blocks/index.dat", 5000, 4).Size())
-}
\ No newline at end of file
+	bt, err := Spimi("data", tempIndex(t), 32 << 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(bt.Size())
+}
+
+func TestSPIMIMissingDir(t *testing.T) {
+	if _, err := Spimi("no_such_dir", tempIndex(t), 32 << 20, 4); !errors.Is(err, ErrMissingSegment) {
+		t.Errorf("expected missing segment, got %v", err)
+	}
+}
+// Postings of every term as doc ID and frequency pairs
+func postings(t *testing.T, bt *BlockTree) map[string][][2]int {
+
+	res := make(map[string][][2]int)
+	for _, key := range bt.Keys() {
+		path, _ := bt.Get(key)
+		data, err := ioutil.ReadFile(path.(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _, err := ReadBlock(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _, _ := block.Find(key.(string))
+		for _, d := range token.Docs {
+			res[key.(string)] = append(res[key.(string)], [2]int{d.DocID, d.Frequency})
+		}
+	}
+
+	return res
+
+}
+
+// Normalized frequencies of every document vector
+func vectors(bt *BlockTree) map[int]map[string]float32 {
+
+	res := make(map[int]map[string]float32)
+	bt.Documents.Each(func(key, value interface{}) {
+		terms := make(map[string]float32)
+		value.(*DocumentIndex).Each(func(term, frequency interface{}) {
+			terms[term.(string)] = frequency.(float32)
+		})
+		res[key.(int)] = terms
+	})
+
+	return res
+
+}
+
+// Every document gets its own temp block when the budget is tiny
+func TestSPIMIMemoryBudget(t *testing.T) {
+
+	bt, err := Spimi("data", tempIndex(t), 32 << 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := postings(t, bt)
+	expectedVectors := vectors(bt)
+
+	bt, err = Spimi("data", tempIndex(t), 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := postings(t, bt); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if bt.Documents.Size() != 2 {
+		t.Errorf("expected vectors of 2 documents, got %d", bt.Documents.Size())
+	}
+	// vectors spilled with every temp block are read back the same
+	if actual := vectors(bt); !reflect.DeepEqual(actual, expectedVectors) {
+		t.Errorf("expected vectors %v, got %v", expectedVectors, actual)
+	}
+
+}
+
+// IDs follow the order of the dir and the registry is read back with the index
+func TestSPIMIRegistry(t *testing.T) {
+
+	indexFile := tempIndex(t)
+	if _, err := Spimi("data", indexFile, 32 << 20, 4); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, _, err := ReadBlockTree(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, path := range []string{"data/text1.txt", "data/text2.txt"} {
+		info, ok := bt.Registry.Get(id)
+		if !ok || info.Path != path || info.Title == "" || info.Length == 0 || info.Modified.IsZero() {
+			t.Errorf("expected %s as document %d, got %v, %v", path, id, info, ok)
+		}
+	}
+	if bt.Registry.NextID() != 2 {
+		t.Errorf("expected next ID 2, got %d", bt.Registry.NextID())
+	}
+
+}
+
+// Files of different formats, a file of rows gives many documents
+func TestSpimiSource(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spimi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.html"), []byte("<title>Page</title><p>what did <i>zebra</i> say</p>"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "b.csv"), []byte("title,text,year\nFirst,what did giraffe say,1999\nSecond,lion,2000\n"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "c.md"), []byte("# Notes\n\n*quite* a world"), 0666)
+
+	source, err := NewDirectorySource(dir, ParserConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := SpimiSource(source, filepath.Join(dir, "index.dat"), 32 << 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DocumentInfo{
+		{ID: 0, Path: dir + "/a.html", Title: "Page", Length: 4},
+		{ID: 1, Path: dir + "/b.csv", Title: "First", Length: 4},
+		{ID: 2, Path: dir + "/b.csv", Title: "Second", Length: 1},
+		{ID: 3, Path: dir + "/c.md", Title: "Notes", Length: 4},
+	}
+	for _, e := range expected {
+		info, _ := bt.Registry.Get(e.ID)
+		info.Added, info.Modified = e.Added, e.Modified
+		if !reflect.DeepEqual(info, e) {
+			t.Errorf("expected %v, got %v", e, info)
+		}
+	}
+	if doc, err := bt.Store.Get(1); err != nil || doc.Text != "what did giraffe say" || doc.Fields["year"] != "1999" {
+		t.Errorf("expected the first row stored with its year, got %v, %v", doc, err)
+	}
+	if _, ok := bt.Get("zebra"); !ok {
+		t.Error("expected zebra in the dictionary")
+	}
+	if _, ok := bt.Get("<i>zebra</i>"); ok {
+		t.Error("expected tags to be stripped")
+	}
+
+}
+
+// Stories of a Reuters file are documents with their docno stored
+func TestSpimiReuters(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spimi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "reut2-000.sgm"), []byte(`<!DOCTYPE lewis SYSTEM "lewis.dtd">
+<REUTERS NEWID="5"><TEXT><TITLE>COCOA REVIEW</TITLE><BODY>showers in the cocoa zone</BODY></TEXT></REUTERS>
+<REUTERS NEWID="6"><TEXT><TITLE>GRAIN</TITLE><BODY>wheat exports</BODY></TEXT></REUTERS>
+`), 0666)
+
+	source, err := NewDirectorySource(dir, ParserConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := SpimiSource(source, filepath.Join(dir, "index.dat"), 32 << 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, docNo := range []string{"5", "6"} {
+		doc, err := bt.Store.Get(id)
+		if err != nil || doc.Fields[DocNoField] != docNo {
+			t.Errorf("expected docno %s of document %d, got %v, %v", docNo, id, doc, err)
+		}
+	}
+	// the title is counted in the text
+	if info, _ := bt.Registry.Get(1); info.Title != "GRAIN" || info.Length != 3 {
+		t.Errorf("expected the title of the second story, got %v", info)
+	}
+	for _, term := range []string{"wheat", "GRAIN"} {
+		if _, ok := bt.Get(term); !ok {
+			t.Errorf("expected %s in the dictionary", term)
+		}
+	}
+
+}
@@ -0,0 +1,381 @@
+package statistics
+
+import (
+	"../corpus"
+	"../storage"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Heaps' law: M = kT^b, M - vocabulary size, T - number of tokens in the collection
+type HeapsLaw struct {
+	K      float64
+	B      float64
+	Points []HeapsPoint
+}
+
+// Vocabulary size after reading first documents of the collection
+type HeapsPoint struct {
+	Documents  int
+	Tokens     int
+	Vocabulary int
+}
+
+// Zipf's law: cf(i) = c * i^(-Exponent), cf(i) - collection frequency of the i-th most common term
+type ZipfLaw struct {
+	Exponent float64
+	C        float64
+}
+
+type RankedTerm struct {
+	Rank                int
+	Term                string
+	CollectionFrequency int
+	DocumentFrequency   int
+}
+
+// Size of the dictionary or postings in bytes for one codec
+type CodecSize struct {
+	Codec string
+	Bytes int
+}
+
+type Report struct {
+	Documents      int
+	Tokens         int
+	Terms          int
+	Singletons     int // terms that occur once in the whole collection
+	Heaps          HeapsLaw
+	Zipf           ZipfLaw
+	Ranks          []RankedTerm
+	DictionarySize []CodecSize
+	PostingsSize   []CodecSize
+}
+
+// postings of one term, docs are sorted by ID. Positions are counted only
+// by the bytes of their VB gaps.
+type termPostings struct {
+	term        string
+	docs        []int
+	frequencies []int
+	positions   int
+}
+
+// Build the report from in-memory corpus
+func FromCorpus(c *corpus.Corpus) *Report {
+
+	terms := make([]termPostings, 0, c.Size())
+
+	c.Each(func(key, value interface{}) {
+		index := value.(corpus.Index)
+		tp := termPostings{term: key.(string)}
+		index.Docs.Each(func(key, value interface{}) {
+			doc := value.(corpus.Doc)
+			tp.docs = append(tp.docs, doc.ID)
+			tp.frequencies = append(tp.frequencies, doc.Frequency)
+			tp.positions += len(corpus.EncodePositions(doc.Positions))
+		})
+		terms = append(terms, tp)
+	})
+
+	return newReport(terms)
+
+}
+
+// Build the report from block storage, every block is read once.
+// Blocks that can not be read are left out and reported by *corpus.PartialError.
+func FromBlockTree(bt *corpus.BlockTree) (*Report, error) {
+	return FromSegments([]*corpus.BlockTree{bt}, nil)
+}
+
+// Build the report from segments of one index, postings of a term are gathered from
+// every segment and documents set in deleted are left out, deleted may be nil.
+// Blocks that can not be read are left out and reported by *corpus.PartialError.
+func FromSegments(segments []*corpus.BlockTree, deleted *corpus.Bitmap) (*Report, error) {
+
+	postings := make(map[string]*termPostings)
+	failed := &corpus.PartialError{}
+
+	for _, bt := range segments {
+		seen := make(map[string]bool)
+		for _, v := range bt.Values() {
+			block := v.(string)
+			if seen[block] {
+				continue
+			}
+			seen[block] = true
+
+			sc, err := storage.DeserializeBlock(block)
+			if err != nil {
+				failed.Add(err)
+				continue
+			}
+
+			for _, token := range sc.Tokens {
+				tp, ok := postings[token.Term]
+				if !ok {
+					tp = &termPostings{term: token.Term}
+					postings[token.Term] = tp
+				}
+				for _, d := range token.Docs {
+					if deleted.Contains(d.DocID) {
+						continue
+					}
+					tp.docs = append(tp.docs, d.DocID)
+					tp.frequencies = append(tp.frequencies, d.Frequency)
+					tp.positions += len(d.Positions)
+				}
+			}
+		}
+	}
+
+	terms := make([]termPostings, 0, len(postings))
+	for _, tp := range postings {
+		// a term whose documents are all deleted is not in the index anymore
+		if len(tp.docs) > 0 {
+			terms = append(terms, sortedPostings(*tp))
+		}
+	}
+
+	return newReport(terms), failed.Err()
+
+}
+
+// Segments are not ordered by doc ID after merges, so postings gathered from them are sorted
+func sortedPostings(tp termPostings) termPostings {
+
+	order := make([]int, len(tp.docs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return tp.docs[order[i]] < tp.docs[order[j]] })
+
+	sorted := termPostings{term: tp.term, positions: tp.positions}
+	for _, i := range order {
+		sorted.docs = append(sorted.docs, tp.docs[i])
+		sorted.frequencies = append(sorted.frequencies, tp.frequencies[i])
+	}
+
+	return sorted
+
+}
+
+func newReport(terms []termPostings) *Report {
+
+	r := &Report{Terms: len(terms)}
+
+	// tokens per document and the first document of every term for Heaps' curve
+	docTokens := make(map[int]int)
+	firstDoc := make(map[int]int)
+
+	for _, tp := range terms {
+		cf := 0
+		for i, id := range tp.docs {
+			cf += tp.frequencies[i]
+			docTokens[id] += tp.frequencies[i]
+		}
+		r.Tokens += cf
+		if cf == 1 {
+			r.Singletons++
+		}
+		if len(tp.docs) > 0 {
+			firstDoc[minDoc(tp.docs)]++
+		}
+		r.Ranks = append(r.Ranks, RankedTerm{
+			Term:                tp.term,
+			CollectionFrequency: cf,
+			DocumentFrequency:   len(tp.docs),
+		})
+	}
+	r.Documents = len(docTokens)
+
+	sort.Slice(r.Ranks, func(i, j int) bool {
+		if r.Ranks[i].CollectionFrequency != r.Ranks[j].CollectionFrequency {
+			return r.Ranks[i].CollectionFrequency > r.Ranks[j].CollectionFrequency
+		}
+		return r.Ranks[i].Term < r.Ranks[j].Term
+	})
+	for i := range r.Ranks {
+		r.Ranks[i].Rank = i + 1
+	}
+
+	r.Heaps = heapsCurve(docTokens, firstDoc)
+	r.Zipf = fitZipf(r.Ranks)
+	r.DictionarySize = dictionarySizes(terms)
+	r.PostingsSize = postingsSizes(terms)
+
+	return r
+
+}
+
+// Read documents in ID order, the vocabulary grows by terms seen for the first time
+func heapsCurve(docTokens, firstDoc map[int]int) HeapsLaw {
+
+	ids := make([]int, 0, len(docTokens))
+	for id := range docTokens {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	points := make([]HeapsPoint, 0, len(ids))
+	tokens, vocabulary := 0, 0
+	for i, id := range ids {
+		tokens += docTokens[id]
+		vocabulary += firstDoc[id]
+		points = append(points, HeapsPoint{i + 1, tokens, vocabulary})
+	}
+
+	x := make([]float64, 0, len(points))
+	y := make([]float64, 0, len(points))
+	for _, p := range points {
+		x = append(x, float64(p.Tokens))
+		y = append(y, float64(p.Vocabulary))
+	}
+
+	// log M = log k + b log T
+	intercept, slope := fitLogLog(x, y)
+
+	return HeapsLaw{
+		K:      math.Exp(intercept),
+		B:      slope,
+		Points: points,
+	}
+
+}
+
+func fitZipf(ranks []RankedTerm) ZipfLaw {
+
+	x := make([]float64, 0, len(ranks))
+	y := make([]float64, 0, len(ranks))
+	for _, r := range ranks {
+		x = append(x, float64(r.Rank))
+		y = append(y, float64(r.CollectionFrequency))
+	}
+
+	// log cf = log c - a log i
+	intercept, slope := fitLogLog(x, y)
+
+	return ZipfLaw{
+		Exponent: -slope,
+		C:        math.Exp(intercept),
+	}
+
+}
+
+// Least squares fit of log y = a + b log x, points with zeros are skipped
+func fitLogLog(x, y []float64) (float64, float64) {
+
+	var n, sx, sy, sxx, sxy float64
+
+	for i := range x {
+		if x[i] <= 0 || y[i] <= 0 {
+			continue
+		}
+		lx, ly := math.Log(x[i]), math.Log(y[i])
+		n++
+		sx += lx
+		sy += ly
+		sxx += lx * lx
+		sxy += lx * ly
+	}
+
+	if n < 2 || n*sxx-sx*sx == 0 {
+		return 0, 0
+	}
+
+	b := (n*sxy - sx*sy) / (n*sxx - sx*sx)
+	a := (sy - b*sx) / n
+
+	return a, b
+
+}
+
+// Dictionary sizes as in chapter 5: 4 bytes for frequency and postings pointer per term,
+// plus term storage of the given scheme
+func dictionarySizes(terms []termPostings) []CodecSize {
+
+	const (
+		frequency     = 4
+		postingsPtr   = 4
+		termPtr       = 3
+		fixedTermSize = 20
+		blockSize     = 4
+	)
+
+	m := len(terms)
+	chars := 0
+	for _, tp := range terms {
+		chars += len(tp.term)
+	}
+
+	return []CodecSize{
+		{"fixed width", m * (fixedTermSize + frequency + postingsPtr)},
+		{"as a string", m*(frequency+postingsPtr+termPtr) + chars},
+		{fmt.Sprintf("blocked k=%d", blockSize), m*(frequency+postingsPtr+1) + chars + (m+blockSize-1)/blockSize*termPtr},
+	}
+
+}
+
+func postingsSizes(terms []termPostings) []CodecSize {
+
+	raw, vb, pfor, positions := 0, 0, 0, 0
+
+	for _, tp := range terms {
+		raw += 4 * len(tp.docs)
+		vb += len(corpus.VBEncodeGaps(tp.docs))
+		pfor += len(corpus.EncodePFor(tp.docs))
+		positions += tp.positions
+	}
+
+	return []CodecSize{
+		{"uncompressed 32-bit", raw},
+		{"VB gaps", vb},
+		{"PForDelta", pfor},
+		{"positions VB gaps", positions},
+	}
+
+}
+
+func minDoc(values []int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// Print human readable report with top terms
+func (r *Report) Print(w io.Writer, top int) {
+
+	fmt.Fprintf(w, "documents: %d, tokens: %d, terms: %d, singletons: %d\n", r.Documents, r.Tokens, r.Terms, r.Singletons)
+
+	fmt.Fprintf(w, "\nHeaps' law: M = %.2f * T^%.3f\n", r.Heaps.K, r.Heaps.B)
+	fmt.Fprintln(w, "documents\ttokens\tvocabulary")
+	for _, p := range r.Heaps.Points {
+		fmt.Fprintf(w, "%d\t%d\t%d\n", p.Documents, p.Tokens, p.Vocabulary)
+	}
+
+	fmt.Fprintf(w, "\nZipf's law: cf(i) = %.2f * i^-%.3f\n", r.Zipf.C, r.Zipf.Exponent)
+	fmt.Fprintln(w, "rank\tcf\tdf\tterm")
+	for _, t := range r.Ranks {
+		if t.Rank > top {
+			break
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", t.Rank, t.CollectionFrequency, t.DocumentFrequency, t.Term)
+	}
+
+	fmt.Fprintln(w, "\ndictionary bytes:")
+	for _, s := range r.DictionarySize {
+		fmt.Fprintf(w, "%s\t%d\n", s.Codec, s.Bytes)
+	}
+
+	fmt.Fprintln(w, "\npostings bytes:")
+	for _, s := range r.PostingsSize {
+		fmt.Fprintf(w, "%s\t%d\n", s.Codec, s.Bytes)
+	}
+
+}
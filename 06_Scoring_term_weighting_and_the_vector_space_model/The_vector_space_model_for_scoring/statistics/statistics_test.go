@@ -0,0 +1,99 @@
+package statistics
+
+import (
+	"../corpus"
+	"../spimi"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFitLogLog(t *testing.T) {
+
+	// M = 44 * T^0.49, as for Reuters-RCV1
+	x := make([]float64, 0)
+	y := make([]float64, 0)
+	for T := 1000.0; T < 1e7; T *= 3 {
+		x = append(x, T)
+		y = append(y, 44*math.Pow(T, 0.49))
+	}
+
+	a, b := fitLogLog(x, y)
+	if math.Abs(math.Exp(a)-44) > 0.01 || math.Abs(b-0.49) > 1e-6 {
+		t.Errorf("expected k=44 b=0.49, got k=%f b=%f", math.Exp(a), b)
+	}
+
+}
+
+func TestNewReport(t *testing.T) {
+
+	terms := []termPostings{
+		{term: "the", docs: []int{0, 1}, frequencies: []int{3, 1}, positions: 4},
+		{term: "say", docs: []int{1}, frequencies: []int{2}, positions: 2},
+		{term: "mean", docs: []int{0}, frequencies: []int{1}, positions: 1},
+	}
+
+	r := newReport(terms)
+
+	if r.Documents != 2 || r.Tokens != 7 || r.Terms != 3 || r.Singletons != 1 {
+		t.Errorf("unexpected counts %+v", r)
+	}
+	if r.Ranks[0].Term != "the" || r.Ranks[0].CollectionFrequency != 4 {
+		t.Errorf("unexpected top term %+v", r.Ranks[0])
+	}
+
+	// doc 0 brings "the" and "mean", doc 1 brings "say"
+	last := r.Heaps.Points[len(r.Heaps.Points)-1]
+	if r.Heaps.Points[0].Vocabulary != 2 || last.Vocabulary != 3 || last.Tokens != 7 {
+		t.Errorf("unexpected Heaps' curve %v", r.Heaps.Points)
+	}
+	if positions := r.PostingsSize[len(r.PostingsSize)-1]; positions.Bytes != 7 {
+		t.Errorf("expected 7 bytes of positions, got %+v", positions)
+	}
+
+}
+
+func TestFromSegments(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "statistics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bt, err := spimi.Spimi("../spimi/data", filepath.Join(dir, "index.dat"), 32<<20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := FromBlockTree(bt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Documents != 2 {
+		t.Fatalf("expected 2 documents, got %d", all.Documents)
+	}
+
+	// text1.txt is deleted, its terms like syme are gone
+	deleted := corpus.NewBitmap()
+	deleted.Set(0)
+	r, err := FromSegments([]*corpus.BlockTree{bt}, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Documents != 1 || r.Terms >= all.Terms || r.Tokens >= all.Tokens {
+		t.Errorf("expected only text2.txt counted, got %+v", r)
+	}
+	// positions are counted from their encoded bytes
+	if positions, kept := all.PostingsSize[3].Bytes, r.PostingsSize[3].Bytes; kept == 0 || kept >= positions {
+		t.Errorf("expected fewer positions of text2.txt than of both documents, got %d and %d", kept, positions)
+	}
+	for _, rank := range r.Ranks {
+		if rank.Term == "Syme" {
+			t.Errorf("term of the deleted document is counted %+v", rank)
+		}
+	}
+
+}
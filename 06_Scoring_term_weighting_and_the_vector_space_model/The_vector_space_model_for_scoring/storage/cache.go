@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"../corpus"
+	"container/list"
+	"strings"
+	"sync"
+)
+
+const (
+	// budget of the shared postings cache
+	postingsCacheSize = 64 << 20
+	// rough memory used by one decoded document entry without its strings and positions
+	docEntrySize = 48
+)
+
+// Cache keeps decoded postings of the most recently queried terms.
+// It is shared by all ranking functions.
+var Cache = NewPostingsCache(postingsCacheSize)
+
+// PostingsCache is LRU cache of decoded postings lists keyed by term.
+// The size is bounded by the approximate amount of bytes of cached postings.
+// Cached tokens are shared between queries and must not be modified.
+type PostingsCache struct {
+	capacity int
+	size     int
+	items    map[string]*list.Element
+	order    *list.List
+	hits     uint64
+	misses   uint64
+	mutex    *sync.Mutex
+}
+
+type cacheEntry struct {
+	term  string
+	token corpus.SerializedToken
+	size  int
+}
+
+// CacheStats is a snapshot of cache counters
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Terms    int
+	Size     int
+	Capacity int
+}
+
+// Part of lookups served from the cache
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// New cache that holds up to capacity bytes of postings
+func NewPostingsCache(capacity int) *PostingsCache {
+	return &PostingsCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Get postings of the term and mark it as recently used
+func (c *PostingsCache) Get(term string) (corpus.SerializedToken, bool) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.items[term]; ok {
+		c.hits++
+		c.order.MoveToFront(e)
+		return e.Value.(*cacheEntry).token, true
+	}
+
+	c.misses++
+
+	return corpus.SerializedToken{}, false
+
+}
+
+// Put postings of the term, least recently used terms are evicted to fit the capacity
+func (c *PostingsCache) Put(term string, token corpus.SerializedToken) {
+
+	size := tokenSize(token)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.items[term]; ok {
+		c.remove(e)
+	}
+
+	// postings list bigger than the whole cache would flush everything
+	if size > c.capacity {
+		return
+	}
+
+	for c.size+size > c.capacity {
+		c.remove(c.order.Back())
+	}
+
+	c.items[term] = c.order.PushFront(&cacheEntry{term, token, size})
+	c.size += size
+
+}
+
+func (c *PostingsCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.items, entry.term)
+	c.size -= entry.size
+}
+
+// Drop all cached postings, counters are kept
+func (c *PostingsCache) Purge() {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+
+}
+
+// Drop cached postings of the block file, other blocks are kept
+func (c *PostingsCache) Evict(block string) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	prefix := block + "\x00"
+	for key, e := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+		}
+	}
+
+}
+
+// Change the capacity, extra terms are evicted right away
+func (c *PostingsCache) Resize(capacity int) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.capacity = capacity
+	for c.size > c.capacity {
+		c.remove(c.order.Back())
+	}
+
+}
+
+// Reset hit and miss counters
+func (c *PostingsCache) ResetStats() {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.hits, c.misses = 0, 0
+
+}
+
+func (c *PostingsCache) Stats() CacheStats {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Terms:    len(c.items),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+
+}
+
+// Approximate memory used by decoded postings
+func tokenSize(token corpus.SerializedToken) int {
+
+	size := len(token.Term) + len(token.DocIDs) + docEntrySize
+
+	for _, d := range token.Docs {
+		size += docEntrySize + len(d.File) + len(d.Positions)
+	}
+
+	return size
+
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"../corpus"
+	"testing"
+)
+
+func TestPostingsCache(t *testing.T) {
+
+	token := func(term string) corpus.SerializedToken {
+		return corpus.SerializedToken{
+			Term: term,
+			Docs: []corpus.SerializedDoc{{DocID: 1, File: "doc", Positions: corpus.EncodePositions([]int{1})}},
+		}
+	}
+
+	size := tokenSize(token("a"))
+	c := NewPostingsCache(2 * size)
+
+	c.Put("a", token("a"))
+	c.Put("b", token("b"))
+
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+
+	// b is the least recently used now
+	c.Put("c", token("c"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("expected c to be cached")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Terms != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.Size > stats.Capacity {
+		t.Errorf("cache is over capacity %+v", stats)
+	}
+
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"../corpus"
+	"path/filepath"
+	"testing"
+)
+
+// Doc ID lists of every term of the SPIMI index built from spimi/data in a temp dir
+func postingsLists(b *testing.B) [][]int {
+
+	dir := b.TempDir()
+	if err := buildStorage("../spimi/data", filepath.Join(dir, "index.dat"), nil); err != nil {
+		b.Fatal(err)
+	}
+	index, err := OpenIndex(dir, auxiliaryDocuments)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer index.Close()
+	snapshot := index.Snapshot()
+	defer snapshot.Release()
+
+	lists := make([][]int, 0)
+	seen := make(map[string]bool)
+	for _, bt := range snapshot.Segments() {
+		for _, v := range bt.Values() {
+			block := v.(string)
+			if seen[block] {
+				continue
+			}
+			seen[block] = true
+			sc, err := DeserializeBlock(block)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, token := range sc.Tokens {
+				ids := make([]int, len(token.Docs))
+				for i, d := range token.Docs {
+					ids[i] = d.DocID
+				}
+				lists = append(lists, ids)
+			}
+		}
+	}
+
+	if len(lists) == 0 {
+		b.Skip("index is empty")
+	}
+
+	b.ResetTimer()
+
+	return lists
+
+}
+
+func BenchmarkEncodeVB(b *testing.B) {
+	lists := postingsLists(b)
+	size := 0
+	for n := 0; n < b.N; n++ {
+		size = 0
+		for _, ids := range lists {
+			size += len(corpus.VBEncodeGaps(ids))
+		}
+	}
+	b.ReportMetric(float64(size), "bytes")
+}
+
+func BenchmarkEncodePFor(b *testing.B) {
+	lists := postingsLists(b)
+	size := 0
+	for n := 0; n < b.N; n++ {
+		size = 0
+		for _, ids := range lists {
+			size += len(corpus.EncodePFor(ids))
+		}
+	}
+	b.ReportMetric(float64(size), "bytes")
+}
+
+func BenchmarkDecodeVB(b *testing.B) {
+	lists := postingsLists(b)
+	encoded := make([][]byte, len(lists))
+	for i, ids := range lists {
+		encoded[i] = corpus.VBEncodeGaps(ids)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, data := range encoded {
+			corpus.VBDecodeGaps(data, len(lists[i]))
+		}
+	}
+}
+
+func BenchmarkDecodePFor(b *testing.B) {
+	lists := postingsLists(b)
+	encoded := make([]corpus.PForList, len(lists))
+	for i, ids := range lists {
+		encoded[i] = corpus.EncodePFor(ids)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, pl := range encoded {
+			it := pl.Iterator()
+			for it.Next() {
+				if _, err := it.Values(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"../corpus"
+	"errors"
+)
+
+// Errors returned by storage functions, match them with errors.Is.
+// Errors of several independent parts, like query terms, come as *corpus.PartialError
+// along with the results of the parts that did not fail.
+var (
+	ErrTermNotFound      = corpus.ErrTermNotFound
+	ErrCorruptBlock      = corpus.ErrCorruptBlock
+	ErrMissingSegment    = corpus.ErrMissingSegment
+	ErrDocumentNotFound  = corpus.ErrDocumentNotFound
+	ErrDuplicateDocument = corpus.ErrDuplicateDocument
+	ErrInvalidPolicy     = errors.New("storage: invalid merge policy")
+)
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"../corpus"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	if _, err := OpenStorage(filepath.Join(dir, "index.dat")); !errors.Is(err, ErrMissingSegment) {
+		t.Errorf("expected missing segment, got %v", err)
+	}
+
+	if _, err := DeserializeBlock(filepath.Join(dir, "block0.dat")); !errors.Is(err, ErrMissingSegment) {
+		t.Errorf("expected missing segment, got %v", err)
+	}
+
+	block := filepath.Join(dir, "block1.dat")
+	sc := &corpus.SerializedCorpus{Tokens: []corpus.SerializedToken{{Term: "say", Docs: []corpus.SerializedDoc{{DocID: 0}}}}}
+	data := sc.ToBlockFile()
+
+	if _, err := DeserializeTerm("mean", writeBlock(t, block, data)); !errors.Is(err, ErrTermNotFound) {
+		t.Errorf("expected term not found, got %v", err)
+	}
+
+	corrupted := filepath.Join(dir, "block2.dat")
+	data[len(data)-1] ^= 1
+	if _, err := DeserializeBlock(writeBlock(t, corrupted, data)); !errors.Is(err, ErrCorruptBlock) || !errors.Is(err, corpus.ErrChecksumMismatch) {
+		t.Errorf("expected corrupt block, got %v", err)
+	}
+
+	// the query goes on without the broken term
+	bt := corpus.NewBlockTree(corpus.NewDocumentTree())
+	bt.Put("say", block)
+	bt.Put("mean", corrupted)
+	index := NewIndex(bt, filepath.Join(dir, "index.dat"), 1)
+	defer index.Close()
+	_, err = CosineScore(index, "say mean", 10)
+	var partial *corpus.PartialError
+	if !errors.As(err, &partial) || len(partial.Errors) != 1 || !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("expected partial failure of one term, got %v", err)
+	}
+
+}
+
+// A postings entry that can not be decoded is corruption, not an absent term
+func TestCorruptPostingsEntry(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	sc := &corpus.SerializedCorpus{Tokens: []corpus.SerializedToken{
+		{Term: "mean", Docs: []corpus.SerializedDoc{{DocID: 0, File: "text1.txt", Frequency: 1}}},
+		{Term: "say", Docs: []corpus.SerializedDoc{{DocID: 0, File: "text1.txt", Frequency: 1}}},
+	}}
+	postings := sc.ToBlock()
+
+	// bytes after the term never end a uvarint, the section checksum still matches
+	entry := bytes.Index(postings, []byte("\x03say")) + 4
+	for i := entry; i < entry+11; i++ {
+		postings[i] = 0xff
+	}
+	block := writeBlock(t, filepath.Join(dir, "block0.dat"), corpus.EncodeFile(corpus.KindBlock, corpus.Section{ID: corpus.SectionPostings, Data: postings}))
+
+	if _, err := DeserializeTerm("say", block); !errors.Is(err, ErrCorruptBlock) || errors.Is(err, ErrTermNotFound) {
+		t.Errorf("expected corrupt block, got %v", err)
+	}
+	if token, err := DeserializeTerm("mean", block); err != nil || len(token.Docs) != 1 {
+		t.Errorf("expected the other term decoded, got %v, %v", token, err)
+	}
+
+	bt := corpus.NewBlockTree(corpus.NewDocumentTree())
+	bt.Put("mean", block)
+	bt.Put("say", block)
+	index := NewIndex(bt, filepath.Join(dir, "index.dat"), 1)
+	defer index.Close()
+	if _, err := CosineScore(index, "say", 10); !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("expected the query to report the corrupt term, got %v", err)
+	}
+
+}
+
+func writeBlock(t *testing.T, path string, data []byte) string {
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
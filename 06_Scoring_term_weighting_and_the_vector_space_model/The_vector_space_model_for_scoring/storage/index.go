@@ -0,0 +1,592 @@
+package storage
+
+import (
+	"../corpus"
+	"../spimi"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//Page 79:
+//LMERGEADDTOKEN(indexes, Z0, token)
+//1  Z0 <- MERGE(Z0, {token})
+//2  if |Z0| = n
+//3    then for i <- 0 to ∞
+//4         do if Ii ∈ indexes
+//5              then Zi+1 <- MERGE(Ii, Zi)
+//6                   (Zi+1 is a temporary index on disk.)
+//7                   indexes <- indexes − {Ii}
+//8              else Ii <- Zi (Zi becomes the permanent index Ii.)
+//9                   indexes <- indexes ∪ {Ii}
+//10                  BREAK
+//11        Z0 <- ∅
+//Each posting is merged O(log T) times, there are at most log T indexes to search.
+
+// Index is made of immutable segments listed by the commit point: the main index built
+// by SPIMI and segments of documents added after the build. New documents go to the
+// in-memory auxiliary index Z0, a full Z0 is written to disk as a new segment.
+// Like the indexes Ii of logarithmic merging, segments of similar size are merged
+// by the background scheduler as the MergePolicy says, so the writer never waits for them.
+// Writers build new segments aside and publish them with a new commit point, readers
+// search a snapshot of the segments, so queries never wait for writes.
+// Deleted documents stay in their segments until the segment is merged, queries skip them.
+type Index struct {
+	dir      string
+	auxLimit int
+	sequence int
+	current  *Snapshot
+	policy   MergePolicy
+	// gives IDs of new documents and knows their paths and titles
+	registry *corpus.Registry
+	// split added files into documents
+	parsers corpus.ParserConfig
+	// changes of Z0, nil when Z0 is not logged
+	log *writeAheadLog
+	// segments of running merges and the number of merges
+	merging  map[*segment]bool
+	merges   int
+	mergeErr error
+	// requests to the scheduler and its stop
+	pending chan struct{}
+	done    chan struct{}
+	// scheduler and merges
+	running *sync.WaitGroup
+	// one writer at a time, it guards the merge state too
+	writer *sync.Mutex
+	// guards current and reference counts
+	mutex *sync.Mutex
+}
+
+// Commit point is replaced atomically, so it always lists complete segments
+const commitFile = "commit.dat"
+
+// The scheduler is started right away, Close stops it
+func newIndex(dir string, auxLimit int) *Index {
+
+	index := &Index{
+		dir:      dir,
+		auxLimit: auxLimit,
+		policy:   DefaultMergePolicy,
+		merging:  make(map[*segment]bool),
+		pending:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		running:  &sync.WaitGroup{},
+		writer:   &sync.Mutex{},
+		mutex:    &sync.Mutex{},
+	}
+
+	index.running.Add(1)
+	go index.schedule()
+
+	return index
+
+}
+
+// Wrap the main index of indexFile, segments written later go to the same dir.
+// Z0 is merged to disk when it holds auxLimit documents. Z0 is not logged,
+// so documents added to it are lost on a crash, OpenIndex gives an index with a log.
+func NewIndex(main *corpus.BlockTree, indexFile string, auxLimit int) *Index {
+
+	index := newIndex(filepath.Dir(indexFile), auxLimit)
+
+	// index files written before the registry know documents by ID only
+	index.registry = main.Registry
+	if index.registry == nil {
+		index.registry = corpus.NewRegistry()
+		for _, id := range main.Documents.Keys() {
+			index.registry.Put(corpus.DocumentInfo{ID: id.(int)})
+		}
+	}
+
+	index.publish(&Snapshot{
+		segments: []*segment{{BlockTree: main, indexFile: indexFile}},
+		deleted:  corpus.NewBitmap(),
+	})
+
+	return index
+
+}
+
+// Open segments of the last commit point in dir. Segments that are not listed
+// were left by writers that did not finish, they are removed.
+// Z0 is rebuilt from the write-ahead log, changes are logged from now on.
+func OpenIndex(dir string, auxLimit int) (*Index, error) {
+
+	path := filepath.Join(dir, commitFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
+	commit, err := corpus.ReadCommitPoint(data)
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
+
+	index := newIndex(dir, auxLimit)
+	index.registry = commit.Registry
+	index.sequence = commit.Sequence
+
+	snapshot := &Snapshot{deleted: corpus.NewBitmap()}
+	failed := &corpus.PartialError{}
+
+	for _, s := range commit.Segments {
+		bt, err := loadBTree(s.IndexFile)
+		if bt == nil {
+			index.Close()
+			return nil, err
+		}
+		failed.Add(err)
+		snapshot.segments = append(snapshot.segments, &segment{BlockTree: bt, indexFile: s.IndexFile})
+	}
+
+	// Z0 is not committed, bits of its documents are useless now
+	for _, id := range commit.Deleted.IDs() {
+		if snapshot.hasDocument(id) {
+			snapshot.deleted.Set(id)
+		}
+	}
+
+	log, records, err := openLog(dir)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	index.log = log
+	if snapshot, err = index.replay(snapshot, records); err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	// documents deleted after the commit point are forgotten only now
+	for _, info := range index.registry.Documents() {
+		if !snapshot.hasDocument(info.ID) {
+			index.registry.Remove(info.ID)
+		}
+	}
+
+	index.publish(snapshot)
+	removeOrphans(dir, commit)
+	// segments may be left unmerged by a writer that stopped
+	index.maybeMerge()
+
+	return index, failed.Err()
+
+}
+
+// Snapshot of the current segments, Z0 and deleted documents.
+// It stays the same while the index changes and must be released after use.
+func (index *Index) Snapshot() *Snapshot {
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.current.refs++
+
+	return index.current
+
+}
+
+// Make the snapshot current, it is referenced by the index until the next one comes
+func (index *Index) publish(s *Snapshot) {
+
+	s.index = index
+	s.refs = 1
+
+	index.mutex.Lock()
+	for _, seg := range s.segments {
+		seg.refs++
+		if seg.refs == 1 {
+			seg.acquire()
+		}
+	}
+	old := index.current
+	index.current = s
+	index.mutex.Unlock()
+
+	if old != nil {
+		old.Release()
+	}
+
+}
+
+// Path, title, length and times of the live document
+func (index *Index) Document(docID int) (corpus.DocumentInfo, bool) {
+	return index.registry.Get(docID)
+}
+
+// Original text and stored fields of the live document
+func (index *Index) StoredDocument(docID int) (corpus.StoredDocument, error) {
+
+	snapshot := index.Snapshot()
+	defer snapshot.Release()
+
+	return snapshot.document(docID)
+
+}
+
+// Save segments and deleted documents of the snapshot to the commit point
+func (index *Index) writeCommit(s *Snapshot) error {
+
+	commit := &corpus.CommitPoint{
+		Deleted:  s.deleted,
+		Registry: index.registry,
+		Sequence: index.sequence,
+	}
+	for _, seg := range s.segments {
+		commit.Segments = append(commit.Segments, corpus.CommitSegment{IndexFile: seg.indexFile})
+	}
+
+	data, err := commit.MarshalFile()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(index.dir, commitFile), data)
+
+}
+
+// Readers see the snapshot only after it survives restarts
+func (index *Index) commit(s *Snapshot) error {
+
+	if err := index.writeCommit(s); err != nil {
+		return err
+	}
+	index.publish(s)
+
+	return nil
+
+}
+
+// Read and parse documents of the file for Z0, they get IDs from docID on.
+// Content of the file goes to the log.
+func readFile(docID int, path string, config corpus.ParserConfig) ([]*memoryDocument, corpus.LogRecord, []corpus.DocumentInfo, error) {
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, corpus.LogRecord{}, nil, corpus.NewFileError(path, err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, corpus.LogRecord{}, nil, corpus.NewFileError(path, err)
+	}
+
+	record := corpus.LogRecord{
+		Op:       corpus.LogAdd,
+		DocID:    docID,
+		Path:     path,
+		Content:  content,
+		Parser:   config,
+		Added:    time.Now(),
+		Modified: stat.ModTime(),
+	}
+
+	documents, infos, err := parseRecord(record)
+	if err != nil {
+		return nil, corpus.LogRecord{}, nil, err
+	}
+
+	return documents, record, infos, nil
+
+}
+
+// Documents of the file added by the record, title and length of their registry entries come from parsing
+func parseRecord(r corpus.LogRecord) ([]*memoryDocument, []corpus.DocumentInfo, error) {
+
+	docs, err := corpus.ParseFile(r.Path, r.Content, r.Parser)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	documents := make([]*memoryDocument, len(docs))
+	infos := make([]corpus.DocumentInfo, len(docs))
+	for i, doc := range docs {
+		infos[i] = corpus.DocumentInfo{ID: r.DocID + i, Path: r.Path, Added: r.Added, Modified: r.Modified}
+		tokens, err := spimi.DescribeDocument(&infos[i], doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		documents[i] = newMemoryDocument(infos[i].ID, r.Path, doc, tokens)
+	}
+
+	return documents, infos, nil
+
+}
+
+// Make the change durable before readers see it: it is logged when the index
+// has a log, otherwise the commit point is written
+func (index *Index) persist(s *Snapshot, r corpus.LogRecord) error {
+
+	if index.log == nil {
+		return index.commit(s)
+	}
+
+	if err := index.log.append(r); err != nil {
+		return err
+	}
+	index.publish(s)
+
+	return nil
+
+}
+
+// Apply logged changes to the snapshot of the commit point. Documents that are
+// in the segments already were flushed before the writer stopped, they are skipped.
+func (index *Index) replay(s *Snapshot, records []corpus.LogRecord) (*Snapshot, error) {
+
+	inSegments := func(docID int) bool {
+		for _, seg := range s.segments {
+			if _, ok := seg.Documents.Get(docID); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, r := range records {
+		if r.Op == corpus.LogAdd {
+			documents, infos, err := parseRecord(r)
+			if err != nil {
+				return nil, err
+			}
+			for i, d := range documents {
+				if !inSegments(d.id) {
+					s = s.withDocuments([]*memoryDocument{d})
+					index.registry.Put(infos[i])
+				}
+			}
+		}
+
+		deleted := r.Deleted
+		if r.Op == corpus.LogDelete {
+			deleted = []int{r.DocID}
+		}
+		// documents dropped by a merge are not in the snapshot anymore
+		for _, id := range deleted {
+			if s.hasDocument(id) {
+				s.deleted.Set(id)
+			}
+		}
+	}
+
+	return s, nil
+
+}
+
+// Parse documents of the file into Z0, returns ID of the first document or -1 when the file
+// can not be read. Other documents of the file get the IDs that follow it.
+// When merging Z0 to disk fails the documents stay searchable in Z0, the merge is retried
+// on the next add.
+func (index *Index) AddDocument(path string) (int, error) {
+
+	index.writer.Lock()
+	defer index.writer.Unlock()
+
+	docID := index.registry.NextID()
+
+	documents, record, infos, err := readFile(docID, path, index.parsers)
+	if err != nil {
+		return -1, err
+	}
+
+	// the registry is committed along with the change
+	index.register(infos)
+	if err := index.persist(index.current.withDocuments(documents), record); err != nil {
+		index.unregister(infos)
+		return -1, err
+	}
+
+	return docID, index.mergeIfFull()
+
+}
+
+// Documents of one file are registered together
+func (index *Index) register(infos []corpus.DocumentInfo) {
+	for _, info := range infos {
+		index.registry.Put(info)
+	}
+}
+
+func (index *Index) unregister(infos []corpus.DocumentInfo) {
+	for _, info := range infos {
+		index.registry.Remove(info.ID)
+	}
+}
+
+// Parsers of files added after the call, Format of the config names the parser of every file,
+// otherwise extensions pick them
+func (index *Index) SetParserConfig(config corpus.ParserConfig) {
+
+	index.writer.Lock()
+	index.parsers = config
+	index.writer.Unlock()
+
+}
+
+// Add every file of the dir, files that can not be read are skipped
+// and reported by *corpus.PartialError along with IDs of the added ones
+func (index *Index) AddDirectory(dir string) ([]int, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, corpus.NewFileError(dir, err)
+	}
+
+	ids := make([]int, 0, len(files))
+	failed := &corpus.PartialError{}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		id, err := index.AddDocument(filepath.Join(dir, f.Name()))
+		failed.Add(err)
+		// a failed merge still leaves the document in Z0
+		if id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, failed.Err()
+
+}
+
+// Mark the document as deleted, it is removed from disk when its segment is merged
+func (index *Index) DeleteDocument(docID int) error {
+
+	index.writer.Lock()
+	defer index.writer.Unlock()
+
+	if !index.current.hasDocument(docID) {
+		return fmt.Errorf("%w: %d", ErrDocumentNotFound, docID)
+	}
+
+	snapshot := index.current.derive()
+	snapshot.deleted = snapshot.deleted.Clone()
+	snapshot.deleted.Set(docID)
+
+	if err := index.persist(snapshot, corpus.LogRecord{Op: corpus.LogDelete, DocID: docID}); err != nil {
+		return err
+	}
+	index.registry.Remove(docID)
+	// mostly deleted segments are rewritten
+	index.maybeMerge()
+
+	return nil
+
+}
+
+// Reindex the changed file: documents of the new version get new IDs, every old version is deleted.
+// Returns the first new ID, an unreadable file leaves the old versions as they are.
+func (index *Index) UpdateDocument(path string) (int, error) {
+
+	index.writer.Lock()
+	defer index.writer.Unlock()
+
+	docID := index.registry.NextID()
+
+	documents, record, infos, err := readFile(docID, path, index.parsers)
+	if err != nil {
+		return -1, err
+	}
+
+	// readers see either the old version or the new one
+	snapshot := index.current.withDocuments(documents)
+	snapshot.deleted = snapshot.deleted.Clone()
+	for _, id := range index.current.documentIDs(path) {
+		snapshot.deleted.Set(id)
+		record.Deleted = append(record.Deleted, id)
+	}
+
+	// a change that is not durable still takes its IDs, they are not given again
+	index.register(infos)
+	if err := index.persist(snapshot, record); err != nil {
+		index.unregister(infos)
+		return -1, err
+	}
+	for _, id := range record.Deleted {
+		index.registry.Remove(id)
+	}
+
+	return docID, index.mergeIfFull()
+
+}
+
+func (index *Index) mergeIfFull() error {
+
+	if len(index.current.memory) < index.auxLimit {
+		return nil
+	}
+
+	return index.flush()
+
+}
+
+// Write Z0 to a new segment, the scheduler decides when it is merged further
+func (index *Index) flush() error {
+
+	current := index.current
+
+	sources := make([]corpus.TokenIterator, 0, len(current.memory))
+	documents := corpus.NewDocumentTree()
+	store := corpus.NewDocumentStore()
+
+	// Z0 is read back like temp blocks of SPIMI
+	for _, d := range current.memory {
+		run, err := corpus.NewRunReader(bytes.NewReader(d.corpus.ToRunFile()))
+		if err != nil {
+			return err
+		}
+		if err := store.Put(d.stored()); err != nil {
+			return err
+		}
+		sources = append(sources, run)
+		d.corpus.Documents.Each(func(key, value interface{}) {
+			documents.Put(key, normalize(value.(corpus.DocumentIndex)))
+		})
+	}
+
+	index.sequence++
+	indexFile := filepath.Join(index.dir, fmt.Sprintf("segment%d", index.sequence), "index.dat")
+
+	// nil segment means every document of Z0 was deleted
+	seg, err := writeSegment(indexFile, documents, sources, store, current.deleted)
+	if seg == nil && err != nil {
+		return err
+	}
+	failpoint("flush:segment")
+
+	snapshot := &Snapshot{segments: current.segments, deleted: current.deleted.Clone()}
+	if seg != nil {
+		snapshot.segments = append(current.segments[:len(current.segments):len(current.segments)], seg)
+	}
+
+	// deleted documents of Z0 are gone for good
+	documents.Each(func(key, value interface{}) {
+		snapshot.deleted.Clear(key.(int))
+	})
+
+	if err := index.commit(snapshot); err != nil {
+		if seg != nil {
+			seg.remove()
+		}
+		return err
+	}
+	failpoint("flush:commit")
+
+	// a crash before the log is cut replays documents that are in the segment already,
+	// replay skips them
+	if index.log != nil {
+		if err := index.log.truncate(); err != nil {
+			return err
+		}
+	}
+	index.maybeMerge()
+
+	return err
+
+}
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"../spimi"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Main index of spimi/data in a temp dir, Z0 holds one document only
+func newTestIndex(t *testing.T) (*Index, string) {
+
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, err := spimi.Spimi("../spimi/data", filepath.Join(dir, "index.dat"), memoryBudget, termsInBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changes are logged like in the storage
+	built := NewIndex(bt, filepath.Join(dir, "index.dat"), 1)
+	err = built.writeCommit(built.current)
+	built.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := OpenIndex(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return index, dir
+
+}
+
+// Current snapshot, background merges may replace it meanwhile
+func current(index *Index) *Snapshot {
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	return index.current
+
+}
+
+// Segments of the current snapshot written after the main index
+func added(index *Index) []*segment {
+	return current(index).segments[1:]
+}
+
+func TestAddDocument(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	docs := filepath.Join(dir, "docs")
+	os.Mkdir(docs, 0777)
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(docs, fmt.Sprintf("new%d.txt", i)), []byte(fmt.Sprintf("what did zebra%d say", i)), 0666)
+	}
+
+	ids, err := index.AddDirectory(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != 2 {
+		t.Fatalf("expected IDs to continue the main index, got %v", ids)
+	}
+
+	// Z0 holds one document, every document is flushed to its own segment
+	segments := added(index)
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 segments, got %v", segments)
+	}
+	if n := segments[2].Documents.Size(); n != 1 {
+		t.Errorf("expected 1 document in a segment, got %d", n)
+	}
+
+	fourth := filepath.Join(dir, "new3.txt")
+	ioutil.WriteFile(fourth, []byte("what did zebra3 say"), 0666)
+	id, err := index.AddDocument(fourth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current(index).memory) != 0 {
+		t.Fatalf("expected Z0 of document %d to be flushed", id)
+	}
+	if segments := added(index); len(segments) != 4 {
+		t.Errorf("expected segments to wait for the policy, got %v", segments)
+	}
+	if n := current(index).docsNum(); n != 6 {
+		t.Errorf("expected 6 documents, got %d", n)
+	}
+
+	res, err := ITFScore(index, "zebra1", "say")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].File != filepath.Join(docs, "new1.txt") {
+		t.Errorf("expected new1.txt, got %v", res)
+	}
+
+	// added documents and the main index are ranked together
+	res, err = CosineScore(index, "What did", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 6 {
+		t.Errorf("expected every document, got %v", res)
+	}
+	res, err = CosineScore(index, "zebra3", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].File != fourth {
+		t.Errorf("expected new3.txt, got %v", res)
+	}
+
+	matches, err := PositionalIntersect(index, "zebra2", "say", 1)
+	if err != nil || len(matches) != 1 || matches[0].DocID != ids[2] {
+		t.Errorf("expected zebra2 next to say in one document, got %v, %v", matches, err)
+	}
+
+}
+
+func TestAddDocumentMissing(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	if id, err := index.AddDocument(filepath.Join(dir, "missing.txt")); id != -1 || err == nil {
+		t.Errorf("expected missing document to fail, got %d, %v", id, err)
+	}
+	if next := index.registry.NextID(); next != 2 {
+		t.Errorf("expected failed document to keep its ID free, got %d", next)
+	}
+
+}
+
+func TestDeleteDocument(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	if err := index.DeleteDocument(0); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := CosineScore(index, "What did", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].File != "../spimi/data/text2.txt" {
+		t.Errorf("expected text2.txt only, got %v", res)
+	}
+
+	matches, err := PositionalIntersect(index, "mean", "say", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		if m.DocID == 0 {
+			t.Errorf("unexpected match in deleted document %v", m)
+		}
+	}
+
+	for _, id := range []int{0, 99} {
+		if err := index.DeleteDocument(id); !errors.Is(err, ErrDocumentNotFound) {
+			t.Errorf("expected document %d not to be found, got %v", id, err)
+		}
+	}
+
+	// deletions survive reopening
+	reopened, err := OpenIndex(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if deleted := current(reopened).deleted; !deleted.Contains(0) || deleted.Count() != 1 {
+		t.Errorf("expected document 0 to stay deleted, got %v", deleted.IDs())
+	}
+
+}
+
+func TestUpdateDocument(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	path := filepath.Join(dir, "new.txt")
+	ioutil.WriteFile(path, []byte("what did zebra say"), 0666)
+	old, err := index.AddDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path, []byte("what did giraffe say"), 0666)
+	id, err := index.UpdateDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == old {
+		t.Fatal("expected new version to get a new ID")
+	}
+
+	if res, _ := CosineScore(index, "zebra", 10); len(res) != 0 {
+		t.Errorf("expected old version to be gone, got %v", res)
+	}
+	if res, _ := CosineScore(index, "giraffe", 10); len(res) != 1 || res[0].File != path {
+		t.Errorf("expected new version, got %v", res)
+	}
+
+	// the old version stays on disk until its segment is merged
+	index.SetMergePolicy(mergeAll)
+	waitMerges(t, index)
+
+	segments := current(index).segments
+	if len(segments) != 1 {
+		t.Fatalf("expected one merged segment, got %v", segments)
+	}
+	if _, ok := segments[0].Files[old]; ok {
+		t.Errorf("expected old version to be removed from disk, got %v", segments[0].Files)
+	}
+	if _, ok := segments[0].Get("zebra"); ok {
+		t.Error("expected postings of the old version to be removed from disk")
+	}
+	if current(index).deleted.Contains(old) {
+		t.Error("expected bit of the removed document to be cleared")
+	}
+
+}
+
+func TestOpenIndex(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	ids := make([]int, 2)
+	for i := range ids {
+		path := filepath.Join(dir, fmt.Sprintf("new%d.txt", i))
+		ioutil.WriteFile(path, []byte(fmt.Sprintf("what did zebra%d say", i)), 0666)
+		id, err := index.AddDocument(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+
+	// a writer died before its commit point was written
+	orphan := filepath.Join(dir, "segment99")
+	os.Mkdir(orphan, 0777)
+	ioutil.WriteFile(filepath.Join(orphan, "index.dat"), []byte("partial"), 0666)
+
+	reopened, err := OpenIndex(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected orphan segment to be removed, got %v", err)
+	}
+	if reopened.registry.NextID() != index.registry.NextID() || reopened.sequence != index.sequence {
+		t.Errorf("expected counters %d, %d, got %d, %d", index.registry.NextID(), index.sequence, reopened.registry.NextID(), reopened.sequence)
+	}
+	info, ok := reopened.Document(ids[1])
+	if !ok || info.Path != filepath.Join(dir, "new1.txt") || info.Title != "what did zebra1 say" || info.Length != 4 || info.Added.IsZero() {
+		t.Errorf("expected registered new1.txt, got %v, %v", info, ok)
+	}
+	if segments := added(reopened); len(segments) != 2 {
+		t.Errorf("expected 2 segments, got %v", segments)
+	}
+
+	res, err := CosineScore(reopened, "zebra1", 10)
+	if err != nil || len(res) != 1 {
+		t.Errorf("expected committed document to be found, got %v, %v", res, err)
+	}
+
+	if _, err := OpenIndex(filepath.Join(dir, "missing"), 1); err == nil {
+		t.Error("expected dir without commit point to fail")
+	}
+
+}
+
+func TestStoredDocument(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	text, _ := ioutil.ReadFile("../spimi/data/text2.txt")
+	if doc, err := index.StoredDocument(1); err != nil || doc.Text != string(text) || doc.Path != "../spimi/data/text2.txt" {
+		t.Errorf("expected text2.txt from the main index, got %v, %v", doc, err)
+	}
+
+	path := filepath.Join(dir, "new.txt")
+	ioutil.WriteFile(path, []byte("what did zebra say"), 0666)
+	id, err := index.AddDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file is not read again, the text comes from the store of the flushed segment
+	os.Remove(path)
+	res, err := CosineScore(index, "zebra", 10)
+	if err != nil || len(res) != 1 || res[0].DocID != id || res[0].Content != "what did zebra say" {
+		t.Errorf("expected text of new.txt in the result, got %v, %v", res, err)
+	}
+
+	if err := index.DeleteDocument(0); err != nil {
+		t.Fatal(err)
+	}
+	index.SetMergePolicy(mergeAll)
+	waitMerges(t, index)
+
+	// merged segment keeps the text of live documents only
+	segments := current(index).segments
+	if len(segments) != 1 || segments[0].Store == nil || segments[0].Store.Contains(0) {
+		t.Fatalf("expected one merged segment without the deleted document, got %v", segments)
+	}
+	if doc, err := index.StoredDocument(id); err != nil || doc.Text != "what did zebra say" {
+		t.Errorf("expected text of new.txt after the merge, got %v, %v", doc, err)
+	}
+	if _, err := index.StoredDocument(0); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected deleted document to be gone, got %v", err)
+	}
+
+}
+
+// Close unmaps blocks of the index only, once snapshots taken before are released
+func TestCloseReleasesMappings(t *testing.T) {
+
+	first, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	second, other := newTestIndex(t)
+	defer os.RemoveAll(other)
+	defer second.Close()
+
+	for _, index := range []*Index{first, second} {
+		if _, err := CosineScore(index, "what did", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mappedIn(dir) == 0 || mappedIn(other) == 0 {
+		t.Fatal("expected blocks of both indexes mapped")
+	}
+
+	snapshot := first.Snapshot()
+	first.Close()
+	if mappedIn(dir) == 0 {
+		t.Error("expected blocks mapped while the snapshot is used")
+	}
+	if _, err := snapshot.postings("what"); err != nil {
+		t.Errorf("expected the snapshot readable after Close, got %v", err)
+	}
+
+	snapshot.Release()
+	if n := mappedIn(dir); n != 0 {
+		t.Errorf("expected blocks of the closed index unmapped, got %d", n)
+	}
+	if mappedIn(other) == 0 {
+		t.Error("expected blocks of the other index kept")
+	}
+	if res, err := CosineScore(second, "what did", 10); err != nil || len(res) != 2 {
+		t.Errorf("expected the other index still answers, got %v, %v", res, err)
+	}
+
+}
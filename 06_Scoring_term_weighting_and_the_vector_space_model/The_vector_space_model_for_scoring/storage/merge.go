@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"../corpus"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+)
+
+// MergePolicy decides which segments are merged in the background.
+// Segments are put into tiers by size, tier i holds segments of up to
+// FloorSegmentDocs * SegmentsPerTier^(i+1) documents. A tier with too many
+// segments is merged into one segment of the next tier, so there are at most
+// SegmentsPerTier segments in each of log(N) tiers.
+type MergePolicy struct {
+	// Segments a tier holds before they are merged
+	SegmentsPerTier int
+	// Most segments merged into one at once
+	MaxMergeAtOnce int
+	// Merges running at the same time
+	MaxConcurrentMerges int
+	// Merged segment never gets more live documents, larger segments are merged only to drop deleted ones
+	MaxSegmentDocs int
+	// Smaller segments are counted as this size, so small flushes of Z0 share the first tier
+	FloorSegmentDocs int
+	// Segment with a larger share of deleted documents is rewritten alone
+	MaxDeletedRatio float64
+}
+
+var DefaultMergePolicy = MergePolicy{
+	SegmentsPerTier:     10,
+	MaxMergeAtOnce:      10,
+	MaxConcurrentMerges: 1,
+	MaxSegmentDocs:      1 << 20,
+	FloorSegmentDocs:    auxiliaryDocuments,
+	MaxDeletedRatio:     0.5,
+}
+
+// Size of a segment as the policy sees it
+type segmentSize struct {
+	live    int
+	deleted int
+}
+
+// Documents of every segment of the snapshot that are alive and deleted
+func (s *Snapshot) sizes() []segmentSize {
+
+	sizes := make([]segmentSize, len(s.segments))
+	for i, seg := range s.segments {
+		sizes[i].live = seg.Documents.Size()
+	}
+
+	for _, id := range s.deleted.IDs() {
+		for i, seg := range s.segments {
+			if _, ok := seg.Documents.Get(id); ok {
+				sizes[i].live--
+				sizes[i].deleted++
+				break
+			}
+		}
+	}
+
+	return sizes
+
+}
+
+// Tiers need a base above 1 and a floor above 0, a merge needs two segments at least
+func (p MergePolicy) validate() error {
+
+	switch {
+	case p.SegmentsPerTier <= 1:
+		return fmt.Errorf("%w: SegmentsPerTier is %d, must be above 1", ErrInvalidPolicy, p.SegmentsPerTier)
+	case p.FloorSegmentDocs <= 0:
+		return fmt.Errorf("%w: FloorSegmentDocs is %d, must be above 0", ErrInvalidPolicy, p.FloorSegmentDocs)
+	case p.MaxMergeAtOnce < 2:
+		return fmt.Errorf("%w: MaxMergeAtOnce is %d, must be 2 or more", ErrInvalidPolicy, p.MaxMergeAtOnce)
+	}
+
+	return nil
+
+}
+
+// Tier of the segment, the policy must be valid
+func (p MergePolicy) tier(size segmentSize) int {
+
+	docs := math.Max(float64(size.live), float64(p.FloorSegmentDocs))
+
+	return int(math.Log(docs/float64(p.FloorSegmentDocs)) / math.Log(float64(p.SegmentsPerTier)))
+
+}
+
+// Indexes of segments to merge next or nil. Busy segments are being merged already.
+// The lowest full tier goes first, its smallest segments are merged while
+// the result fits MaxSegmentDocs. Segments that are mostly deleted come after.
+func (p MergePolicy) findMerge(sizes []segmentSize, busy []bool) []int {
+
+	tiers := make(map[int][]int)
+	for i, size := range sizes {
+		// a half full segment can not be merged with a similar one
+		if busy[i] || size.live > p.MaxSegmentDocs/2 {
+			continue
+		}
+		tier := p.tier(size)
+		tiers[tier] = append(tiers[tier], i)
+	}
+
+	levels := make([]int, 0, len(tiers))
+	for tier := range tiers {
+		levels = append(levels, tier)
+	}
+	sort.Ints(levels)
+
+	for _, tier := range levels {
+		candidates := tiers[tier]
+		if len(candidates) < p.SegmentsPerTier {
+			continue
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return sizes[candidates[i]].live < sizes[candidates[j]].live })
+
+		merge := make([]int, 0, p.MaxMergeAtOnce)
+		docs := 0
+		for _, i := range candidates {
+			if len(merge) == p.MaxMergeAtOnce || docs+sizes[i].live > p.MaxSegmentDocs {
+				break
+			}
+			merge = append(merge, i)
+			docs += sizes[i].live
+		}
+		if len(merge) > 1 {
+			return merge
+		}
+	}
+
+	for i, size := range sizes {
+		total := size.live + size.deleted
+		if !busy[i] && size.deleted > 0 && float64(size.deleted) > p.MaxDeletedRatio*float64(total) {
+			return []int{i}
+		}
+	}
+
+	return nil
+
+}
+
+// Set the policy for merges started from now on, an invalid policy is ErrInvalidPolicy
+// and the current one is kept
+func (index *Index) SetMergePolicy(policy MergePolicy) error {
+
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	index.writer.Lock()
+	index.policy = policy
+	index.writer.Unlock()
+
+	index.maybeMerge()
+
+	return nil
+
+}
+
+// Wake up the scheduler, a request that comes while one is pending is dropped
+func (index *Index) maybeMerge() {
+
+	select {
+	case index.pending <- struct{}{}:
+	default:
+	}
+
+}
+
+// Background scheduler: every request starts merges the policy finds
+// until the budget of concurrent merges is spent.
+func (index *Index) schedule() {
+
+	defer index.running.Done()
+
+	for {
+		select {
+		case <-index.done:
+			return
+		case <-index.pending:
+		}
+		for index.startMerge() {
+		}
+	}
+
+}
+
+// Pick the next merge of the current snapshot and run it in a new goroutine
+func (index *Index) startMerge() bool {
+
+	index.writer.Lock()
+	defer index.writer.Unlock()
+
+	if index.merges >= index.policy.MaxConcurrentMerges {
+		return false
+	}
+	select {
+	case <-index.done:
+		return false
+	default:
+	}
+
+	snapshot := index.Snapshot()
+	busy := make([]bool, len(snapshot.segments))
+	for i, seg := range snapshot.segments {
+		busy[i] = index.merging[seg]
+	}
+
+	picked := index.policy.findMerge(snapshot.sizes(), busy)
+	if picked == nil {
+		snapshot.Release()
+		return false
+	}
+
+	segments := make([]*segment, len(picked))
+	for i, j := range picked {
+		segments[i] = snapshot.segments[j]
+		index.merging[segments[i]] = true
+	}
+
+	index.sequence++
+	indexFile := filepath.Join(index.dir, fmt.Sprintf("segment%d", index.sequence), "index.dat")
+	index.merges++
+
+	index.running.Add(1)
+	go func() {
+		defer index.running.Done()
+		err := index.mergeSegments(snapshot, segments, indexFile)
+		snapshot.Release()
+
+		index.writer.Lock()
+		for _, seg := range segments {
+			delete(index.merging, seg)
+		}
+		index.merges--
+		if err != nil && index.mergeErr == nil {
+			index.mergeErr = err
+		}
+		index.writer.Unlock()
+
+		// the merged segment may fill the next tier
+		if err == nil {
+			index.maybeMerge()
+		}
+	}()
+
+	return true
+
+}
+
+// Merge segments of the snapshot into indexFile and swap them in one commit.
+// Documents deleted while the merge runs stay marked in the new segment.
+func (index *Index) mergeSegments(snapshot *Snapshot, segments []*segment, indexFile string) error {
+
+	sources := make([]corpus.TokenIterator, 0, len(segments))
+	documents := corpus.NewDocumentTree()
+	store := corpus.NewDocumentStore()
+	merged := make(map[*segment]bool)
+
+	for _, seg := range segments {
+		merged[seg] = true
+		sources = append(sources, newSegmentIterator(seg.BlockTree))
+		seg.Documents.Each(func(key, value interface{}) {
+			documents.Put(key, value)
+		})
+		// stored documents are copied compressed
+		if seg.Store != nil {
+			for _, id := range seg.Store.IDs() {
+				store.CopyFrom(seg.Store, id)
+			}
+		}
+	}
+
+	// nil segment means every merged document was deleted
+	seg, err := writeSegment(indexFile, documents, sources, store, snapshot.deleted)
+	if seg == nil && err != nil {
+		return err
+	}
+
+	index.writer.Lock()
+	defer index.writer.Unlock()
+
+	current := index.current
+	swapped := current.derive()
+	swapped.segments = make([]*segment, 0, len(current.segments))
+	for _, s := range current.segments {
+		if !merged[s] {
+			swapped.segments = append(swapped.segments, s)
+		}
+	}
+	if seg != nil {
+		swapped.segments = append(swapped.segments, seg)
+	}
+
+	// documents dropped by the merge are gone for good
+	swapped.deleted = current.deleted.Clone()
+	for _, id := range snapshot.deleted.IDs() {
+		if _, ok := documents.Get(id); ok {
+			swapped.deleted.Clear(id)
+		}
+	}
+
+	if err := index.commit(swapped); err != nil {
+		if seg != nil {
+			seg.remove()
+		}
+		return err
+	}
+
+	return err
+
+}
+
+// Stop the scheduler, wait for running merges and close the log, returns the first merge that failed.
+// Z0 is not flushed, it is replayed from the log by the next OpenIndex.
+// Blocks are unmapped when snapshots taken before are released, the index must not be used anymore.
+func (index *Index) Close() error {
+
+	closing := false
+	index.writer.Lock()
+	select {
+	case <-index.done:
+	default:
+		close(index.done)
+		closing = true
+	}
+	index.writer.Unlock()
+
+	index.running.Wait()
+
+	if index.log != nil {
+		index.log.close()
+	}
+
+	if closing && index.current != nil {
+		// committed segments stay on disk for the next OpenIndex
+		index.mutex.Lock()
+		for _, seg := range index.current.segments {
+			seg.kept = true
+		}
+		index.mutex.Unlock()
+		index.current.Release()
+	}
+
+	return index.mergeErr
+
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Small segments of the tests share one tier, two of them are merged
+var mergeAll = MergePolicy{
+	SegmentsPerTier:     2,
+	MaxMergeAtOnce:      10,
+	MaxConcurrentMerges: 1,
+	MaxSegmentDocs:      100,
+	FloorSegmentDocs:    10,
+	MaxDeletedRatio:     0.5,
+}
+
+// Wait until the scheduler has nothing to merge
+func waitMerges(t *testing.T, index *Index) {
+
+	for i := 0; i < 500; i++ {
+		index.writer.Lock()
+		current := index.current
+		idle := index.merges == 0 && index.policy.findMerge(current.sizes(), make([]bool, len(current.segments))) == nil
+		index.writer.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("merges did not finish")
+
+}
+
+func TestFindMerge(t *testing.T) {
+
+	policy := MergePolicy{
+		SegmentsPerTier:  3,
+		MaxMergeAtOnce:   2,
+		MaxSegmentDocs:   80,
+		FloorSegmentDocs: 10,
+		MaxDeletedRatio:  0.5,
+	}
+
+	tests := []struct {
+		sizes    []segmentSize
+		busy     []bool
+		expected []int
+	}{
+		// the tier is not full
+		{[]segmentSize{{5, 0}, {8, 0}}, []bool{false, false}, nil},
+		// the smallest segments of the first tier, 40 documents are in the next tier
+		{[]segmentSize{{5, 0}, {8, 0}, {3, 0}, {40, 0}}, []bool{false, false, false, false}, []int{2, 0}},
+		// segment that is merged already does not count
+		{[]segmentSize{{5, 0}, {8, 0}, {3, 0}}, []bool{false, false, true}, nil},
+		// two segments do not fit the maximum size together
+		{[]segmentSize{{45, 0}, {45, 0}, {45, 0}}, []bool{false, false, false}, nil},
+		// large segments are not merged for size
+		{[]segmentSize{{60, 0}, {60, 0}, {60, 0}}, []bool{false, false, false}, nil},
+		// mostly deleted segment is rewritten alone
+		{[]segmentSize{{8, 2}, {60, 0}, {2, 8}}, []bool{false, false, false}, []int{2}},
+	}
+
+	for _, test := range tests {
+		if merge := policy.findMerge(test.sizes, test.busy); !reflect.DeepEqual(merge, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.sizes, test.expected, merge)
+		}
+	}
+
+}
+
+// Policies that can not put segments into tiers or merge them are refused
+func TestInvalidMergePolicy(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	invalid := []func(p *MergePolicy){
+		func(p *MergePolicy) { p.SegmentsPerTier = 1 },
+		func(p *MergePolicy) { p.SegmentsPerTier = 0 },
+		func(p *MergePolicy) { p.FloorSegmentDocs = 0 },
+		func(p *MergePolicy) { p.MaxMergeAtOnce = 1 },
+	}
+	for i, change := range invalid {
+		policy := mergeAll
+		change(&policy)
+		if err := index.SetMergePolicy(policy); !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("%d: expected invalid policy, got %v", i, err)
+		}
+	}
+	if index.policy != DefaultMergePolicy {
+		t.Errorf("expected the policy kept, got %v", index.policy)
+	}
+
+	if err := index.SetMergePolicy(mergeAll); err != nil {
+		t.Errorf("expected the policy set, got %v", err)
+	}
+
+}
+
+func TestBackgroundMerge(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	docs := filepath.Join(dir, "docs")
+	os.Mkdir(docs, 0777)
+	for i := 0; i < 4; i++ {
+		ioutil.WriteFile(filepath.Join(docs, fmt.Sprintf("new%d.txt", i)), []byte(fmt.Sprintf("what did zebra%d say", i)), 0666)
+	}
+	ids, err := index.AddDirectory(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.DeleteDocument(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := added(index)
+	index.SetMergePolicy(mergeAll)
+	waitMerges(t, index)
+
+	// the main index and every flushed segment end up in one
+	segments := current(index).segments
+	if len(segments) != 1 {
+		t.Fatalf("expected one segment, got %v", segments)
+	}
+	if n := segments[0].Documents.Size(); n != 5 {
+		t.Errorf("expected deleted document to be dropped, got %d documents", n)
+	}
+	if current(index).deleted.Count() != 0 {
+		t.Errorf("expected bits of dropped documents to be cleared, got %v", current(index).deleted.IDs())
+	}
+	for _, seg := range flushed {
+		if _, err := os.Stat(filepath.Dir(seg.indexFile)); !os.IsNotExist(err) {
+			t.Errorf("expected merged segment to be removed, got %v", err)
+		}
+	}
+
+	res, err := CosineScore(index, "What did", 10)
+	if err != nil || len(res) != 5 {
+		t.Errorf("expected every live document, got %v, %v", res, err)
+	}
+	if res, _ := CosineScore(index, "zebra1", 10); len(res) != 0 {
+		t.Errorf("expected deleted document to stay deleted, got %v", res)
+	}
+
+	// the merged segment is committed
+	reopened, err := OpenIndex(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if len(current(reopened).segments) != 1 {
+		t.Errorf("expected merged segment to be committed, got %v", current(reopened).segments)
+	}
+
+	if err := index.Close(); err != nil {
+		t.Errorf("expected merges to succeed, got %v", err)
+	}
+
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"../corpus"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Migrated is a file rewritten by Migrate
+type Migrated struct {
+	Path string
+	Kind corpus.FileKind
+	From int
+}
+
+// Rewrite the index, its blocks and bloom filter in the current format version.
+// Every file is replaced atomically, so a failed migration leaves old files readable.
+// Block checksums of the index are recomputed over the rewritten blocks.
+func Migrate(indexFile string) ([]Migrated, error) {
+
+	// files are going to be replaced under the mappings
+	UnmapAll()
+
+	data, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bt, version, err := corpus.ReadBlockTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %v", indexFile, err)
+	}
+
+	migrated := make([]Migrated, 0)
+	changed := version < corpus.FormatVersion
+
+	blocks := make(map[string]bool)
+	for _, v := range bt.Values() {
+		blocks[v.(string)] = true
+	}
+	paths := make([]string, 0, len(blocks))
+	for path := range blocks {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		m, err := migrateFile(path, corpus.KindBlock)
+		if err != nil {
+			return migrated, err
+		}
+		if m != nil {
+			migrated = append(migrated, *m)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return migrated, err
+		}
+		if crc := corpus.Checksum(data); bt.Checksums[path] != crc {
+			bt.Checksums[path] = crc
+			changed = true
+		}
+	}
+
+	// filter is optional
+	bloomFile := corpus.BloomFilterPath(indexFile)
+	if _, err := os.Stat(bloomFile); err == nil {
+		m, err := migrateFile(bloomFile, corpus.KindBloomFilter)
+		if err != nil {
+			return migrated, err
+		}
+		if m != nil {
+			migrated = append(migrated, *m)
+		}
+	}
+
+	// index goes last, it is the only file pointing to the others
+	if changed {
+		data, err := bt.MarshalFile()
+		if err != nil {
+			return migrated, err
+		}
+		if err := writeFileAtomic(indexFile, data); err != nil {
+			return migrated, err
+		}
+		migrated = append(migrated, Migrated{indexFile, corpus.KindBlockTree, version})
+	}
+
+	return migrated, nil
+
+}
+
+// Migrate every segment the commit point in dir lists, commit points and stores
+// appeared in the current version, so only segments are rewritten
+func MigrateStorage(dir string) ([]Migrated, error) {
+
+	segments, _, err := CommittedSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := make([]Migrated, 0)
+	for _, indexFile := range segments {
+		m, err := Migrate(indexFile)
+		migrated = append(migrated, m...)
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+
+}
+
+// Upgrade one file in place, nil when it already has the current version
+func migrateFile(path string, kind corpus.FileKind) (*Migrated, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	upgraded, version, err := corpus.Upgrade(kind, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", kind, path, err)
+	}
+	if version == corpus.FormatVersion {
+		return nil, nil
+	}
+
+	if err := writeFileAtomic(path, upgraded); err != nil {
+		return nil, err
+	}
+
+	return &Migrated{path, kind, version}, nil
+
+}
+
+// Write into a temp file next to the target and rename it over the target
+func writeFileAtomic(path string, data []byte) error {
+
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+
+}
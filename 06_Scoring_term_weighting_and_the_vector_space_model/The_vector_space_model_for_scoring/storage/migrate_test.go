@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"../corpus"
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"github.com/emirpasic/gods/maps/treemap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Postings of chapters 4-6 as they were gob encoded, positions are plain numbers
+type legacyDoc struct {
+	Positions []int
+	DocID     int
+	File      string
+	Frequency int
+}
+
+type legacyToken struct {
+	Term           string
+	Docs           []legacyDoc
+	TotalFrequency int
+}
+
+type legacyCorpus struct {
+	Tokens []legacyToken
+}
+
+func TestMigrate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	block0 := filepath.Join(dir, "block0.dat")
+	indexFile := filepath.Join(dir, "index.dat")
+
+	// storage of version 0: base64 gob block and tree, there are no filters
+	b := bytes.Buffer{}
+	legacy := &legacyCorpus{[]legacyToken{{Term: "say", TotalFrequency: 1, Docs: []legacyDoc{{DocID: 0, Frequency: 1, Positions: []int{1}}}}}}
+	if err := gob.NewEncoder(&b).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	block := []byte(base64.StdEncoding.EncodeToString(b.Bytes()))
+	ioutil.WriteFile(block0, block, 0666)
+
+	docs := corpus.NewDocumentTree()
+	vector := corpus.DocumentIndex{Map: treemap.NewWithStringComparator()}
+	vector.Put("say", float32(1))
+	docs.Put(0, vector)
+
+	bt := corpus.NewBlockTree(docs)
+	bt.Put("say", block0)
+	bt.Checksums[block0] = corpus.Checksum(block)
+	ioutil.WriteFile(indexFile, []byte(bt.ToGOB64()), 0666)
+
+	kinds := problemKinds(Verify(indexFile))
+	if kinds[ProblemOldFormat] != 2 {
+		t.Errorf("expected old index and block, got %v", kinds)
+	}
+
+	migrated, err := Migrate(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != 2 {
+		t.Errorf("expected block and index to be migrated, got %v", migrated)
+	}
+
+	if report := Verify(indexFile); !report.OK() {
+		t.Errorf("unexpected problems %v", report.Problems)
+	}
+
+	if token, err := DeserializeTerm("say", block0); err != nil || token.Docs[0].Positions.Decode()[0] != 1 {
+		t.Errorf("migrated block is not read, %v, %v", token, err)
+	}
+
+	// second run has nothing to do
+	if migrated, err := Migrate(indexFile); err != nil || len(migrated) != 0 {
+		t.Errorf("expected nothing to migrate, got %v, %v", migrated, err)
+	}
+
+}
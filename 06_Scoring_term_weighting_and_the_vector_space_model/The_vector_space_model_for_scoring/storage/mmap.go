@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"../corpus"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// mappedFile is a read-only memory mapping of a block file.
+// Mappings are shared by every query, the kernel pages data in on demand.
+// Segments of open indexes hold references, the file is unmapped when the last one is released.
+type mappedFile struct {
+	data  []byte
+	block *corpus.BlockReader
+	refs  int
+}
+
+type mappings struct {
+	files map[string]*mappedFile
+	mutex *sync.RWMutex
+}
+
+var mapped = &mappings{
+	files: make(map[string]*mappedFile),
+	mutex: &sync.RWMutex{},
+}
+
+// Get shared mapping of the file, map it on the first access
+func openMapped(path string) (*mappedFile, error) {
+
+	mapped.mutex.RLock()
+	m, ok := mapped.files[path]
+	if ok && m.data != nil {
+		mapped.mutex.RUnlock()
+		return m, nil
+	}
+	mapped.mutex.RUnlock()
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	// somebody could map it while we were waiting for the lock
+	m, ok = mapped.files[path]
+	if ok && m.data != nil {
+		return m, nil
+	}
+
+	data, err := mmap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		m = &mappedFile{}
+		mapped.files[path] = m
+	}
+	m.data = data
+
+	return m, nil
+
+}
+
+// Get shared block reader over the mapped block file
+func openBlock(path string) (*corpus.BlockReader, error) {
+
+	m, err := openMapped(path)
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
+
+	mapped.mutex.RLock()
+	block := m.block
+	mapped.mutex.RUnlock()
+	if block != nil {
+		return block, nil
+	}
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	if m.block == nil {
+		block, version, err := corpus.ReadBlock(m.data)
+		if err != nil {
+			return nil, corpus.NewFileError(path, err)
+		}
+		if version < corpus.FormatVersion {
+			log.Printf("block %s has format version %d, it is upgraded on every load, run migrate", path, version)
+		}
+		m.block = block
+	}
+
+	return m.block, nil
+
+}
+
+// Take a reference to the file, it is mapped on the first access
+func acquireMapped(path string) {
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	m, ok := mapped.files[path]
+	if !ok {
+		m = &mappedFile{}
+		mapped.files[path] = m
+	}
+	m.refs++
+
+}
+
+// Drop a reference to the file, the last one unmaps it and evicts its cached postings
+func releaseMapped(path string) error {
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	m, ok := mapped.files[path]
+	if !ok {
+		return nil
+	}
+	if m.refs > 0 {
+		m.refs--
+	}
+	if m.refs > 0 {
+		return nil
+	}
+	delete(mapped.files, path)
+	// cached postings keep slices of mapped blocks
+	Cache.Evict(path)
+
+	return munmap(m.data)
+
+}
+
+// Unmap one file no matter who holds it, readers that still hold its bytes must be done by now
+func closeMapped(path string) error {
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	m, ok := mapped.files[path]
+	if !ok {
+		return nil
+	}
+	delete(mapped.files, path)
+
+	return munmap(m.data)
+
+}
+
+// Unmap files of the dir only, mappings of other indexes stay valid
+func unmapDir(dir string) {
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	for path, m := range mapped.files {
+		if !inDir(path, dir) {
+			continue
+		}
+		// cached postings keep slices of mapped blocks
+		Cache.Evict(path)
+		munmap(m.data)
+		delete(mapped.files, path)
+	}
+
+}
+
+func inDir(path, dir string) bool {
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+
+}
+
+// UnmapAll releases every mapping of every index, must be called before block files are rewritten
+// and only when no index is queried, open indexes release their own mappings on Close
+func UnmapAll() {
+
+	// cached postings keep slices of mapped blocks
+	Cache.Purge()
+
+	mapped.mutex.Lock()
+	defer mapped.mutex.Unlock()
+
+	for path, m := range mapped.files {
+		munmap(m.data)
+		delete(mapped.files, path)
+	}
+
+}
+
+func mmap(path string) ([]byte, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// mapping stays valid after the descriptor is closed
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() == 0 {
+		return []byte{}, nil
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+
+}
+
+func munmap(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
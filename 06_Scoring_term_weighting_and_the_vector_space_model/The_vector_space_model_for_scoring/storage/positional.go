@@ -0,0 +1,78 @@
+package storage
+
+// ProximityMatch is a pair of positions of 2 terms found in one document
+type ProximityMatch struct {
+	DocID     int
+	File      string
+	Position1 int
+	Position2 int
+}
+
+// Find documents where term2 occurs within k words of term1.
+// Positions are decoded only for documents that contain both terms.
+func PositionalIntersect(index *Index, term1, term2 string, k int) ([]ProximityMatch, error) {
+
+	// positions are slices of mapped blocks, the snapshot keeps its segments mapped
+	snapshot := index.Snapshot()
+	defer snapshot.Release()
+
+	answer := make([]ProximityMatch, 0)
+
+	p1, err := snapshot.postings(term1)
+	if err != nil {
+		return answer, err
+	}
+	p2, err := snapshot.postings(term2)
+	if err != nil {
+		return answer, err
+	}
+
+	len1 := len(p1.Docs)
+	len2 := len(p2.Docs)
+	i, j := 0, 0
+
+	for i != len1 && j != len2 {
+		doc1 := p1.Docs[i]
+		doc2 := p2.Docs[j]
+
+		if doc1.DocID == doc2.DocID {
+			pp1 := doc1.Positions.Decode()
+			pp2 := doc2.Positions.Decode()
+
+			l := make([]int, 0)
+			jj := 0
+			for _, pos1 := range pp1 {
+				for jj != len(pp2) {
+					if abs(pos1-pp2[jj]) <= k {
+						l = append(l, pp2[jj])
+					} else if pp2[jj] > pos1 {
+						break
+					}
+					jj++
+				}
+				for len(l) > 0 && abs(l[0]-pos1) > k {
+					l = l[1:]
+				}
+				for _, ps := range l {
+					answer = append(answer, ProximityMatch{doc1.DocID, doc1.File, pos1, ps})
+				}
+			}
+			i++
+			j++
+		} else if doc1.DocID < doc2.DocID {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return answer, nil
+
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"../corpus"
+	"errors"
 	"math"
 	"sort"
 	"strings"
@@ -10,6 +11,9 @@ import (
 type TermRank struct {
 	File string
 	Score float32
+	DocID int
+	// Text of the document, empty when the index does not store it
+	Content string
 }
 
 //As a first step, we introduce the overlap score measure: the score of a document d is the
@@ -18,43 +22,38 @@ type TermRank struct {
 //occurrences of each query term t in d, but instead the tf-idf weight of each
 //term in d.
 // ITFScore 2 terms and sort documents using their inverse document frequency
-func ITFScore(bt *corpus.BlockTree, term1, term2 string) []TermRank {
+func ITFScore(index *Index, term1, term2 string) ([]TermRank, error) {
+
+	snapshot := index.Snapshot()
+	defer snapshot.Release()
 
 	res := make([]TermRank, 0)
 
-	block1, ok1 := bt.Get(term1)
-	block2, ok2 := bt.Get(term2)
-	if !ok1 || !ok2 {
-		return res
+	p1, err := snapshot.postings(term1)
+	if err != nil {
+		return res, err
+	}
+	p2, err := snapshot.postings(term2)
+	if err != nil {
+		return res, err
 	}
 
-	p1 := DeserializeTerm(term1, block1.(string))
-	p2 := DeserializeTerm(term2, block2.(string))
-
-	len1 := len(p1.Docs)
-	len2 := len(p2.Docs)
-	i, j := 0, 0
-
-	for i != len1  && j != len2 {
-		doc1 := p1.Docs[i]
-		doc2 := p2.Docs[j]
-
-		//   if docID(p1[i]) == docID(p2[j]):
-		if doc1.DocID == doc2.DocID {
-			res = append(res, TermRank{
-				doc1.File,
-				score(doc1, doc2, p1, p2),
-			})
-			i++
-			j++
-		} else if doc1.DocID < doc2.DocID {
-			i++
-		} else {
-			j++
-		}
+	// doc IDs are intersected a whole PForDelta block at a time
+	matches, err := corpus.IntersectPFor(p1.DocIDs, p2.DocIDs)
+	if err != nil {
+		return res, err
+	}
+	for _, match := range matches {
+		doc1 := p1.Docs[match[0]]
+		doc2 := p2.Docs[match[1]]
+		res = append(res, TermRank{
+			File:  documentPath(snapshot, doc1.DocID, doc1.File),
+			Score: score(doc1, doc2, p1, p2),
+			DocID: doc1.DocID,
+		})
 	}
 
-	return sortScores(res)
+	return sortScores(res), nil
 
 }
 
@@ -76,46 +75,127 @@ type RankSorter []TermRank
 
 func (a RankSorter) Len() int           { return len(a) }
 func (a RankSorter) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a RankSorter) Less(i, j int) bool { return a[i].Score > a[j].Score }
+func (a RankSorter) Less(i, j int) bool {
+	// documents of equal scores keep the order of their IDs
+	if a[i].Score != a[j].Score {
+		return a[i].Score > a[j].Score
+	}
+	return a[i].DocID < a[j].DocID
+}
 
 func sortScores(scores []TermRank) []TermRank {
 	sort.Sort(RankSorter(scores))
 	return scores
 }
 
-// Get top K results for given query using cosine score and vector model
-func CosineScore(bt *corpus.BlockTree, query string, top int) []TermRank {
+// Get top K results for given query using cosine score and vector model.
+// Terms absent from the storage are skipped, terms whose blocks can not be read
+// are reported by *corpus.PartialError along with the scores of the other terms.
+func CosineScore(index *Index, query string, top int) ([]TermRank, error) {
+
+	snapshot := index.Snapshot()
+	defer snapshot.Release()
 
 	tokens := parseToTokens(query)
-	scores := make(map[string] float32)
+	failed := &corpus.PartialError{}
 
-	for _, t := range tokens {
+	postings := snapshot.queryPostings(tokens, failed)
+	ranks := getTopKResults(sortScores(scorePostings(snapshot, tokens, postings, postingsStats(snapshot, postings))), top)
 
-		block, ok := bt.Get(t.Term)
-		if !ok {
+	// text is read for the top K only, documents that are not stored keep it empty
+	for i := range ranks {
+		ranks[i].Content = storedText(snapshot, ranks[i].DocID, failed)
+	}
+
+	return ranks, failed.Err()
+
+}
+
+// Statistics of the collection that weigh query terms, shards of one collection sum them up
+type collectionStats struct {
+	docsNum int
+	// documents of every query term
+	documentFrequency map[string]int
+}
+
+func (stats collectionStats) add(other collectionStats) collectionStats {
+
+	sum := collectionStats{stats.docsNum + other.docsNum, make(map[string]int)}
+	for term, df := range stats.documentFrequency {
+		sum.documentFrequency[term] += df
+	}
+	for term, df := range other.documentFrequency {
+		sum.documentFrequency[term] += df
+	}
+
+	return sum
+
+}
+
+// idf(t) = log(N / df(t))
+func (stats collectionStats) inverseDocumentFrequency(term string) float32 {
+	return corpus.CountInverseDocumentFrequency(stats.docsNum, stats.documentFrequency[term])
+}
+
+// Postings of the query terms in the snapshot, terms that can not be read are added to failed
+func (s *Snapshot) queryPostings(tokens []InputVector, failed *corpus.PartialError) map[string]corpus.SerializedToken {
+
+	postings := make(map[string]corpus.SerializedToken)
+	for _, t := range tokens {
+		p, err := s.postings(t.Term)
+		if errors.Is(err, ErrTermNotFound) {
+			continue
+		}
+		if err != nil {
+			failed.Add(err)
 			continue
 		}
+		postings[t.Term] = p
+	}
 
-		p := DeserializeTerm(t.Term, block.(string))
+	return postings
 
-		for _, d := range p.Docs {
+}
 
-			if doc, ok := bt.Documents.Get(d.DocID); ok {
-				document := doc.(*corpus.DocumentIndex)
+func postingsStats(s *Snapshot, postings map[string]corpus.SerializedToken) collectionStats {
 
-				if frequency, ok := document.Get(t.Term); ok {
-					ntf := frequency.(float32)
-					doc := InputVector {
-						Term:                        t.Term,
-						NormalizedDocumentFrequency: ntf,
-						InverseDocumentFrequency:    d.InverseDocumentFrequency,
-						TFxIDF:                      ntf * d.InverseDocumentFrequency,
-					}
+	stats := collectionStats{s.docsNum(), make(map[string]int)}
+	for term, p := range postings {
+		stats.documentFrequency[term] = len(p.Docs)
+	}
+
+	return stats
+
+}
+
+// Score documents of the postings, idf of every term comes from stats of the whole collection.
+// Documents are scored by ID, a file may hold many of them.
+func scorePostings(snapshot *Snapshot, tokens []InputVector, postings map[string]corpus.SerializedToken, stats collectionStats) []TermRank {
+
+	scores := make(map[int]float32)
+	files := make(map[int]string)
+
+	for _, t := range tokens {
+
+		p, ok := postings[t.Term]
+		if !ok {
+			continue
+		}
+		idf := stats.inverseDocumentFrequency(t.Term)
 
-					scores[d.File] += CosineSimilarity(t, doc) * doc.NormalizedDocumentFrequency
+		for _, d := range p.Docs {
 
+			if ntf, ok := snapshot.frequency(d.DocID, t.Term); ok {
+				doc := InputVector {
+					Term:                        t.Term,
+					NormalizedDocumentFrequency: ntf,
+					InverseDocumentFrequency:    idf,
+					TFxIDF:                      ntf * idf,
 				}
 
+				scores[d.DocID] += CosineSimilarity(t, doc) * doc.NormalizedDocumentFrequency
+				files[d.DocID] = d.File
+
 			}
 
 		}
@@ -124,14 +204,39 @@ func CosineScore(bt *corpus.BlockTree, query string, top int) []TermRank {
 
 	ranks := make([]TermRank, 0)
 
-	for key, value := range scores {
+	for id, value := range scores {
 		ranks = append(ranks, TermRank {
-			File:  key,
+			File:  documentPath(snapshot, id, files[id]),
 			Score: value,
+			DocID: id,
 		})
 	}
 
-	return getTopKResults(sortScores(ranks), top)
+	return ranks
+
+}
+
+// Path of the document from the registry, registries of indexes written before
+// the registry know documents by ID only, the file of their postings is taken then
+func documentPath(snapshot *Snapshot, docID int, file string) string {
+
+	if info, ok := snapshot.index.Document(docID); ok && info.Path != "" {
+		return info.Path
+	}
+
+	return file
+
+}
+
+// Text of the stored document, empty when it is not stored
+func storedText(snapshot *Snapshot, docID int, failed *corpus.PartialError) string {
+
+	doc, err := snapshot.document(docID)
+	if err != nil && !errors.Is(err, ErrDocumentNotFound) {
+		failed.Add(err)
+	}
+
+	return doc.Text
 
 }
 
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"../corpus"
+	"../spimi"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// segment is an index written once to its own dir and never changed
+type segment struct {
+	*corpus.BlockTree
+	indexFile string
+	// snapshots that have the segment
+	refs int
+	// files stay on disk when the last snapshot is released, the index is closed
+	kept bool
+}
+
+// Merge sources into a new segment, deleted documents are dropped from it and its store.
+// Segment is returned along with a problem of its bloom filter, nil segment means nothing was written,
+// there is nothing to write when every document is deleted.
+func writeSegment(indexFile string, documents *corpus.DocumentTree, sources []corpus.TokenIterator, store *corpus.DocumentStore, deleted *corpus.Bitmap) (*segment, error) {
+
+	live := documents.Size()
+	kept := corpus.NewDocumentStore()
+	documents.Each(func(key, value interface{}) {
+		if deleted.Contains(key.(int)) {
+			live--
+		} else if store.Contains(key.(int)) {
+			kept.CopyFrom(store, key.(int))
+		}
+	})
+	if live == 0 {
+		return nil, nil
+	}
+
+	dir := filepath.Dir(indexFile)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, corpus.NewFileError(dir, err)
+	}
+
+	if _, err := spimi.WriteSegment(indexFile, termsInBlock, live, documents, sources, deleted, nil); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	data, err := kept.MarshalFile()
+	if err == nil {
+		err = writeFileAtomic(corpus.StorePath(indexFile), data)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	bt, err := loadBTree(indexFile)
+	if bt == nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &segment{BlockTree: bt, indexFile: indexFile}, err
+
+}
+
+// Take references to the blocks of the segment
+func (s *segment) acquire() {
+	for block := range s.Checksums {
+		acquireMapped(block)
+	}
+}
+
+// Drop references to the blocks, blocks that no other segment has are unmapped
+func (s *segment) release() {
+	for block := range s.Checksums {
+		releaseMapped(block)
+	}
+}
+
+// Unmap and delete files of the segment, nobody may read it anymore
+func (s *segment) remove() {
+
+	s.release()
+
+	for block := range s.Checksums {
+		os.Remove(block)
+	}
+	os.Remove(s.indexFile)
+	os.Remove(corpus.BloomFilterPath(s.indexFile))
+	os.Remove(corpus.StorePath(s.indexFile))
+
+	// the dir is shared when the segment is the main index, it is not empty then
+	os.Remove(filepath.Dir(s.indexFile))
+
+}
+
+// Segment dirs that the commit point does not list
+func removeOrphans(dir string, commit *corpus.CommitPoint) {
+
+	listed := make(map[string]bool)
+	for _, s := range commit.Segments {
+		listed[filepath.Clean(filepath.Dir(s.IndexFile))] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() && strings.HasPrefix(f.Name(), "segment") && !listed[path] {
+			os.RemoveAll(path)
+		}
+	}
+
+}
+
+// segmentIterator yields postings of an on-disk index sorted by term
+type segmentIterator struct {
+	bt    *corpus.BlockTree
+	terms []string
+}
+
+func newSegmentIterator(bt *corpus.BlockTree) *segmentIterator {
+
+	terms := make([]string, 0, bt.Size())
+	for _, key := range bt.Keys() {
+		terms = append(terms, key.(string))
+	}
+	sort.Strings(terms)
+
+	return &segmentIterator{bt, terms}
+
+}
+
+func (it *segmentIterator) Next() (corpus.SerializedToken, error) {
+
+	if len(it.terms) == 0 {
+		return corpus.SerializedToken{}, io.EOF
+	}
+	term := it.terms[0]
+	it.terms = it.terms[1:]
+
+	block, _ := it.bt.Get(term)
+
+	return DeserializeTerm(term, block.(string))
+
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"../corpus"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ShardedIndex splits the collection by document across independent indexes, every shard
+// has its own dir, segments, log and registry. A document goes to the shard of its path,
+// so updates of the file find it again. Queries are scattered to every shard and their
+// answers are gathered, a shard holds a part of the collection only.
+// Doc IDs of the shards are made global by interleaving: shard i gives IDs id*n + i.
+type ShardedIndex struct {
+	shards []*Index
+}
+
+// Dir of the shard in the dir of the sharded index
+func shardDir(dir string, shard int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard%d", shard))
+}
+
+// Shard of the document file
+func shardOf(path string, shards int) int {
+
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Clean(path)))
+
+	return int(h.Sum32() % uint32(shards))
+
+}
+
+// Open the shards of dir, shards without a commit point are built from documents
+// of the input dir first. Documents that can not be read are reported
+// by *corpus.PartialError along with the loaded index.
+func InitShardedStorage(inputDir, dir string, shards int) (*ShardedIndex, error) {
+
+	failed := &corpus.PartialError{}
+
+	for i := 0; i < shards; i++ {
+		if fileExists(filepath.Join(shardDir(dir, i), commitFile)) {
+			continue
+		}
+		if err := os.MkdirAll(shardDir(dir, i), 0777); err != nil {
+			return nil, corpus.NewFileError(shardDir(dir, i), err)
+		}
+		shard := i
+		err := buildStorage(inputDir, filepath.Join(shardDir(dir, i), "index.dat"), func(path string) bool {
+			return shardOf(path, shards) == shard
+		})
+		if _, partial := err.(*corpus.PartialError); err != nil && !partial {
+			return nil, err
+		}
+		failed.Add(err)
+	}
+
+	index, err := OpenShardedIndex(dir, shards, auxiliaryDocuments)
+	if index == nil {
+		return nil, err
+	}
+	failed.Add(err)
+
+	return index, failed.Err()
+
+}
+
+// Open every shard of dir like OpenIndex
+func OpenShardedIndex(dir string, shards, auxLimit int) (*ShardedIndex, error) {
+
+	index := &ShardedIndex{}
+	failed := &corpus.PartialError{}
+
+	for i := 0; i < shards; i++ {
+		shard, err := OpenIndex(shardDir(dir, i), auxLimit)
+		if shard == nil {
+			index.Close()
+			return nil, err
+		}
+		failed.Add(err)
+		index.shards = append(index.shards, shard)
+	}
+
+	return index, failed.Err()
+
+}
+
+// Global doc ID of the shard's document
+func (index *ShardedIndex) globalID(shard, docID int) int {
+	return docID*len(index.shards) + shard
+}
+
+// Shard of the global doc ID and the doc ID in it
+func (index *ShardedIndex) localID(docID int) (int, int) {
+	return docID % len(index.shards), docID / len(index.shards)
+}
+
+// Add the file to its shard, gives the global doc ID
+func (index *ShardedIndex) AddDocument(path string) (int, error) {
+
+	shard := shardOf(path, len(index.shards))
+	docID, err := index.shards[shard].AddDocument(path)
+	if err != nil {
+		return docID, err
+	}
+
+	return index.globalID(shard, docID), nil
+
+}
+
+// Index the file again in its shard
+func (index *ShardedIndex) UpdateDocument(path string) (int, error) {
+
+	shard := shardOf(path, len(index.shards))
+	docID, err := index.shards[shard].UpdateDocument(path)
+	if err != nil {
+		return docID, err
+	}
+
+	return index.globalID(shard, docID), nil
+
+}
+
+func (index *ShardedIndex) DeleteDocument(docID int) error {
+
+	shard, local := index.localID(docID)
+
+	return index.shards[shard].DeleteDocument(local)
+
+}
+
+// Registered document of the global doc ID
+func (index *ShardedIndex) Document(docID int) (corpus.DocumentInfo, bool) {
+
+	shard, local := index.localID(docID)
+	info, ok := index.shards[shard].Document(local)
+	info.ID = docID
+
+	return info, ok
+
+}
+
+func (index *ShardedIndex) StoredDocument(docID int) (corpus.StoredDocument, error) {
+
+	shard, local := index.localID(docID)
+	doc, err := index.shards[shard].StoredDocument(local)
+	doc.ID = docID
+
+	return doc, err
+
+}
+
+// Stop every shard, the first error is returned
+func (index *ShardedIndex) Close() error {
+
+	var err error
+	for _, shard := range index.shards {
+		if closeErr := shard.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+
+}
+
+// Answer of one shard
+type shardResult struct {
+	snapshot *Snapshot
+	postings map[string]corpus.SerializedToken
+	stats    collectionStats
+	ranks    []TermRank
+	failed   *corpus.PartialError
+}
+
+// Get top K results of every shard for the query and merge them. Shards gather df of the query terms
+// and their sizes first, so every shard weighs terms by idf of the whole collection,
+// then every shard scores its documents in parallel. Failures of shards are reported
+// by *corpus.PartialError along with the scores of the others.
+func ShardedCosineScore(index *ShardedIndex, query string, top int) ([]TermRank, error) {
+
+	tokens := parseToTokens(query)
+	results := make([]*shardResult, len(index.shards))
+
+	for i, shard := range index.shards {
+		results[i] = &shardResult{snapshot: shard.Snapshot(), failed: &corpus.PartialError{}}
+		defer results[i].snapshot.Release()
+	}
+
+	// gather df
+	scatter(results, func(r *shardResult) {
+		r.postings = r.snapshot.queryPostings(tokens, r.failed)
+		r.stats = postingsStats(r.snapshot, r.postings)
+	})
+	stats := collectionStats{0, make(map[string]int)}
+	for _, r := range results {
+		stats = stats.add(r.stats)
+	}
+
+	// score with global idf
+	scatter(results, func(r *shardResult) {
+		r.ranks = getTopKResults(sortScores(scorePostings(r.snapshot, tokens, r.postings, stats)), top)
+	})
+
+	// merge top K lists, text is read for the merged top K only
+	type shardRank struct {
+		TermRank
+		shard int
+	}
+	ranks := make([]shardRank, 0)
+	failed := &corpus.PartialError{}
+	for shard, r := range results {
+		for _, rank := range r.ranks {
+			ranks = append(ranks, shardRank{rank, shard})
+		}
+		failed.Add(r.failed.Err())
+	}
+	sort.SliceStable(ranks, func(i, j int) bool { return ranks[i].Score > ranks[j].Score })
+
+	merged := make([]TermRank, 0)
+	for _, rank := range ranks {
+		if len(merged) == top {
+			break
+		}
+		rank.Content = storedText(results[rank.shard].snapshot, rank.DocID, failed)
+		rank.DocID = index.globalID(rank.shard, rank.DocID)
+		merged = append(merged, rank.TermRank)
+	}
+
+	return merged, failed.Err()
+
+}
+
+// Run f for every shard at once
+func scatter(results []*shardResult, f func(*shardResult)) {
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(results))
+
+	for _, r := range results {
+		go func(r *shardResult) {
+			defer wg.Done()
+			f(r)
+		}(r)
+	}
+
+	wg.Wait()
+
+}
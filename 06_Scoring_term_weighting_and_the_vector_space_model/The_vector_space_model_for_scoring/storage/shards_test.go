@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedCosineScore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	docs := filepath.Join(dir, "docs")
+	os.Mkdir(docs, 0777)
+	for i := 0; i < 8; i++ {
+		text := fmt.Sprintf("what did zebra%d say about %s", i, "the apple of hamlet"[:4+i])
+		ioutil.WriteFile(filepath.Join(docs, fmt.Sprintf("text%d.txt", i)), []byte(text), 0666)
+	}
+
+	sharded, err := InitShardedStorage(docs, filepath.Join(dir, "sharded"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	// the same documents in one index
+	os.Mkdir(filepath.Join(dir, "single"), 0777)
+	if err := buildStorage(docs, filepath.Join(dir, "single", "index.dat"), nil); err != nil {
+		t.Fatal(err)
+	}
+	single, err := OpenIndex(filepath.Join(dir, "single"), auxiliaryDocuments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+
+	used := 0
+	for _, shard := range sharded.shards {
+		snapshot := shard.Snapshot()
+		if n := snapshot.docsNum(); n > 0 && n < 8 {
+			used++
+		}
+		snapshot.Release()
+	}
+	if used < 2 {
+		t.Fatalf("expected documents split between shards, %d shards are used", used)
+	}
+
+	// idf of the whole collection gives every shard the scores of one index,
+	// every document is asked for, so ties are not cut differently
+	for _, query := range []string{"what did", "zebra3 hamlet", "the apple say"} {
+		expected, err := CosineScore(single, query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ShardedCosineScore(sharded, query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("expected %d results for %q, got %d", len(expected), query, len(actual))
+		}
+		scores := make(map[string]float32)
+		for _, r := range expected {
+			scores[r.File] = r.Score
+		}
+		for i, r := range actual {
+			if math.Abs(float64(r.Score-expected[i].Score)) > 1e-5 {
+				t.Errorf("expected score %v at %d for %q, got %v", expected[i].Score, i, query, r.Score)
+			}
+			if score, ok := scores[r.File]; !ok || math.Abs(float64(score-r.Score)) > 1e-5 {
+				t.Errorf("expected %s scored %v for %q, got %v", r.File, score, query, r.Score)
+			}
+			if info, ok := sharded.Document(r.DocID); !ok || info.Path != r.File {
+				t.Errorf("expected global doc ID %d of %s, got %v", r.DocID, r.File, info)
+			}
+			if r.Content == "" {
+				t.Errorf("expected text of %s", r.File)
+			}
+		}
+	}
+
+	if res, _ := ShardedCosineScore(sharded, "what did", 2); len(res) != 2 {
+		t.Errorf("expected top 2 of the merged lists, got %v", res)
+	}
+
+	// changes go to the shard of the file
+	path := filepath.Join(docs, "giraffe.txt")
+	ioutil.WriteFile(path, []byte("giraffe"), 0666)
+	id, err := sharded.AddDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := ShardedCosineScore(sharded, "giraffe", 5); len(res) != 1 || res[0].DocID != id {
+		t.Errorf("expected added document %d, got %v", id, res)
+	}
+	if doc, err := sharded.StoredDocument(id); err != nil || doc.Text != "giraffe" {
+		t.Errorf("expected stored giraffe, got %v, %v", doc, err)
+	}
+	if err := sharded.DeleteDocument(id); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := ShardedCosineScore(sharded, "giraffe", 5); len(res) != 0 {
+		t.Errorf("expected deleted document to be gone, got %v", res)
+	}
+
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"../corpus"
+	"errors"
+	"fmt"
+	"github.com/emirpasic/gods/maps/treemap"
+	"sort"
+)
+
+// Snapshot is a consistent view of the index. Nothing it refers to is changed,
+// files of its segments are kept on disk until every snapshot that has them is released.
+type Snapshot struct {
+	index    *Index
+	segments []*segment
+	memory   []*memoryDocument
+	deleted  *corpus.Bitmap
+	// readers of the snapshot and the index while it is current
+	refs int
+}
+
+// memoryDocument is one document of Z0, it is never changed after it is parsed
+type memoryDocument struct {
+	id     int
+	path   string
+	doc    corpus.ParsedDocument
+	corpus *corpus.Corpus
+}
+
+func newMemoryDocument(docID int, path string, doc corpus.ParsedDocument, tokens []corpus.Token) *memoryDocument {
+
+	c := corpus.NewCorpus()
+	c.BuildIndexFromTokens(tokens)
+
+	return &memoryDocument{docID, path, doc, c}
+
+}
+
+func (d *memoryDocument) stored() corpus.StoredDocument {
+	return corpus.StoredDocument{ID: d.id, Path: d.path, Text: d.doc.Text, Fields: d.doc.Fields}
+}
+
+// Release the snapshot, segments that no snapshot has anymore are removed
+func (s *Snapshot) Release() {
+
+	index := s.index
+	dropped := make([]*segment, 0)
+	kept := make([]*segment, 0)
+
+	index.mutex.Lock()
+	s.refs--
+	if s.refs == 0 {
+		for _, seg := range s.segments {
+			seg.refs--
+			if seg.refs == 0 && seg.kept {
+				kept = append(kept, seg)
+			} else if seg.refs == 0 {
+				dropped = append(dropped, seg)
+			}
+		}
+	}
+	index.mutex.Unlock()
+
+	for _, seg := range kept {
+		seg.release()
+	}
+	for _, seg := range dropped {
+		seg.remove()
+	}
+
+}
+
+// Indexes of the segments on disk
+func (s *Snapshot) Segments() []*corpus.BlockTree {
+
+	trees := make([]*corpus.BlockTree, 0, len(s.segments))
+	for _, seg := range s.segments {
+		trees = append(trees, seg.BlockTree)
+	}
+
+	return trees
+
+}
+
+// Stored text of the live document, segments written before the store was kept have none
+func (s *Snapshot) document(docID int) (corpus.StoredDocument, error) {
+
+	if !s.hasDocument(docID) {
+		return corpus.StoredDocument{}, fmt.Errorf("%w: %d", ErrDocumentNotFound, docID)
+	}
+
+	for _, d := range s.memory {
+		if d.id == docID {
+			return d.stored(), nil
+		}
+	}
+
+	for _, seg := range s.segments {
+		if seg.Store != nil && seg.Store.Contains(docID) {
+			doc, err := seg.Store.Get(docID)
+			if err != nil {
+				return doc, corpus.NewFileError(corpus.StorePath(seg.indexFile), err)
+			}
+			return doc, nil
+		}
+	}
+
+	return corpus.StoredDocument{}, fmt.Errorf("%w: %d is not stored", ErrDocumentNotFound, docID)
+
+}
+
+// New snapshot with the same content, the writer changes it before publishing
+func (s *Snapshot) derive() *Snapshot {
+	return &Snapshot{segments: s.segments, memory: s.memory, deleted: s.deleted}
+}
+
+// New snapshot with the documents added to Z0, memory of older snapshots is not touched
+func (s *Snapshot) withDocuments(documents []*memoryDocument) *Snapshot {
+
+	derived := s.derive()
+	derived.memory = append(s.memory[:len(s.memory):len(s.memory)], documents...)
+
+	return derived
+
+}
+
+// Amount of live documents in every part of the snapshot,
+// bits are cleared when deleted documents leave the index
+func (s *Snapshot) docsNum() int {
+
+	n := 0
+	for _, seg := range s.segments {
+		n += seg.Documents.Size()
+	}
+	for _, d := range s.memory {
+		n += d.corpus.Documents.Size()
+	}
+
+	return n - s.deleted.Count()
+
+}
+
+// Live document is in one of the parts and is not deleted
+func (s *Snapshot) hasDocument(docID int) bool {
+
+	if s.deleted.Contains(docID) {
+		return false
+	}
+
+	for _, seg := range s.segments {
+		if _, ok := seg.Documents.Get(docID); ok {
+			return true
+		}
+	}
+
+	for _, d := range s.memory {
+		if _, ok := d.corpus.Documents.Get(docID); ok {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// IDs of live documents of the file in every part
+func (s *Snapshot) documentIDs(path string) []int {
+
+	ids := make([]int, 0)
+
+	for _, seg := range s.segments {
+		for id, file := range seg.Files {
+			if file == path && !s.deleted.Contains(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	for _, d := range s.memory {
+		if d.path == path && !s.deleted.Contains(d.id) {
+			ids = append(ids, d.id)
+		}
+	}
+
+	return ids
+
+}
+
+// Postings of live documents of the term from every part of the snapshot sorted by doc ID,
+// idf is counted over documents of all parts
+func (s *Snapshot) postings(term string) (corpus.SerializedToken, error) {
+
+	parts := make([]corpus.SerializedToken, 0)
+
+	for _, seg := range s.segments {
+		token, err := getPostings(seg.BlockTree, term)
+		if errors.Is(err, ErrTermNotFound) {
+			continue
+		}
+		if err != nil {
+			return corpus.SerializedToken{}, err
+		}
+		parts = append(parts, token)
+	}
+
+	for _, d := range s.memory {
+		if token, ok := d.postings(term); ok {
+			parts = append(parts, token)
+		}
+	}
+
+	merged := mergePostings(term, parts, s.docsNum(), s.deleted)
+	if len(merged.Docs) == 0 {
+		return corpus.SerializedToken{}, fmt.Errorf("%w: %q", ErrTermNotFound, term)
+	}
+
+	return merged, nil
+
+}
+
+// Postings of the term in the document of Z0
+func (d *memoryDocument) postings(term string) (corpus.SerializedToken, bool) {
+
+	value, ok := d.corpus.Get(term)
+	if !ok {
+		return corpus.SerializedToken{}, false
+	}
+	ind := value.(corpus.Index)
+
+	token := corpus.SerializedToken{Term: term, TotalFrequency: ind.TotalFrequency}
+	ind.Docs.Each(func(key, value interface{}) {
+		doc := value.(corpus.Doc)
+		token.Docs = append(token.Docs, corpus.SerializedDoc{
+			Positions: corpus.EncodePositions(doc.Positions),
+			DocID:     doc.ID,
+			File:      doc.File,
+			Frequency: doc.Frequency,
+		})
+	})
+
+	return token, true
+
+}
+
+// Join postings of different parts without deleted documents, a document is in one part only.
+// Cached tokens are shared, so docs are copied before idf is changed. Encoded doc IDs of a segment
+// are kept when it is the only part and none of its documents is deleted, so intersection still skips blocks.
+func mergePostings(term string, parts []corpus.SerializedToken, docsNum int, deleted *corpus.Bitmap) corpus.SerializedToken {
+
+	merged := corpus.SerializedToken{Term: term}
+	deletions := false
+	for _, p := range parts {
+		for _, d := range p.Docs {
+			if deleted.Contains(d.DocID) {
+				deletions = true
+				continue
+			}
+			merged.Docs = append(merged.Docs, d)
+			merged.TotalFrequency += d.Frequency
+		}
+	}
+
+	for i := range merged.Docs {
+		merged.Docs[i].InverseDocumentFrequency = corpus.CountInverseDocumentFrequency(docsNum, merged.Docs[i].Frequency)
+	}
+
+	if len(parts) == 1 && !deletions && len(parts[0].DocIDs) > 0 {
+		merged.DocIDs = parts[0].DocIDs
+	} else {
+		sort.Slice(merged.Docs, func(i, j int) bool { return merged.Docs[i].DocID < merged.Docs[j].DocID })
+		ids := make([]int, len(merged.Docs))
+		for i := range merged.Docs {
+			ids[i] = merged.Docs[i].DocID
+		}
+		merged.DocIDs = corpus.EncodePFor(ids)
+	}
+	merged.InverseDocumentFrequency = corpus.CountInverseDocumentFrequency(docsNum, merged.TotalFrequency)
+
+	return merged
+
+}
+
+// Normalized frequency of the term in the document of any part
+func (s *Snapshot) frequency(docID int, term string) (float32, bool) {
+
+	var doc *corpus.DocumentIndex
+
+	for _, seg := range s.segments {
+		if value, ok := seg.Documents.Get(docID); ok {
+			doc = documentVector(value)
+			break
+		}
+	}
+
+	for _, d := range s.memory {
+		if doc != nil {
+			break
+		}
+		if value, ok := d.corpus.Documents.Get(docID); ok {
+			// term counts of Z0 are normalized on the fly
+			doc = normalize(value.(corpus.DocumentIndex))
+		}
+	}
+
+	if doc == nil {
+		return 0, false
+	}
+	frequency, ok := doc.Get(term)
+	if !ok {
+		return 0, false
+	}
+
+	return frequency.(float32), true
+
+}
+
+// Built trees keep document vectors as values, loaded trees keep pointers
+func documentVector(value interface{}) *corpus.DocumentIndex {
+	if doc, ok := value.(*corpus.DocumentIndex); ok {
+		return doc
+	}
+	doc := value.(corpus.DocumentIndex)
+	return &doc
+}
+
+// Copy of the vector of term counts with counts divided by the vector size
+func normalize(counts corpus.DocumentIndex) *corpus.DocumentIndex {
+
+	doc := corpus.DocumentIndex{Map: treemap.NewWithStringComparator()}
+	counts.Each(func(key, value interface{}) {
+		doc.Put(key, float32(value.(int))/float32(counts.Size()))
+	})
+
+	return &doc
+
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	first := filepath.Join(dir, "new0.txt")
+	ioutil.WriteFile(first, []byte("what did zebra0 say"), 0666)
+	if _, err := index.AddDocument(first); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := index.Snapshot()
+	flushed := added(index)[0]
+
+	// the segment is merged with a later one, the snapshot still has it
+	second := filepath.Join(dir, "new1.txt")
+	ioutil.WriteFile(second, []byte("what did zebra1 say"), 0666)
+	if _, err := index.AddDocument(second); err != nil {
+		t.Fatal(err)
+	}
+	index.SetMergePolicy(mergeAll)
+	waitMerges(t, index)
+	if len(current(index).segments) != 1 {
+		t.Fatal("expected segments to be merged")
+	}
+
+	if _, err := snapshot.postings("zebra1"); err == nil {
+		t.Error("expected snapshot not to see the later document")
+	}
+	token, err := snapshot.postings("zebra0")
+	if err != nil || len(token.Docs) != 1 || token.Docs[0].File != first {
+		t.Errorf("expected snapshot to read the merged segment, got %v, %v", token, err)
+	}
+	if _, err := os.Stat(flushed.indexFile); err != nil {
+		t.Errorf("expected segment of the snapshot to stay on disk, got %v", err)
+	}
+
+	snapshot.Release()
+	if _, err := os.Stat(filepath.Dir(flushed.indexFile)); !os.IsNotExist(err) {
+		t.Errorf("expected released segment to be removed, got %v", err)
+	}
+
+	// the current snapshot is not affected
+	if res, err := CosineScore(index, "zebra0", 10); err != nil || len(res) != 1 {
+		t.Errorf("expected merged document to be found, got %v, %v", res, err)
+	}
+
+}
+
+func TestConcurrentSearch(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	docs := filepath.Join(dir, "docs")
+	os.Mkdir(docs, 0777)
+	for i := 0; i < 8; i++ {
+		ioutil.WriteFile(filepath.Join(docs, fmt.Sprintf("new%d.txt", i)), []byte(fmt.Sprintf("what did zebra%d say", i)), 0666)
+	}
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// every snapshot has at least the main index
+				if res, err := CosineScore(index, "What did", 10); err != nil || len(res) < 2 {
+					t.Errorf("unexpected result %v, %v", res, err)
+					return
+				}
+				if _, err := PositionalIntersect(index, "mean", "say", 3); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	// segments are merged in the background while documents are added and searched
+	index.SetMergePolicy(mergeAll)
+	if _, err := index.AddDirectory(docs); err != nil {
+		t.Error(err)
+	}
+	waitMerges(t, index)
+	close(done)
+	wg.Wait()
+
+	if n := current(index).docsNum(); n != 10 {
+		t.Errorf("expected 10 documents, got %d", n)
+	}
+
+}
+
+func TestPostingsOfOneSegment(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	defer index.Close()
+
+	snapshot := index.Snapshot()
+	stored, err := getPostings(snapshot.segments[0].BlockTree, "mean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := snapshot.postings("mean")
+	snapshot.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &token.DocIDs[0] != &stored.DocIDs[0] {
+		t.Error("expected encoded doc IDs of the only segment to be kept")
+	}
+
+	// a deleted document is cut out of the doc IDs
+	if err := index.DeleteDocument(stored.Docs[0].DocID); err != nil {
+		t.Fatal(err)
+	}
+	snapshot = index.Snapshot()
+	defer snapshot.Release()
+	token, err = snapshot.postings("mean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := token.DocIDs.Decode(); err != nil || len(ids) != len(stored.Docs)-1 || ids[0] == stored.Docs[0].DocID {
+		t.Errorf("expected doc IDs without the deleted document, got %v, %v", ids, err)
+	}
+
+}
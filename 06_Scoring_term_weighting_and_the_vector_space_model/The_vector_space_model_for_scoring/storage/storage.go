@@ -4,65 +4,142 @@ import (
 	"../corpus"
 	"../spimi"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 )
 
 const (
 	outputFile = "blocks/index.dat"
-	tempBlockSize = 5000
+	memoryBudget = 32 << 20
 	termsInBlock = 4
+	// documents in the auxiliary index before it is merged to disk
+	auxiliaryDocuments = 64
 )
 
-func InitStorage(inputDir string) *corpus.BlockTree {
+// Open the storage of the last commit point, when there is none the main index is built
+// from documents of the input dir first. Documents that can not be read are reported
+// by *corpus.PartialError along with the loaded index.
+// To index the input dir again remove the commit point.
+func InitStorage(inputDir string) (*Index, error) {
 
-	var bt *corpus.BlockTree
+	dir := filepath.Dir(outputFile)
+	var buildErr error
 
-	if !fileExists(outputFile) {
-		bt = spimi.Spimi(inputDir, outputFile, tempBlockSize, termsInBlock)
+	if !fileExists(filepath.Join(dir, commitFile)) {
+		buildErr = buildStorage(inputDir, outputFile, nil)
+		// unreadable documents do not stop the build
+		if _, partial := buildErr.(*corpus.PartialError); buildErr != nil && !partial {
+			return nil, buildErr
+		}
+	}
+
+	index, err := OpenIndex(dir, auxiliaryDocuments)
+	if index == nil {
+		return nil, err
 	}
 
-	bt = loadBTree(outputFile)
+	failed := &corpus.PartialError{}
+	failed.Add(buildErr)
+	failed.Add(err)
 
-	return bt
+	return index, failed.Err()
 
 }
 
-func DeserializeBlock(path string) *corpus.SerializedCorpus{
-	f , err := os.Open(path)
+// Build the main index of the documents include accepts and commit it next to indexFile.
+// Documents that can not be read are reported by *corpus.PartialError, any other error
+// leaves no commit point.
+func buildStorage(inputDir, indexFile string, include func(path string) bool) error {
+
+	dir := filepath.Dir(indexFile)
+
+	// blocks of the dir are going to be rewritten, old mappings would point to truncated files,
+	// other indexes keep their mappings and cached postings
+	unmapDir(dir)
+	// changes of the old index must not be replayed into the new one
+	os.Remove(filepath.Join(dir, logFile))
+	bt, buildErr := spimi.SpimiFiltered(inputDir, indexFile, memoryBudget, termsInBlock, include)
+	if bt == nil {
+		return buildErr
+	}
+	// segments of the old commit point are orphans now
+	built := NewIndex(bt, indexFile, auxiliaryDocuments)
+	err := built.writeCommit(built.current)
+	built.Close()
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-	defer f.Close()
 
-	stat, err := f.Stat()
+	return buildErr
+
+}
+
+// Decode the whole block from the shared mapping
+func DeserializeBlock(path string) (*corpus.SerializedCorpus, error) {
+
+	block, err := openBlock(path)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 
-	data := make([]byte, stat.Size())
+	sc, err := block.Corpus()
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
 
-	for {
-		_, err = f.Read(data)
-		if err != nil {
-			if err == io.EOF {
-				break // end of the file
-			} else {
-				fmt.Println("Error reading file", err);
-				os.Exit(1)
-			}
-		}
+	return sc, nil
+
+}
+
+// Decode postings of the term only, the rest of the block is not touched
+func DeserializeTerm(term, path string) (corpus.SerializedToken, error) {
+
+	block, err := openBlock(path)
+	if err != nil {
+		return corpus.SerializedToken{}, err
 	}
 
-	return corpus.SerializedCorpusFromBlock(string(data))
+	token, ok, err := block.Find(term)
+	if err != nil {
+		return corpus.SerializedToken{}, corpus.NewFileError(path, err)
+	}
+	if !ok {
+		return corpus.SerializedToken{}, fmt.Errorf("%w: %q in %s", ErrTermNotFound, term, path)
+	}
+
+	return token, nil
 
 }
 
-func DeserializeTerm(term, path string) corpus.SerializedToken {
-	return DeserializeBlock(path).Filter(func(token corpus.SerializedToken) bool{
-		return token.Term == term
-	}).Tokens[0]
+// Get postings list of the term, decoded lists are kept in the shared cache.
+// Many indexes have the same terms, so lists are cached by block and term.
+func getPostings(bt *corpus.BlockTree, term string) (corpus.SerializedToken, error) {
+
+	// definitely absent terms never reach the dictionary or block files
+	if bt.Filter != nil && !bt.Filter.MayContain(term) {
+		return corpus.SerializedToken{}, fmt.Errorf("%w: %q", ErrTermNotFound, term)
+	}
+
+	block, ok := bt.Get(term)
+	if !ok {
+		return corpus.SerializedToken{}, fmt.Errorf("%w: %q", ErrTermNotFound, term)
+	}
+
+	key := block.(string) + "\x00" + term
+	if token, ok := Cache.Get(key); ok {
+		return token, nil
+	}
+
+	token, err := DeserializeTerm(term, block.(string))
+	if err != nil {
+		return token, err
+	}
+	Cache.Put(key, token)
+
+	return token, nil
+
 }
 
 func fileExists(path string) bool {
@@ -73,39 +150,108 @@ func fileExists(path string) bool {
 		return false
 	}
 
-	return false
 	return true
 
 }
 
-func loadBTree(path string) *corpus.BlockTree {
+// Open already built storage, block paths of the tree are relative to the working directory.
+// The tree is nil only when the index itself can not be read.
+func OpenStorage(indexFile string) (*corpus.BlockTree, error) {
+	return loadBTree(indexFile)
+}
+
+// Index files of the segments the commit point in dir lists and the documents it deletes
+// from them. Storage written before commit points has only the main index dir/index.dat.
+func CommittedSegments(dir string) ([]string, *corpus.Bitmap, error) {
+
+	path := filepath.Join(dir, commitFile)
+	if !fileExists(path) {
+		return []string{filepath.Join(dir, "index.dat")}, corpus.NewBitmap(), nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, corpus.NewFileError(path, err)
+	}
+	commit, err := corpus.ReadCommitPoint(data)
+	if err != nil {
+		return nil, nil, corpus.NewFileError(path, err)
+	}
+
+	segments := make([]string, 0, len(commit.Segments))
+	for _, s := range commit.Segments {
+		segments = append(segments, s.IndexFile)
+	}
+
+	return segments, commit.Deleted, nil
+
+}
+
+// Filter is optional, a missing one is not an error, a corrupt one is returned along with the tree
+func loadBTree(path string) (*corpus.BlockTree, error) {
 
-	f , err := os.Open(path)
+	m, err := openMapped(path)
 	if err != nil {
-		log.Println(err)
+		return nil, corpus.NewFileError(path, err)
 	}
-	defer f.Close()
+	// block tree is copied into maps, so the mapping is not needed anymore
+	defer closeMapped(path)
 
-	stat, err := f.Stat()
+	bt, version, err := corpus.ReadBlockTree(m.data)
 	if err != nil {
-		log.Println(err)
+		return nil, corpus.NewFileError(path, err)
+	}
+	if version < corpus.FormatVersion {
+		log.Printf("index %s has format version %d, it is upgraded on every load, run migrate", path, version)
 	}
 
-	data := make([]byte, stat.Size())
+	bt.Filter, err = loadBloomFilter(corpus.BloomFilterPath(path))
 
-	for {
-		_, err = f.Read(data)
-		if err != nil {
-			if err == io.EOF {
-				break // end of the file
-			} else {
-				fmt.Println("Error reading file", err);
-				os.Exit(1)
-			}
-		}
+	// a missing store only takes the text of results away
+	store, storeErr := loadStore(corpus.StorePath(path))
+	bt.Store = store
+	if err == nil {
+		err = storeErr
+	}
+
+	return bt, err
+
+}
+
+func loadStore(path string) (*corpus.DocumentStore, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
+
+	store, err := corpus.ReadDocumentStore(data)
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
+
+	return store, nil
+
+}
+
+func loadBloomFilter(path string) (*corpus.BloomFilter, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
+	}
+
+	bf, _, err := corpus.ReadBloomFilter(data)
+	if err != nil {
+		return nil, corpus.NewFileError(path, err)
 	}
-	bt := corpus.BlockTreeFromGOB64(string(data))
 
-	return bt
+	return bf, nil
 
 }
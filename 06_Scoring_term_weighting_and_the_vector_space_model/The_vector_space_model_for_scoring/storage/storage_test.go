@@ -1,7 +1,9 @@
 package storage
 
 import (
-	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -23,9 +25,162 @@ func TestCosineSimilarity(t *testing.T) {
 
 func TestCosineScore(t *testing.T) {
 
-	bt := InitStorage("/home/danil/Проекты/Go/Information_Retrieval/06_Scoring_term_weighting_and_the_vector_space_model/The_vector_space_model_for_scoring/spimi/data")
-	fmt.Println(ITFScore(bt, "What", "did"))
-	fmt.Println("----")
-	fmt.Println(CosineScore(bt, `What did`, 10))
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
 
-}
\ No newline at end of file
+	if err := buildStorage("../spimi/data", filepath.Join(dir, "index.dat"), nil); err != nil {
+		t.Fatal(err)
+	}
+	bt, err := OpenIndex(dir, auxiliaryDocuments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bt.Close()
+
+	// "What" is capitalized in text1.txt only
+	res, err := ITFScore(bt, "What", "did")
+	if err != nil || len(res) != 1 || filepath.Base(res[0].File) != "text1.txt" {
+		t.Errorf("expected text1.txt to have both terms, got %v, %v", res, err)
+	}
+
+	res, err = CosineScore(bt, `What did`, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || filepath.Base(res[0].File) != "text1.txt" || filepath.Base(res[1].File) != "text2.txt" {
+		t.Fatalf("expected text1.txt ranked above text2.txt, got %v", res)
+	}
+	if res[1].Score <= 0 || res[0].Score <= res[1].Score {
+		t.Errorf("expected positive scores in decreasing order, got %v and %v", res[0].Score, res[1].Score)
+	}
+	for _, r := range res {
+		if r.Content == "" {
+			t.Errorf("expected text of %s", r.File)
+		}
+	}
+
+}
+
+func mappedIn(dir string) int {
+
+	mapped.mutex.RLock()
+	defer mapped.mutex.RUnlock()
+
+	n := 0
+	for path := range mapped.files {
+		if inDir(path, dir) {
+			n++
+		}
+	}
+
+	return n
+
+}
+
+// Building an index keeps mappings and cached postings of the other indexes
+func TestBuildKeepsOtherIndexes(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	os.Mkdir(first, 0777)
+	os.Mkdir(second, 0777)
+	if err := buildStorage("../spimi/data", filepath.Join(first, "index.dat"), nil); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenIndex(first, auxiliaryDocuments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	Cache.Purge()
+	if _, err := CosineScore(index, "what did", 10); err != nil {
+		t.Fatal(err)
+	}
+	blocks, terms := mappedIn(first), Cache.Stats().Terms
+	if blocks == 0 || terms == 0 {
+		t.Fatalf("expected mapped blocks and cached postings, got %d and %d", blocks, terms)
+	}
+
+	if err := buildStorage("../spimi/data", filepath.Join(second, "index.dat"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if mappedIn(first) != blocks || Cache.Stats().Terms != terms {
+		t.Errorf("expected %d blocks and %d terms kept, got %d and %d", blocks, terms, mappedIn(first), Cache.Stats().Terms)
+	}
+	if res, err := CosineScore(index, "what did", 10); err != nil || len(res) != 2 {
+		t.Errorf("expected the first index still answers, got %v, %v", res, err)
+	}
+
+}
+
+// Documents of one file are ranked on their own, not folded into one result of the file
+func TestScoreDocumentsOfFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	docs := filepath.Join(dir, "docs")
+	os.Mkdir(docs, 0777)
+	rows := filepath.Join(docs, "rows.jsonl")
+	ioutil.WriteFile(rows, []byte(`{"title": "one", "text": "what did zebra say"}
+{"title": "two", "text": "zebra zebra say"}
+{"title": "three", "text": "what did lion say"}
+`), 0666)
+	ioutil.WriteFile(filepath.Join(docs, "other.txt"), []byte("what did giraffe mean"), 0666)
+
+	os.Mkdir(filepath.Join(dir, "single"), 0777)
+	if err := buildStorage(docs, filepath.Join(dir, "single", "index.dat"), nil); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenIndex(filepath.Join(dir, "single"), auxiliaryDocuments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	sharded, err := InitShardedStorage(docs, filepath.Join(dir, "sharded"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	// every row of rows.jsonl with the term is a result of its own
+	check := func(name string, res []TermRank, err error, expected int) {
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ids := make(map[int]bool)
+		for _, r := range res {
+			if r.File != rows {
+				t.Errorf("%s: expected %s, got %s", name, rows, r.File)
+			}
+			ids[r.DocID] = true
+		}
+		if len(res) != expected || len(ids) != expected {
+			t.Errorf("%s: expected %d documents of one file, got %v", name, expected, res)
+		}
+	}
+
+	res, err := CosineScore(index, "zebra", 10)
+	check("cosine score", res, err, 2)
+	res, err = ShardedCosineScore(sharded, "zebra", 10)
+	check("sharded cosine score", res, err, 2)
+	res, err = ITFScore(index, "say", "zebra")
+	check("tf-idf score", res, err, 2)
+
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"../corpus"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kinds of problems found by Verify
+const (
+	ProblemMissingIndex    = "missing index"
+	ProblemCorruptIndex    = "corrupt index"
+	ProblemOldFormat       = "old format version"
+	ProblemMissingBlock    = "missing block"
+	ProblemChecksum        = "checksum mismatch"
+	ProblemMissingChecksum = "missing checksum"
+	ProblemCorruptBlock    = "corrupt block"
+	ProblemMissingTerm     = "term not in block"
+	ProblemOrphanTerm      = "term not in dictionary"
+	ProblemUnsorted        = "unsorted postings"
+	ProblemDuplicate       = "duplicate posting"
+	ProblemUnknownDocument = "unknown document"
+	ProblemDocumentTerm    = "document vector mismatch"
+	ProblemOrphanBlock     = "orphan block"
+)
+
+// Problem is one inconsistency between index.dat and block files
+type Problem struct {
+	Kind   string
+	Block  string
+	Term   string
+	Detail string
+	Repair string
+}
+
+// VerifyReport is the result of storage verification
+type VerifyReport struct {
+	Index     string
+	Terms     int
+	Blocks    int
+	Documents int
+	Problems  []Problem
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(p Problem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// Check that every term of the block tree resolves to a block that contains it,
+// postings are sorted and deduplicated, block checksums match and document IDs
+// agree with the tree's documents. Block files are read directly, not through the
+// shared mappings, so truncated files can not crash the process.
+func Verify(indexFile string) *VerifyReport {
+
+	report := &VerifyReport{Index: indexFile}
+
+	data, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		report.add(Problem{
+			Kind:   ProblemMissingIndex,
+			Detail: err.Error(),
+			Repair: "rebuild the storage from source documents",
+		})
+		return report
+	}
+
+	bt, version, err := corpus.ReadBlockTree(data)
+	if err != nil {
+		report.add(Problem{
+			Kind:   ProblemCorruptIndex,
+			Block:  indexFile,
+			Detail: err.Error(),
+			Repair: "rebuild the storage from source documents",
+		})
+		return report
+	}
+	if version < corpus.FormatVersion {
+		report.add(oldFormat(indexFile, version))
+	}
+
+	report.Terms = bt.Size()
+	report.Documents = bt.Documents.Size()
+
+	// terms of the dictionary grouped by block
+	blocks := make(map[string][]string)
+	for _, key := range bt.Keys() {
+		block, _ := bt.Get(key)
+		blocks[block.(string)] = append(blocks[block.(string)], key.(string))
+	}
+	report.Blocks = len(blocks)
+
+	paths := make([]string, 0, len(blocks))
+	for path := range blocks {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		verifyBlock(report, bt, path, blocks[path])
+	}
+
+	verifyDocuments(report, bt)
+	findOrphanBlocks(report, indexFile, blocks)
+
+	return report
+
+}
+
+// Verify every segment the commit point in dir lists, one report per segment.
+// A commit point that can not be read gives a single report of its problem.
+func VerifyStorage(dir string) []*VerifyReport {
+
+	segments, _, err := CommittedSegments(dir)
+	if err != nil {
+		report := &VerifyReport{Index: filepath.Join(dir, commitFile)}
+		report.add(Problem{
+			Kind:   ProblemCorruptIndex,
+			Block:  report.Index,
+			Detail: err.Error(),
+			Repair: "rebuild the storage from source documents",
+		})
+		return []*VerifyReport{report}
+	}
+
+	reports := make([]*VerifyReport, 0, len(segments))
+	for _, indexFile := range segments {
+		reports = append(reports, Verify(indexFile))
+	}
+
+	return reports
+
+}
+
+func verifyBlock(report *VerifyReport, bt *corpus.BlockTree, path string, terms []string) {
+
+	rebuild := "rebuild the storage, terms of this block are not searchable"
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		report.add(Problem{ProblemMissingBlock, path, "", err.Error(), rebuild})
+		return
+	}
+
+	if crc, ok := bt.Checksums[path]; !ok {
+		report.add(Problem{ProblemMissingChecksum, path, "", "index has no checksum for the block", "rebuild the storage to record checksums"})
+	} else if actual := corpus.Checksum(data); actual != crc {
+		report.add(Problem{ProblemChecksum, path, "", fmt.Sprintf("expected %08x, got %08x", crc, actual), rebuild})
+	}
+
+	block, version, err := corpus.ReadBlock(data)
+	if err != nil {
+		report.add(Problem{ProblemCorruptBlock, path, "", err.Error(), rebuild})
+		return
+	}
+	if version < corpus.FormatVersion {
+		report.add(oldFormat(path, version))
+	}
+
+	expected := make(map[string]bool)
+	for _, term := range terms {
+		expected[term] = true
+		token, ok, err := block.Find(term)
+		if err != nil {
+			report.add(Problem{ProblemCorruptBlock, path, term, err.Error(), rebuild})
+			continue
+		}
+		if !ok {
+			report.add(Problem{ProblemMissingTerm, path, term, "dictionary points to the block, but the block has no such term", rebuild})
+			continue
+		}
+		verifyPostings(report, bt, path, token)
+	}
+
+	for i := 0; i < block.Len(); i++ {
+		if term := block.Term(i); !expected[term] {
+			report.add(Problem{ProblemOrphanTerm, path, term, "block contains a term the dictionary does not point to", "rebuild the storage, the term is not searchable"})
+		}
+	}
+
+}
+
+func oldFormat(path string, version int) Problem {
+	return Problem{ProblemOldFormat, path, "", fmt.Sprintf("written with format version %d, current is %d", version, corpus.FormatVersion), "run migrate, the file is upgraded on every load"}
+}
+
+func verifyPostings(report *VerifyReport, bt *corpus.BlockTree, path string, token corpus.SerializedToken) {
+
+	for i, d := range token.Docs {
+		if i > 0 {
+			prev := token.Docs[i-1].DocID
+			if d.DocID == prev {
+				report.add(Problem{ProblemDuplicate, path, token.Term, fmt.Sprintf("doc %d is listed twice", d.DocID), "rebuild the storage"})
+			} else if d.DocID < prev {
+				report.add(Problem{ProblemUnsorted, path, token.Term, fmt.Sprintf("doc %d goes after doc %d", d.DocID, prev), "rebuild the storage, intersections skip documents"})
+			}
+		}
+
+		doc, ok := bt.Documents.Get(d.DocID)
+		if !ok {
+			report.add(Problem{ProblemUnknownDocument, path, token.Term, fmt.Sprintf("doc %d (%s) is not in documents", d.DocID, d.File), "rebuild the storage, cosine score ignores the document"})
+			continue
+		}
+		if _, ok := doc.(*corpus.DocumentIndex).Get(token.Term); !ok {
+			report.add(Problem{ProblemDocumentTerm, path, token.Term, fmt.Sprintf("doc %d vector has no such term", d.DocID), "rebuild the storage, cosine score ignores the posting"})
+		}
+	}
+
+}
+
+// Every term of a document vector must be in the dictionary
+func verifyDocuments(report *VerifyReport, bt *corpus.BlockTree) {
+
+	bt.Documents.Each(func(key, value interface{}) {
+		value.(*corpus.DocumentIndex).Each(func(term, _ interface{}) {
+			if _, ok := bt.Get(term); !ok {
+				report.add(Problem{ProblemDocumentTerm, "", term.(string), fmt.Sprintf("doc %d vector has a term missing from the dictionary", key.(int)), "rebuild the storage"})
+			}
+		})
+	})
+
+}
+
+// Block files next to the index that the dictionary never points to
+func findOrphanBlocks(report *VerifyReport, indexFile string, blocks map[string][]string) {
+
+	referenced := make(map[string]bool)
+	for path := range blocks {
+		referenced[filepath.Clean(path)] = true
+	}
+
+	dir := filepath.Dir(indexFile)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "block") || referenced[path] {
+			continue
+		}
+		report.add(Problem{ProblemOrphanBlock, path, "", "block is not referenced by the index", "delete the file"})
+	}
+
+}
+
+// Print repair report
+func (r *VerifyReport) Print(w io.Writer) {
+
+	fmt.Fprintf(w, "index %s: %d terms, %d blocks, %d documents\n", r.Index, r.Terms, r.Blocks, r.Documents)
+
+	if r.OK() {
+		fmt.Fprintln(w, "no problems found")
+		return
+	}
+
+	fmt.Fprintf(w, "%d problems found:\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "[%s]", p.Kind)
+		if p.Block != "" {
+			fmt.Fprintf(w, " block %s", p.Block)
+		}
+		if p.Term != "" {
+			fmt.Fprintf(w, " term %q", p.Term)
+		}
+		fmt.Fprintf(w, ": %s\n\trepair: %s\n", p.Detail, p.Repair)
+	}
+
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"../corpus"
+	"bytes"
+	"github.com/emirpasic/gods/maps/treemap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func problemKinds(r *VerifyReport) map[string]int {
+	kinds := make(map[string]int)
+	for _, p := range r.Problems {
+		kinds[p.Kind]++
+	}
+	return kinds
+}
+
+func TestVerify(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block0 := filepath.Join(dir, "block0.dat")
+	block1 := filepath.Join(dir, "block1.dat")
+	indexFile := filepath.Join(dir, "index.dat")
+
+	sc := &corpus.SerializedCorpus{Tokens: []corpus.SerializedToken{
+		{Term: "say", Docs: []corpus.SerializedDoc{{DocID: 0}}},
+		// doc 3 is not in documents
+		{Term: "mean", Docs: []corpus.SerializedDoc{{DocID: 0}, {DocID: 3}}},
+	}}
+	data := sc.ToBlockFile()
+	if err := ioutil.WriteFile(block0, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "block7.dat"), data, 0666)
+
+	docs := corpus.NewDocumentTree()
+	vector := corpus.DocumentIndex{Map: treemap.NewWithStringComparator()}
+	vector.Put("say", float32(0.5))
+	vector.Put("mean", float32(0.5))
+	docs.Put(0, vector)
+
+	bt := corpus.NewBlockTree(docs)
+	bt.Put("say", block0)
+	bt.Put("mean", block0)
+	// block1 is never written
+	bt.Put("what", block1)
+	bt.Checksums[block0] = corpus.Checksum(data)
+	bt.Checksums[block1] = 0
+	index, err := bt.MarshalFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(indexFile, index, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := problemKinds(Verify(indexFile))
+	if kinds[ProblemMissingBlock] != 1 || kinds[ProblemUnknownDocument] != 1 || kinds[ProblemOrphanBlock] != 1 || len(kinds) != 3 {
+		t.Errorf("unexpected problems %v", kinds)
+	}
+
+	// an entry that can not be decoded is corruption, not a missing term
+	postings := sc.ToBlock()
+	entry := bytes.Index(postings, []byte("\x04mean")) + 5
+	for i := entry; i < entry+11 && i < len(postings); i++ {
+		postings[i] = 0xff
+	}
+	ioutil.WriteFile(block0, corpus.EncodeFile(corpus.KindBlock, corpus.Section{ID: corpus.SectionPostings, Data: postings}), 0666)
+
+	kinds = problemKinds(Verify(indexFile))
+	if kinds[ProblemCorruptBlock] != 1 || kinds[ProblemMissingTerm] != 0 {
+		t.Errorf("expected corrupt entry, got %v", kinds)
+	}
+
+	// truncated block must be reported, not crash the process
+	ioutil.WriteFile(block0, data[:len(data)/2], 0666)
+
+	kinds = problemKinds(Verify(indexFile))
+	if kinds[ProblemChecksum] != 1 {
+		t.Errorf("expected checksum mismatch, got %v", kinds)
+	}
+
+}
+
+// Segments written after the main index are verified and migrated too
+func TestVerifyStorage(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+
+	added := filepath.Join(dir, "new.txt")
+	ioutil.WriteFile(added, []byte("what did zebra say"), 0666)
+	if _, err := index.AddDocument(added); err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+
+	segments, deleted, err := CommittedSegments(dir)
+	if err != nil || len(segments) != 2 || deleted.Count() != 0 {
+		t.Fatalf("expected main index and one segment, got %v, %v", segments, err)
+	}
+
+	reports := VerifyStorage(dir)
+	if len(reports) != 2 || reports[1].Index != segments[1] || reports[1].Documents != 1 {
+		t.Fatalf("expected a report of every segment, got %v", reports)
+	}
+	for _, r := range reports {
+		if !r.OK() {
+			t.Errorf("unexpected problems of %s: %v", r.Index, r.Problems)
+		}
+	}
+	if migrated, err := MigrateStorage(dir); err != nil || len(migrated) != 0 {
+		t.Errorf("expected nothing to migrate, got %v, %v", migrated, err)
+	}
+
+	bt, err := OpenStorage(segments[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for block := range bt.Checksums {
+		ioutil.WriteFile(block, []byte("damaged"), 0666)
+	}
+	if kinds := problemKinds(VerifyStorage(dir)[1]); kinds[ProblemChecksum] == 0 {
+		t.Errorf("expected damaged segment to be reported, got %v", kinds)
+	}
+
+	// a commit point that can not be read is the only problem
+	ioutil.WriteFile(filepath.Join(dir, commitFile), []byte("damaged"), 0666)
+	if reports := VerifyStorage(dir); len(reports) != 1 || reports[0].Problems[0].Kind != ProblemCorruptIndex {
+		t.Errorf("expected corrupt commit point, got %v", reports)
+	}
+
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"../corpus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Changes of Z0 are logged before they are acknowledged, the log is cut after Z0 is flushed
+const logFile = "wal.dat"
+
+// Called at named points of a flush, crash tests set it to exit the process there
+var failpoint = func(name string) {}
+
+// writeAheadLog appends records of added and deleted documents and syncs every one
+type writeAheadLog struct {
+	path string
+	file *os.File
+}
+
+// Open the log of dir for appending, records left by the last writer are returned.
+// A torn record at the end is cut off, so new records follow the valid ones.
+func openLog(dir string) (*writeAheadLog, []corpus.LogRecord, error) {
+
+	path := filepath.Join(dir, logFile)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data = corpus.NewLog()
+		if err := writeFileAtomic(path, data); err != nil {
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, corpus.NewFileError(path, err)
+	}
+
+	records, size, err := corpus.ReadLog(data)
+	if err != nil {
+		return nil, nil, corpus.NewFileError(path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, corpus.NewFileError(path, err)
+	}
+	if size < len(data) {
+		if err := file.Truncate(int64(size)); err != nil {
+			file.Close()
+			return nil, nil, corpus.NewFileError(path, err)
+		}
+	}
+
+	return &writeAheadLog{path, file}, records, nil
+
+}
+
+// Append the record, it survives a crash once append returns
+func (l *writeAheadLog) append(r corpus.LogRecord) error {
+
+	data, err := r.MarshalRecord()
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(data); err != nil {
+		return corpus.NewFileError(l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return corpus.NewFileError(l.path, err)
+	}
+
+	return nil
+
+}
+
+// Drop every record, they are in the committed segments now
+func (l *writeAheadLog) truncate() error {
+
+	if err := l.file.Truncate(int64(len(corpus.NewLog()))); err != nil {
+		return corpus.NewFileError(l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return corpus.NewFileError(l.path, err)
+	}
+
+	return nil
+
+}
+
+func (l *writeAheadLog) close() error {
+	return l.file.Close()
+}
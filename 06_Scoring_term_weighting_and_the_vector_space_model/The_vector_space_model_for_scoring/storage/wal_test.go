@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"../corpus"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Exit code of a writer process that reached its failpoint
+const crashExitCode = 3
+
+// Runs as a writer process when the crash test starts the test binary again.
+// It opens the index of the dir, adds the document and exits at the failpoint,
+// so nothing after it runs, not even deferred calls.
+func TestWriterProcess(t *testing.T) {
+
+	dir := os.Getenv("STORAGE_CRASH_DIR")
+	if dir == "" {
+		t.Skip("started by TestKillDuringFlush only")
+	}
+
+	point := os.Getenv("STORAGE_CRASH_POINT")
+	failpoint = func(name string) {
+		if name == point {
+			os.Exit(crashExitCode)
+		}
+	}
+
+	index, err := OpenIndex(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.AddDocument(os.Getenv("STORAGE_CRASH_DOCUMENT"))
+
+	t.Fatalf("expected the writer to exit at %s", point)
+
+}
+
+// Add the document in a writer process that exits at the failpoint
+func crashAt(t *testing.T, dir, point, document string) {
+
+	process := exec.Command(os.Args[0], "-test.run=^TestWriterProcess$")
+	process.Env = append(os.Environ(), "STORAGE_CRASH_DIR="+dir, "STORAGE_CRASH_POINT="+point, "STORAGE_CRASH_DOCUMENT="+document)
+	output, err := process.CombinedOutput()
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != crashExitCode {
+		t.Fatalf("expected the writer to exit at %s, got %v\n%s", point, err, output)
+	}
+
+}
+
+// Reopen the dir of a writer that stopped without flushing Z0
+func restart(t *testing.T, index *Index, dir string, auxLimit int) *Index {
+
+	index.Close()
+	UnmapAll()
+
+	reopened, err := OpenIndex(dir, auxLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reopened
+
+}
+
+// Files of the added documents, they are removed after adding to show that the log keeps the text
+func writeDocs(t *testing.T, dir string, n int) []string {
+
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("new%d.txt", i))
+		if err := ioutil.WriteFile(paths[i], []byte(fmt.Sprintf("what did zebra%d say", i)), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return paths
+
+}
+
+func TestLogReplay(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	index = restart(t, index, dir, 10)
+
+	paths := writeDocs(t, dir, 3)
+	for _, path := range paths {
+		if _, err := index.AddDocument(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.DeleteDocument(0); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(paths[1], []byte("what did giraffe say"), 0666)
+	updated, err := index.UpdateDocument(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+
+	// nothing is flushed, every change is in the log only
+	index = restart(t, index, dir, 10)
+	defer index.Close()
+
+	if n := len(current(index).memory); n != 4 {
+		t.Errorf("expected 4 documents in Z0, got %d", n)
+	}
+	if next := index.registry.NextID(); next != updated+1 {
+		t.Errorf("expected next ID %d, got %d", updated+1, next)
+	}
+	if _, ok := index.Document(0); ok {
+		t.Error("expected deleted document to leave the registry")
+	}
+	if info, ok := index.Document(updated); !ok || info.Title != "what did giraffe say" || info.Modified.IsZero() {
+		t.Errorf("expected new version to be registered, got %v, %v", info, ok)
+	}
+
+	res, err := CosineScore(index, "What did", 10)
+	if err != nil || len(res) != 4 {
+		t.Errorf("expected text2.txt and 3 added documents, got %v, %v", res, err)
+	}
+	for _, r := range res {
+		if r.File == "../spimi/data/text1.txt" {
+			t.Error("expected deleted document to stay deleted")
+		}
+	}
+	if res, _ := CosineScore(index, "zebra1", 10); len(res) != 0 {
+		t.Errorf("expected old version to stay deleted, got %v", res)
+	}
+	if res, _ := CosineScore(index, "giraffe", 10); len(res) != 1 || res[0].File != paths[1] {
+		t.Errorf("expected new version, got %v", res)
+	}
+
+	// changes after replay are appended to the same log
+	if err := index.DeleteDocument(updated); err != nil {
+		t.Fatal(err)
+	}
+	index = restart(t, index, dir, 10)
+	defer index.Close()
+	if res, _ := CosineScore(index, "giraffe", 10); len(res) != 0 {
+		t.Errorf("expected delete after replay to be logged, got %v", res)
+	}
+
+}
+
+func TestKillDuringFlush(t *testing.T) {
+
+	for _, point := range []string{"flush:segment", "flush:commit"} {
+		t.Run(point, func(t *testing.T) {
+
+			index, dir := newTestIndex(t)
+			defer os.RemoveAll(dir)
+			defer UnmapAll()
+			index = restart(t, index, dir, 3)
+
+			paths := writeDocs(t, dir, 3)
+			for _, path := range paths[:2] {
+				if _, err := index.AddDocument(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := index.DeleteDocument(0); err != nil {
+				t.Fatal(err)
+			}
+			index.Close()
+			UnmapAll()
+
+			// the third document fills Z0 of the writer that replays the log
+			crashAt(t, dir, point, paths[2])
+
+			// the writer also died in the middle of appending the next record
+			log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			log.Write([]byte{0xff, 0xff, 0, 0, 12, 0})
+			log.Close()
+
+			index, err = OpenIndex(dir, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.Close()
+
+			files, _ := filepath.Glob(filepath.Join(dir, "segment*"))
+			if len(files) != len(current(index).segments)-1 {
+				t.Errorf("expected segments of the commit point only, got %v", files)
+			}
+
+			// every acknowledged document is found once
+			res, err := CosineScore(index, "What did", 10)
+			if err != nil || len(res) != 4 {
+				t.Errorf("expected text2.txt and 3 added documents, got %v, %v", res, err)
+			}
+			seen := make(map[string]bool)
+			for _, r := range res {
+				if seen[r.File] || r.File == "../spimi/data/text1.txt" {
+					t.Errorf("unexpected result %v", res)
+				}
+				seen[r.File] = true
+			}
+
+			// the next flush cuts the log, the torn record is gone
+			for i := 0; i == 0 || len(current(index).memory) > 0; i++ {
+				next := filepath.Join(dir, fmt.Sprintf("next%d.txt", i))
+				ioutil.WriteFile(next, []byte("what did giraffe say"), 0666)
+				if _, err := index.AddDocument(next); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, logFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if records, size, err := corpus.ReadLog(data); err != nil || len(records) != 0 || size != len(data) {
+				t.Errorf("expected empty log, got %d records, %d of %d bytes, %v", len(records), size, len(data), err)
+			}
+
+		})
+	}
+
+}
+
+// Documents of one file are logged as the file and split again on replay
+func TestLogReplayDocumentsOfFile(t *testing.T) {
+
+	index, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer UnmapAll()
+	index = restart(t, index, dir, 10)
+
+	path := filepath.Join(dir, "rows.data")
+	ioutil.WriteFile(path, []byte("{\"title\": \"Zebra\", \"body\": \"what did zebra say\", \"id\": \"z\"}\n{\"body\": \"what did giraffe say\"}\n"), 0666)
+	index.SetParserConfig(corpus.ParserConfig{Format: "jsonl", TextField: "body"})
+
+	first, err := index.AddDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+
+	// the config of the replaying index does not matter, the record keeps it
+	index = restart(t, index, dir, 10)
+	defer index.Close()
+
+	if next := index.registry.NextID(); next != first+2 {
+		t.Errorf("expected IDs %d and %d for the documents of the file, next is %d", first, first+1, next)
+	}
+	if info, ok := index.Document(first); !ok || info.Title != "Zebra" || info.Path != path {
+		t.Errorf("expected the first row registered, got %v, %v", info, ok)
+	}
+	if doc, err := index.StoredDocument(first); err != nil || doc.Text != "what did zebra say" || doc.Fields["id"] != "z" {
+		t.Errorf("expected text and fields of the first row, got %v, %v", doc, err)
+	}
+	if res, _ := CosineScore(index, "giraffe", 10); len(res) != 1 || res[0].DocID != first+1 {
+		t.Errorf("expected the second row, got %v", res)
+	}
+
+	// an update replaces every document of the file
+	ioutil.WriteFile(path, []byte("{\"body\": \"what did lion say\"}\n"), 0666)
+	updated, err := index.UpdateDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := CosineScore(index, "zebra giraffe", 10); len(res) != 0 {
+		t.Errorf("expected old rows to be deleted, got %v", res)
+	}
+	if res, _ := CosineScore(index, "lion", 10); len(res) != 1 || res[0].DocID != updated {
+		t.Errorf("expected the new row, got %v", res)
+	}
+
+}
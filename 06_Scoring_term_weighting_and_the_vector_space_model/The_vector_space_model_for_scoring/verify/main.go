@@ -0,0 +1,34 @@
+package main
+
+import (
+	"../storage"
+	"flag"
+	"log"
+	"os"
+)
+
+// Check that index.dat and block files of every segment of the storage agree
+// and print a repair report per segment. Exit code is 1 when problems are found.
+//
+//	go run main.go -root ../storage -dir blocks
+func main() {
+
+	root := flag.String("root", ".", "directory the block storage was built in, block paths are relative to it")
+	dir := flag.String("dir", "blocks", "dir of the storage's commit point, relative to root")
+	flag.Parse()
+
+	if err := os.Chdir(*root); err != nil {
+		log.Fatal(err)
+	}
+
+	ok := true
+	for _, report := range storage.VerifyStorage(*dir) {
+		report.Print(os.Stdout)
+		ok = ok && report.OK()
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+
+}